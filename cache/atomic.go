@@ -0,0 +1,56 @@
+package cache
+
+import (
+	"context"
+	"errors"
+
+	"github.com/bitrise-steplib/bitrise-step-restore-cache/cache/compression"
+)
+
+const restoreOutcomeEnvVar = "BITRISE_CACHE_RESTORE_OUTCOME"
+
+// Values of BITRISE_CACHE_RESTORE_OUTCOME, they tell the state the restore left the target locations in.
+const (
+	// outcomeRestored means the archive was extracted to the target locations
+	outcomeRestored = "restored"
+	// outcomeNotRestored means nothing was written to the target locations
+	outcomeNotRestored = "not_restored"
+	// outcomeRolledBack means moving the staged files into place failed, and the files moved so far were moved back
+	outcomeRolledBack = "rolled_back"
+	// outcomePartiallyRestored means the restore failed, and the target locations can contain some of the archive entries
+	outcomePartiallyRestored = "partially_restored"
+)
+
+// decompress extracts the archive file to the target locations. An atomic restore extracts it into a staging
+// directory first, and only moves the entries into place once the whole archive is extracted.
+func (r *restorer) decompress(ctx context.Context, archiver *compression.Archiver, archivePath string, config restoreCacheConfig) error {
+	if !config.IsAtomic {
+		if err := archiver.Decompress(ctx, archivePath, config.Decompression); err != nil {
+			return extractionError(ctx, err)
+		}
+		return nil
+	}
+
+	staged, err := archiver.Stage(ctx, archivePath, config.Decompression)
+	if err != nil {
+		return extractionError(ctx, err)
+	}
+	r.logger.Debugf("Moving restored files into place")
+	return staged.Commit()
+}
+
+// failureOutcome returns the outcome of a restore that failed after the extraction started.
+func failureOutcome(err error, isAtomic bool) string {
+	var commitErr *compression.CommitError
+	switch {
+	case errors.As(err, &commitErr) && commitErr.RollbackErr != nil:
+		return outcomePartiallyRestored
+	case errors.As(err, &commitErr):
+		return outcomeRolledBack
+	case isAtomic:
+		// The staging directory was discarded
+		return outcomeNotRestored
+	default:
+		return outcomePartiallyRestored
+	}
+}
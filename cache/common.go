@@ -8,6 +8,7 @@ import (
 )
 
 const cacheHitEnvVar = "BITRISE_CACHE_HIT"
+const matchedKeyEnvVar = "BITRISE_CACHE_MATCHED_KEY"
 
 // We need this prefix because there could be multiple restore steps in one workflow with multiple cache keys
 const cacheHitUniqueEnvVarPrefix = "BITRISE_CACHE_HIT__"
@@ -28,3 +29,13 @@ func checksumOfFile(path string) (string, error) {
 
 	return hex.EncodeToString(hash.Sum(nil)), nil
 }
+
+// countingWriter counts the bytes written through it, such as the size of a streamed archive.
+type countingWriter struct {
+	count int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.count += int64(len(p))
+	return len(p), nil
+}
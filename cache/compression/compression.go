@@ -0,0 +1,384 @@
+package compression
+
+import (
+	"archive/tar"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/bitrise-io/go-utils/v2/command"
+	"github.com/bitrise-io/go-utils/v2/env"
+	"github.com/bitrise-io/go-utils/v2/log"
+	"github.com/klauspost/compress/zstd"
+)
+
+// ArchiveDependencyChecker ...
+type ArchiveDependencyChecker interface {
+	CheckDependencies() bool
+}
+
+// DependencyChecker ...
+type DependencyChecker struct {
+	logger  log.Logger
+	envRepo env.Repository
+}
+
+// NewDependencyChecker ...
+func NewDependencyChecker(logger log.Logger, envRepo env.Repository) *DependencyChecker {
+	return &DependencyChecker{
+		logger:  logger,
+		envRepo: envRepo,
+	}
+}
+
+// CheckDependencies ...
+func (dc *DependencyChecker) CheckDependencies() bool {
+	return dc.checkDependency("tar") && dc.checkDependency("zstd")
+}
+
+func (dc *DependencyChecker) checkDependency(binaryName string) bool {
+	cmdFactory := command.NewFactory(dc.envRepo)
+	cmd := cmdFactory.Create("which", []string{binaryName}, nil)
+	dc.logger.Debugf("$ %s", cmd.PrintableCommandArgs())
+
+	_, err := cmd.RunAndReturnTrimmedCombinedOutput()
+	return err == nil
+}
+
+// Archiver ...
+type Archiver struct {
+	logger                   log.Logger
+	envRepo                  env.Repository
+	archiveDependencyChecker ArchiveDependencyChecker
+}
+
+// NewArchiver ...
+func NewArchiver(logger log.Logger, envRepo env.Repository, archiveDependencyChecker ArchiveDependencyChecker) *Archiver {
+	return &Archiver{
+		logger:                   logger,
+		envRepo:                  envRepo,
+		archiveDependencyChecker: archiveDependencyChecker,
+	}
+}
+
+// DecompressOptions ...
+type DecompressOptions struct {
+	// DestinationDirectory is the root directory of the extracted files. Absolute paths in the archive are extracted
+	// relative to this directory. If empty, absolute paths are extracted to their original location.
+	DestinationDirectory string
+	// PathMappings rewrite path prefixes of the archive entries (and absolute symlink targets) before extraction.
+	PathMappings []PathMapping
+	// SafeExtraction rejects entries with `..` path components, entries writing through symlinks extracted from
+	// the same archive, and entries outside AllowedPaths. Unsafe entries are never extracted and fail the extraction.
+	SafeExtraction bool
+	// AllowedPaths are the absolute root directories safe extraction is allowed to write to. Empty means no restriction.
+	AllowedPaths []string
+	// ProgressInterval is how often the extraction progress is logged. Disabled if zero.
+	ProgressInterval time.Duration
+	// relativeRoot is the directory relative entries are extracted to (after the path mappings), set when the archive
+	// is staged without a destination. tar extracts them to the working directory, the staging directory has to
+	// keep them apart from the absolute entries.
+	relativeRoot string
+}
+
+// Decompress takes an archive path and extracts files. This assumes an archive created with absolute file paths.
+// The extraction stops once ctx is done, the files extracted so far are kept.
+func (a *Archiver) Decompress(ctx context.Context, archivePath string, opts DecompressOptions) error {
+	if err := prepareDestination(opts); err != nil {
+		return err
+	}
+	return a.decompress(ctx, archivePath, opts, opts)
+}
+
+// decompress validates the entries against their targets derived from opts, and extracts them as set by extractOpts,
+// which only differs from opts in the destination directory when the archive is staged.
+func (a *Archiver) decompress(ctx context.Context, archivePath string, opts, extractOpts DecompressOptions) error {
+	if opts.SafeExtraction {
+		a.logger.Infof("Validating archive entries before extraction")
+		if err := validateArchive(archivePath, opts); err != nil {
+			return fmt.Errorf("safe extraction: %w", err)
+		}
+	}
+
+	var archiveSize int64
+	if fileInfo, err := os.Stat(archivePath); err == nil {
+		archiveSize = fileInfo.Size()
+	}
+	progress, stopProgress := a.startExtractionProgress(opts, archiveSize)
+	defer stopProgress()
+
+	if !a.canUseBinary(extractOpts) {
+		a.logger.Infof("Falling back to native implementation of zstd.")
+		if err := a.decompressWithGolib(ctx, archivePath, extractOpts, progress); err != nil {
+			return decompressError(ctx, err)
+		}
+		return nil
+	}
+
+	a.logger.Infof("Using installed zstd binary")
+	if err := a.decompressFileWithBinary(ctx, archivePath, extractOpts, progress); err != nil {
+		return decompressError(ctx, err)
+	}
+	return nil
+}
+
+// DecompressStream works like Decompress, but reads the compressed archive from a stream instead of a file.
+// With SafeExtraction, the stream can't be validated up front: the entries preceding an unsafe entry are extracted,
+// use StageStream to keep the target locations unchanged.
+// The stream is not necessarily read until EOF, callers should drain it if they need every byte to be consumed.
+func (a *Archiver) DecompressStream(ctx context.Context, archive io.Reader, opts DecompressOptions) error {
+	if err := prepareDestination(opts); err != nil {
+		return err
+	}
+	return a.decompressStream(ctx, archive, opts, opts)
+}
+
+// decompressStream is the streaming counterpart of decompress.
+func (a *Archiver) decompressStream(ctx context.Context, archive io.Reader, opts, extractOpts DecompressOptions) error {
+	progress, stopProgress := a.startExtractionProgress(opts, 0)
+	defer stopProgress()
+	archive = progress.countReader(contextReader{ctx: ctx, reader: archive})
+
+	if opts.SafeExtraction {
+		if err := a.decompressStreamSafely(archive, opts, extractOpts, progress); err != nil {
+			if ctx.Err() != nil {
+				return decompressError(ctx, err)
+			}
+			return err
+		}
+		return nil
+	}
+
+	if !a.canUseBinary(extractOpts) {
+		a.logger.Infof("Falling back to native implementation of zstd.")
+		if err := a.extractWithGolib(archive, extractOpts, progress); err != nil {
+			return decompressError(ctx, err)
+		}
+		return nil
+	}
+
+	a.logger.Infof("Using installed zstd binary")
+	if err := a.decompressWithBinary("-", archive, true, extractOpts); err != nil {
+		return decompressError(ctx, err)
+	}
+	return nil
+}
+
+// decompressError reports the context error instead of the error of the interrupted extraction, if ctx is done.
+func decompressError(ctx context.Context, err error) error {
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return fmt.Errorf("decompress files: %w", ctxErr)
+	}
+	return fmt.Errorf("decompress files: %w", err)
+}
+
+// contextReader fails reading once ctx is done, which interrupts the extraction reading from it.
+type contextReader struct {
+	ctx    context.Context
+	reader io.Reader
+}
+
+func (r contextReader) Read(b []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.reader.Read(b)
+}
+
+// decompressStreamSafely validates the entries of the stream on the fly. Only the safe entries are passed on to
+// the extractor (as an uncompressed tar stream), the unsafe ones are reported once the whole stream is processed.
+// The extraction progress counts the entries passed on to the extractor.
+func (a *Archiver) decompressStreamSafely(archive io.Reader, opts, extractOpts DecompressOptions, progress *extractionProgress) error {
+	validator, err := newEntryValidator(opts)
+	if err != nil {
+		return err
+	}
+
+	pipeReader, pipeWriter := io.Pipe()
+	filterErrC := make(chan error, 1)
+	go func() {
+		err := filterUnsafeEntries(archive, pipeWriter, validator, progress)
+		pipeWriter.CloseWithError(err) //nolint:errcheck
+		filterErrC <- err
+	}()
+
+	var extractErr error
+	if !a.canUseBinary(extractOpts) {
+		a.logger.Infof("Using native tar extraction with safe extraction checks")
+		extractErr = a.extractTar(tar.NewReader(pipeReader), extractOpts, nil)
+	} else {
+		a.logger.Infof("Using installed tar binary with safe extraction checks")
+		extractErr = a.decompressWithBinary("-", pipeReader, false, extractOpts)
+	}
+	if extractErr != nil {
+		pipeReader.CloseWithError(extractErr) //nolint:errcheck
+	}
+
+	// A failing extractor closes the pipe, which makes the filter fail too, so the extractor error is the root cause
+	filterErr := <-filterErrC
+	if extractErr != nil {
+		return fmt.Errorf("decompress files: %w", extractErr)
+	}
+	if filterErr != nil {
+		return fmt.Errorf("decompress files: %w", filterErr)
+	}
+	if err := validator.err(); err != nil {
+		return fmt.Errorf("safe extraction: %w", err)
+	}
+	return nil
+}
+
+func (a *Archiver) canUseBinary(opts DecompressOptions) bool {
+	if !a.archiveDependencyChecker.CheckDependencies() {
+		return false
+	}
+	if len(opts.PathMappings) > 0 && a.tarFlavor() == unknownTar {
+		a.logger.Warnf("Path mappings are not supported by the installed tar binary")
+		return false
+	}
+	if opts.relativeRoot != "" && a.tarFlavor() == unknownTar {
+		a.logger.Warnf("Staging relative paths is not supported by the installed tar binary")
+		return false
+	}
+	return true
+}
+
+func prepareDestination(opts DecompressOptions) error {
+	if opts.DestinationDirectory == "" {
+		return nil
+	}
+	if err := os.MkdirAll(opts.DestinationDirectory, 0755); err != nil {
+		return fmt.Errorf("create destination directory: %w", err)
+	}
+	return nil
+}
+
+type tarFlavorType int
+
+const (
+	unknownTar tarFlavorType = iota
+	gnuTar
+	bsdTar
+)
+
+func (a *Archiver) tarFlavor() tarFlavorType {
+	cmd := command.NewFactory(a.envRepo).Create("tar", []string{"--version"}, nil)
+	a.logger.Debugf("$ %s", cmd.PrintableCommandArgs())
+
+	out, err := cmd.RunAndReturnTrimmedCombinedOutput()
+	switch {
+	case err != nil:
+		return unknownTar
+	case strings.Contains(out, "GNU tar"):
+		return gnuTar
+	case strings.Contains(out, "bsdtar"):
+		return bsdTar
+	default:
+		return unknownTar
+	}
+}
+
+func (a *Archiver) decompressWithGolib(ctx context.Context, archivePath string, opts DecompressOptions, progress *extractionProgress) error {
+	compressedFile, err := os.Open(archivePath)
+	if err != nil {
+		return fmt.Errorf("read file %s: %w", archivePath, err)
+	}
+	defer compressedFile.Close() //nolint:errcheck
+
+	return a.extractWithGolib(progress.countReader(contextReader{ctx: ctx, reader: compressedFile}), opts, progress)
+}
+
+func (a *Archiver) extractWithGolib(archive io.Reader, opts DecompressOptions, progress *extractionProgress) error {
+	zr, err := zstd.NewReader(archive)
+	if err != nil {
+		return fmt.Errorf("create zstd reader: %w", err)
+	}
+	defer zr.Close()
+
+	return a.extractTar(tar.NewReader(zr), opts, progress)
+}
+
+// decompressFileWithBinary extracts the archive at archivePath with tar. If the progress is reported or ctx can be done,
+// the archive is piped to tar, so the bytes read by tar can be counted, and closing the pipe interrupts tar.
+func (a *Archiver) decompressFileWithBinary(ctx context.Context, archivePath string, opts DecompressOptions, progress *extractionProgress) error {
+	if progress == nil && ctx.Done() == nil {
+		return a.decompressWithBinary(archivePath, nil, true, opts)
+	}
+
+	compressedFile, err := os.Open(archivePath)
+	if err != nil {
+		return fmt.Errorf("read file %s: %w", archivePath, err)
+	}
+	defer compressedFile.Close() //nolint:errcheck
+
+	return a.decompressWithBinary("-", progress.countReader(contextReader{ctx: ctx, reader: compressedFile}), true, opts)
+}
+
+// decompressWithBinary extracts the archive at archivePath with tar. If archivePath is "-", the archive is read from stdin.
+// The archive is zstd compressed unless isCompressed is false.
+func (a *Archiver) decompressWithBinary(archivePath string, stdin io.Reader, isCompressed bool, opts DecompressOptions) error {
+	commandFactory := command.NewFactory(a.envRepo)
+
+	/*
+		tar arguments:
+		--use-compress-program: Pipe the input to zstd instead of using the built-in gzip compression
+		-P: Alias for --absolute-paths in BSD tar and --absolute-names in GNU tar (step runs on both Linux and macOS)
+			Storing absolute paths in the archive allows paths outside the current directory (such as ~/.gradle)
+			Omitted when extracting into a destination directory, so that absolute paths are extracted relative to it.
+		-x: Extract archive
+		-f: Output file
+		--transform (GNU tar) and -s (BSD tar): Rewrite entry names, used for path mappings and staged relative entries
+		--xattrs --xattrs-include=* (GNU tar): Restore the extended attributes of every namespace, like BSD tar does by default
+	*/
+	var decompressTarArgs []string
+	if isCompressed {
+		decompressTarArgs = append(decompressTarArgs, "--use-compress-program", "zstd -d")
+	}
+	decompressTarArgs = append(decompressTarArgs,
+		"-x",
+		"-f", archivePath,
+	)
+
+	if opts.DestinationDirectory != "" {
+		decompressTarArgs = append(decompressTarArgs, "--directory", opts.DestinationDirectory)
+	} else {
+		decompressTarArgs = append(decompressTarArgs, "-P")
+	}
+
+	flavor := a.tarFlavor()
+	if flavor == gnuTar {
+		decompressTarArgs = append(decompressTarArgs, "--xattrs", "--xattrs-include=*")
+	}
+
+	expressions := tarTransformExpressions(opts.PathMappings)
+	if opts.relativeRoot != "" {
+		expressions = append(expressions, relativeRootExpression(opts.relativeRoot))
+	}
+	if len(expressions) > 0 {
+		for _, expression := range expressions {
+			if flavor == gnuTar {
+				decompressTarArgs = append(decompressTarArgs, "--transform", "s"+expression)
+			} else {
+				decompressTarArgs = append(decompressTarArgs, "-s", expression)
+			}
+		}
+	}
+
+	var cmdOpts *command.Opts
+	if stdin != nil {
+		cmdOpts = &command.Opts{Stdin: stdin}
+	}
+	cmd := commandFactory.Create("tar", decompressTarArgs, cmdOpts)
+	a.logger.Debugf("$ %s", cmd.PrintableCommandArgs())
+
+	out, err := cmd.RunAndReturnTrimmedCombinedOutput()
+	if err != nil {
+		a.logger.Printf("Output: %s", out)
+		return err
+	}
+
+	return nil
+}
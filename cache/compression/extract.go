@@ -0,0 +1,224 @@
+package compression
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const xattrPAXPrefix = "SCHILY.xattr."
+
+type extractedDir struct {
+	path    string
+	header  *tar.Header
+	created bool
+}
+
+// extractTar extracts the entries of tr the same way GNU tar does:
+// existing files are replaced instead of being written in place, hard links are recreated,
+// and modes, mtimes and extended attributes (PAX `SCHILY.xattr.*` records) are restored.
+// Extracted entries are counted by progress, which can be nil.
+func (a *Archiver) extractTar(tr *tar.Reader, opts DecompressOptions, progress *extractionProgress) error {
+	var dirs []extractedDir
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("read tar file: %w", err)
+		}
+
+		target := extractTarget(header.Name, opts)
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			created, err := extractDir(target)
+			if err != nil {
+				return err
+			}
+			dirs = append(dirs, extractedDir{path: target, header: header, created: created})
+		case tar.TypeReg:
+			if err := extractFile(target, header, tr); err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			linkname := header.Linkname
+			if filepath.IsAbs(linkname) {
+				linkname = remapPath(linkname, opts.PathMappings)
+			}
+			if err := extractSymlink(target, linkname); err != nil {
+				return err
+			}
+		case tar.TypeLink:
+			if err := extractHardLink(target, extractTarget(header.Linkname, opts)); err != nil {
+				return err
+			}
+		default:
+			a.logger.Warnf("Skipping %s: unsupported entry type %q", header.Name, header.Typeflag)
+			continue
+		}
+
+		if header.Typeflag != tar.TypeDir {
+			a.restoreMetadata(target, header)
+		}
+		progress.addEntry(header.Size)
+	}
+
+	// Directory metadata is restored last (deepest first), because extracting the directory content
+	// would update the mtime, and a read-only mode would prevent extracting the content at all.
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if dirs[i].created {
+			if err := os.Chmod(dirs[i].path, entryMode(dirs[i].header)); err != nil {
+				return fmt.Errorf("set mode of %s: %w", dirs[i].path, err)
+			}
+		}
+		a.restoreMetadata(dirs[i].path, dirs[i].header)
+	}
+
+	return nil
+}
+
+// extractTarget returns the path where an entry is extracted, taking path mappings and the destination into account.
+func extractTarget(name string, opts DecompressOptions) string {
+	target := remapPath(strings.TrimSuffix(filepath.ToSlash(name), "/"), opts.PathMappings)
+	if opts.relativeRoot != "" && !filepath.IsAbs(target) {
+		target = filepath.Join(opts.relativeRoot, target)
+	}
+	if opts.DestinationDirectory != "" {
+		target = filepath.Join(opts.DestinationDirectory, target)
+	}
+	return target
+}
+
+// entryMode returns the permission bits of the entry, including the setuid, setgid and sticky bits.
+func entryMode(header *tar.Header) fs.FileMode {
+	return header.FileInfo().Mode() & (fs.ModePerm | fs.ModeSetuid | fs.ModeSetgid | fs.ModeSticky)
+}
+
+// extractDir creates the directory if it doesn't exist yet. Its mode is set once its content is extracted.
+func extractDir(target string) (bool, error) {
+	info, err := os.Stat(target)
+	if err == nil && info.IsDir() {
+		return false, nil
+	}
+	if err := removeExisting(target); err != nil {
+		return false, err
+	}
+	if err := os.MkdirAll(target, 0700); err != nil {
+		return false, fmt.Errorf("create target directories: %w", err)
+	}
+	return true, nil
+}
+
+func extractFile(target string, header *tar.Header, content io.Reader) error {
+	if err := prepareTarget(target); err != nil {
+		return err
+	}
+
+	fileToWrite, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, entryMode(header))
+	if err != nil {
+		return fmt.Errorf("create file: %w", err)
+	}
+	// copy over contents
+	if _, err := io.Copy(fileToWrite, content); err != nil {
+		fileToWrite.Close() //nolint:errcheck
+		return fmt.Errorf("copy content to file: %w", err)
+	}
+	// manually close here after each file operation; defering would cause each file close
+	// to wait until all operations have completed.
+	if err := fileToWrite.Close(); err != nil {
+		return fmt.Errorf("write file: %w", err)
+	}
+	// The mode passed to OpenFile is masked by the umask
+	if err := os.Chmod(target, entryMode(header)); err != nil {
+		return fmt.Errorf("set mode of %s: %w", target, err)
+	}
+	return nil
+}
+
+func extractSymlink(target, linkname string) error {
+	if err := prepareTarget(target); err != nil {
+		return err
+	}
+	if err := os.Symlink(linkname, target); err != nil {
+		return fmt.Errorf("symlink file: %w", err)
+	}
+	return nil
+}
+
+func extractHardLink(target, linkTarget string) error {
+	if target == linkTarget {
+		return nil
+	}
+	if err := prepareTarget(target); err != nil {
+		return err
+	}
+	if err := os.Link(linkTarget, target); err != nil {
+		return fmt.Errorf("hard link file: %w", err)
+	}
+	return nil
+}
+
+// prepareTarget creates the parent directories of target and removes whatever non-directory already exists at target.
+// Replacing the file (instead of writing into it) doesn't follow existing symlinks and doesn't modify other hard links.
+func prepareTarget(target string) error {
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return fmt.Errorf("create target directories: %w", err)
+	}
+	return removeExisting(target)
+}
+
+func removeExisting(target string) error {
+	info, err := os.Lstat(target)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("check existing file: %w", err)
+	}
+	if info.IsDir() {
+		// Same as GNU tar: an existing directory is only replaced if it's empty
+		if err := os.Remove(target); err != nil {
+			return fmt.Errorf("replace directory %s: %w", target, err)
+		}
+		return nil
+	}
+	if err := os.Remove(target); err != nil {
+		return fmt.Errorf("remove existing file: %w", err)
+	}
+	return nil
+}
+
+// restoreMetadata restores the extended attributes and the modification time of the extracted entry.
+// Failures are not fatal, GNU tar only warns about them too.
+func (a *Archiver) restoreMetadata(target string, header *tar.Header) {
+	for key, value := range header.PAXRecords {
+		if !strings.HasPrefix(key, xattrPAXPrefix) {
+			continue
+		}
+		name := strings.TrimPrefix(key, xattrPAXPrefix)
+		if err := setXattr(target, name, []byte(value)); err != nil {
+			a.logger.Debugf("Failed to restore extended attribute %s of %s: %s", name, target, err)
+		}
+	}
+
+	accessTime := header.AccessTime
+	if accessTime.IsZero() {
+		accessTime = header.ModTime
+	}
+	var err error
+	if header.Typeflag == tar.TypeSymlink {
+		err = setSymlinkTimes(target, accessTime, header.ModTime)
+	} else {
+		err = os.Chtimes(target, accessTime, header.ModTime)
+	}
+	if err != nil {
+		a.logger.Debugf("Failed to restore modification time of %s: %s", target, err)
+	}
+}
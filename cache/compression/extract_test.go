@@ -0,0 +1,400 @@
+//go:build linux || darwin
+
+package compression
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/bitrise-io/go-utils/v2/env"
+	"github.com/bitrise-io/go-utils/v2/log"
+	"github.com/klauspost/compress/zstd"
+	"golang.org/x/sys/unix"
+)
+
+type fakeDependencyChecker bool
+
+func (c fakeDependencyChecker) CheckDependencies() bool {
+	return bool(c)
+}
+
+// fixtureEntry is an archive entry of a conformance fixture, the content is only used by regular files.
+type fixtureEntry struct {
+	header  tar.Header
+	content string
+}
+
+var fixtureTime = time.Date(2024, 3, 1, 12, 30, 0, 0, time.UTC)
+
+func file(name string, mode int64, content string) fixtureEntry {
+	return fixtureEntry{
+		header:  tar.Header{Typeflag: tar.TypeReg, Name: name, Mode: mode, Size: int64(len(content)), ModTime: fixtureTime},
+		content: content,
+	}
+}
+
+func dir(name string, mode int64, modTime time.Time) fixtureEntry {
+	return fixtureEntry{header: tar.Header{Typeflag: tar.TypeDir, Name: name + "/", Mode: mode, ModTime: modTime}}
+}
+
+func symlink(name, linkname string) fixtureEntry {
+	return fixtureEntry{header: tar.Header{Typeflag: tar.TypeSymlink, Name: name, Linkname: linkname, Mode: 0777, ModTime: fixtureTime}}
+}
+
+func hardLink(name, linkname string) fixtureEntry {
+	return fixtureEntry{header: tar.Header{Typeflag: tar.TypeLink, Name: name, Linkname: linkname, ModTime: fixtureTime}}
+}
+
+// TestExtractConformance extracts the same archives with the native extractor and with the tar binary,
+// and expects the same file trees.
+func TestExtractConformance(t *testing.T) {
+	for _, binary := range []string{"tar", "zstd"} {
+		if _, err := exec.LookPath(binary); err != nil {
+			t.Skipf("%s binary is not installed", binary)
+		}
+	}
+	// Both extractors have to restore the exact modes, the tar binary of a non-root user applies the umask otherwise
+	oldUmask := syscall.Umask(0)
+	defer syscall.Umask(oldUmask)
+
+	xattrEntry := file("xattr.txt", 0644, "with extended attributes")
+	xattrEntry.header.Format = tar.FormatPAX
+	xattrEntry.header.PAXRecords = map[string]string{xattrPAXPrefix + "user.cache": "restored"}
+
+	tests := []struct {
+		name string
+		// fixture returns the entries of the archive, root is the prefix of the absolute entry names
+		fixture func(root string) []fixtureEntry
+		// existing are files created in the extraction root before the extraction
+		existing map[string]string
+		// absolute extracts the entries to their absolute path, instead of into a destination directory
+		absolute bool
+	}{
+		{
+			name: "files and file modes",
+			fixture: func(string) []fixtureEntry {
+				return []fixtureEntry{
+					dir("dir", 0755, fixtureTime),
+					file("dir/regular.txt", 0644, "regular"),
+					file("dir/executable.sh", 0755, "#!/bin/sh"),
+					file("dir/private.txt", 0600, "private"),
+					file("dir/setgid", 02750, "setgid"),
+					file("dir/empty", 0644, ""),
+				}
+			},
+		},
+		{
+			name: "directory mtimes and modes",
+			fixture: func(string) []fixtureEntry {
+				return []fixtureEntry{
+					dir("a", 0750, fixtureTime.Add(-time.Hour)),
+					dir("a/b", 0700, fixtureTime.Add(-2*time.Hour)),
+					file("a/b/file", 0644, "content updates the directory mtimes"),
+					dir("a/c", 0555, fixtureTime.Add(-3*time.Hour)),
+				}
+			},
+		},
+		{
+			name: "symlinks",
+			fixture: func(string) []fixtureEntry {
+				return []fixtureEntry{
+					file("target.txt", 0644, "target"),
+					symlink("relative", "target.txt"),
+					symlink("absolute", "/nonexistent/target"),
+					symlink("dangling", "missing"),
+					dir("dir", 0755, fixtureTime),
+					symlink("dir/parent", "../target.txt"),
+				}
+			},
+		},
+		{
+			name: "hard links",
+			fixture: func(string) []fixtureEntry {
+				return []fixtureEntry{
+					dir("dir", 0755, fixtureTime),
+					file("dir/original", 0640, "shared content"),
+					hardLink("dir/link", "dir/original"),
+					hardLink("second-link", "dir/original"),
+				}
+			},
+		},
+		{
+			name: "overwriting a longer existing file",
+			fixture: func(string) []fixtureEntry {
+				return []fixtureEntry{
+					file("existing.txt", 0644, "short"),
+					symlink("existing-symlink", "existing.txt"),
+				}
+			},
+			existing: map[string]string{
+				"existing.txt":     "a much longer content that must not be left behind",
+				"existing-symlink": "a regular file replaced by a symlink",
+			},
+		},
+		{
+			name: "PAX extended attributes",
+			fixture: func(string) []fixtureEntry {
+				return []fixtureEntry{xattrEntry}
+			},
+		},
+		{
+			name: "absolute paths into a destination directory",
+			fixture: func(string) []fixtureEntry {
+				return []fixtureEntry{
+					dir("/abs", 0755, fixtureTime),
+					file("/abs/file.txt", 0644, "absolute"),
+					symlink("/abs/link", "/abs/file.txt"),
+					hardLink("/abs/hardlink", "/abs/file.txt"),
+				}
+			},
+		},
+		{
+			name:     "absolute paths",
+			absolute: true,
+			fixture: func(root string) []fixtureEntry {
+				return []fixtureEntry{
+					dir(root+"/abs", 0755, fixtureTime),
+					file(root+"/abs/file.txt", 0644, "absolute"),
+					symlink(root+"/abs/link", "file.txt"),
+					hardLink(root+"/abs/hardlink", root+"/abs/file.txt"),
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			trees := map[string]map[string]treeEntry{}
+			for _, useBinary := range []bool{false, true} {
+				backend := map[bool]string{false: "native", true: "binary"}[useBinary]
+				root := t.TempDir()
+
+				for name, content := range tt.existing {
+					if err := os.WriteFile(filepath.Join(root, name), []byte(content), 0644); err != nil {
+						t.Fatal(err)
+					}
+				}
+
+				opts := DecompressOptions{DestinationDirectory: root}
+				prefix := ""
+				if tt.absolute {
+					opts = DecompressOptions{}
+					prefix = root
+				}
+				archivePath := writeFixture(t, tt.fixture(prefix))
+
+				archiver := NewArchiver(log.NewLogger(), env.NewRepository(), fakeDependencyChecker(useBinary))
+				if err := archiver.Decompress(context.Background(), archivePath, opts); err != nil {
+					t.Fatalf("%s extraction failed: %s", backend, err)
+				}
+				trees[backend] = readTree(t, root)
+			}
+
+			if !reflect.DeepEqual(trees["native"], trees["binary"]) {
+				t.Errorf("native extraction differs from the tar binary:\n%s", diffTrees(trees["native"], trees["binary"]))
+			}
+		})
+	}
+}
+
+func writeFixture(t *testing.T, entries []fixtureEntry) string {
+	t.Helper()
+
+	var archive bytes.Buffer
+	zw, err := zstd.NewWriter(&archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tw := tar.NewWriter(zw)
+	for _, entry := range entries {
+		header := entry.header
+		if err := tw.WriteHeader(&header); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(entry.content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	archivePath := filepath.Join(t.TempDir(), "archive.tzst")
+	if err := os.WriteFile(archivePath, archive.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return archivePath
+}
+
+// treeEntry is everything the conformance test compares about an extracted entry.
+type treeEntry struct {
+	Type     string
+	Mode     fs.FileMode
+	ModTime  time.Time
+	Content  string
+	Linkname string
+	Xattrs   map[string]string
+	// HardLinks are the other paths of the tree with the same inode
+	HardLinks []string
+}
+
+func readTree(t *testing.T, root string) map[string]treeEntry {
+	t.Helper()
+
+	tree := map[string]treeEntry{}
+	inodes := map[uint64][]string{}
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || path == root {
+			return err
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		info, err := os.Lstat(path)
+		if err != nil {
+			return err
+		}
+
+		entry := treeEntry{Type: entryType(info.Mode()), Mode: info.Mode(), Xattrs: userXattrs(t, path)}
+		switch {
+		case info.Mode().IsRegular():
+			content, err := os.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			entry.Content = string(content)
+			entry.ModTime = info.ModTime()
+			inode := info.Sys().(*syscall.Stat_t).Ino
+			inodes[inode] = append(inodes[inode], rel)
+		case info.Mode()&fs.ModeSymlink != 0:
+			entry.Linkname, err = os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			// Only the target of symlinks is compared, the tar binaries differ in restoring their metadata
+			entry.Mode = fs.ModeSymlink
+		default:
+			entry.ModTime = info.ModTime()
+		}
+		tree[rel] = entry
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, paths := range inodes {
+		if len(paths) < 2 {
+			continue
+		}
+		for _, path := range paths {
+			entry := tree[path]
+			for _, other := range paths {
+				if other != path {
+					entry.HardLinks = append(entry.HardLinks, other)
+				}
+			}
+			sort.Strings(entry.HardLinks)
+			tree[path] = entry
+		}
+	}
+	return tree
+}
+
+func entryType(mode fs.FileMode) string {
+	switch {
+	case mode.IsDir():
+		return "dir"
+	case mode.IsRegular():
+		return "file"
+	case mode&fs.ModeSymlink != 0:
+		return "symlink"
+	default:
+		return "other"
+	}
+}
+
+// userXattrs returns the extended attributes of the user namespace, the others depend on the system.
+func userXattrs(t *testing.T, path string) map[string]string {
+	t.Helper()
+
+	size, err := unix.Llistxattr(path, nil)
+	if err != nil || size == 0 {
+		return nil
+	}
+	buf := make([]byte, size)
+	size, err = unix.Llistxattr(path, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	xattrs := map[string]string{}
+	for _, name := range strings.Split(strings.TrimRight(string(buf[:size]), "\x00"), "\x00") {
+		if !strings.HasPrefix(name, "user.") {
+			continue
+		}
+		value := make([]byte, 1024)
+		n, err := unix.Lgetxattr(path, name, value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		xattrs[name] = string(value[:n])
+	}
+	if len(xattrs) == 0 {
+		return nil
+	}
+	return xattrs
+}
+
+func diffTrees(native, binary map[string]treeEntry) string {
+	paths := map[string]bool{}
+	for path := range native {
+		paths[path] = true
+	}
+	for path := range binary {
+		paths[path] = true
+	}
+	var sorted []string
+	for path := range paths {
+		sorted = append(sorted, path)
+	}
+	sort.Strings(sorted)
+
+	var b strings.Builder
+	for _, path := range sorted {
+		nativeEntry, inNative := native[path]
+		binaryEntry, inBinary := binary[path]
+		if inNative && inBinary && reflect.DeepEqual(nativeEntry, binaryEntry) {
+			continue
+		}
+		b.WriteString(path + ":\n")
+		if inNative {
+			b.WriteString("  native: " + formatEntry(nativeEntry) + "\n")
+		}
+		if inBinary {
+			b.WriteString("  binary: " + formatEntry(binaryEntry) + "\n")
+		}
+	}
+	return b.String()
+}
+
+func formatEntry(entry treeEntry) string {
+	return fmt.Sprintf("%s %s mtime=%s content=%q link=%q xattrs=%v hardlinks=%v",
+		entry.Type, entry.Mode, entry.ModTime.UTC().Format(time.RFC3339Nano), entry.Content, entry.Linkname, entry.Xattrs, entry.HardLinks)
+}
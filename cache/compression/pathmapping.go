@@ -0,0 +1,94 @@
+package compression
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// PathMapping rewrites archive entries under the From path prefix to the To path prefix.
+type PathMapping struct {
+	From string
+	To   string
+}
+
+// ValidatePathMappings checks that the mappings can be applied independently of each other:
+// the target of a mapping can't be rewritten again by another mapping.
+func ValidatePathMappings(mappings []PathMapping) error {
+	for i, mapping := range mappings {
+		if mapping.From == "" || mapping.To == "" {
+			return fmt.Errorf("path mapping %s => %s has an empty side", mapping.From, mapping.To)
+		}
+		for j, other := range mappings {
+			if i == j {
+				continue
+			}
+			if hasPathPrefix(mapping.To, other.From) {
+				return fmt.Errorf("path mapping %s => %s would be rewritten again by %s => %s", mapping.From, mapping.To, other.From, other.To)
+			}
+		}
+	}
+	return nil
+}
+
+// remapPath applies the first mapping whose From prefix matches the path (on path component boundaries).
+func remapPath(path string, mappings []PathMapping) string {
+	for _, mapping := range mappings {
+		if path == mapping.From {
+			return mapping.To
+		}
+		if strings.HasPrefix(path, mapping.From+"/") {
+			return mapping.To + strings.TrimPrefix(path, mapping.From)
+		}
+	}
+	return path
+}
+
+func hasPathPrefix(path, prefix string) bool {
+	return path == prefix || strings.HasPrefix(path, prefix+"/")
+}
+
+// tarTransformExpressions converts the mappings to sed-like substitutions understood by both
+// GNU tar (`--transform`) and BSD tar (`-s`). Every mapping needs two expressions:
+// one for the entries under the prefix and one for the entry of the prefix itself.
+// The expressions match the whole name, because BSD tar matches the next expression against the rest of the name.
+func tarTransformExpressions(mappings []PathMapping) []string {
+	var expressions []string
+	for _, mapping := range mappings {
+		from := escapeTarPattern(mapping.From)
+		to := escapeTarReplacement(mapping.To)
+		expressions = append(expressions,
+			fmt.Sprintf(`,^%s/\(.*\),%s/\1,`, from, to),
+			fmt.Sprintf(",^%s$,%s,", from, to),
+		)
+	}
+	return expressions
+}
+
+// relativeRootExpression returns the substitution prefixing the relative entry names with root. It has to come after
+// the expressions of the path mappings, the names they rewrite are absolute. Symlink targets are left unchanged (`S`).
+func relativeRootExpression(root string) string {
+	return fmt.Sprintf(`,^\([^/].*\),%s/\1,S`, escapeTarReplacement(filepath.ToSlash(root)))
+}
+
+func escapeTarPattern(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if strings.ContainsRune(`\.[]*^$,`, r) {
+			b.WriteRune('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+func escapeTarReplacement(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if strings.ContainsRune(`\&,`, r) {
+			b.WriteRune('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
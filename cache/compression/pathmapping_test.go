@@ -0,0 +1,106 @@
+//go:build linux || darwin
+
+package compression
+
+import (
+	"context"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/bitrise-io/go-utils/v2/env"
+	"github.com/bitrise-io/go-utils/v2/log"
+)
+
+func TestRemapPath(t *testing.T) {
+	mappings := []PathMapping{
+		{From: "/home/ubuntu", To: "/Users/vagrant"},
+		{From: "/root/.gradle", To: "/Users/vagrant/.gradle"},
+	}
+	tests := []struct {
+		path string
+		want string
+	}{
+		{path: "/home/ubuntu/.npm/cache", want: "/Users/vagrant/.npm/cache"},
+		{path: "/home/ubuntu", want: "/Users/vagrant"},
+		// Prefixes only match whole path components
+		{path: "/home/ubuntu2/file", want: "/home/ubuntu2/file"},
+		{path: "/root/.gradle/caches", want: "/Users/vagrant/.gradle/caches"},
+		{path: "node_modules/pkg", want: "node_modules/pkg"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			if got := remapPath(tt.path, mappings); got != tt.want {
+				t.Errorf("remapPath() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidatePathMappings(t *testing.T) {
+	tests := []struct {
+		name     string
+		mappings []PathMapping
+		wantErr  bool
+	}{
+		{name: "independent mappings", mappings: []PathMapping{{From: "/a", To: "/b"}, {From: "/c", To: "/d"}}},
+		{name: "swapped prefixes", mappings: []PathMapping{{From: "/a", To: "/b"}, {From: "/b", To: "/a"}}, wantErr: true},
+		{name: "target rewritten by a shorter prefix", mappings: []PathMapping{{From: "/a", To: "/b/c"}, {From: "/b", To: "/d"}}, wantErr: true},
+		{name: "similar prefix", mappings: []PathMapping{{From: "/a", To: "/bc"}, {From: "/b", To: "/d"}}},
+		{name: "empty side", mappings: []PathMapping{{From: "/a", To: ""}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := ValidatePathMappings(tt.mappings); (err != nil) != tt.wantErr {
+				t.Errorf("ValidatePathMappings() error = %v, wantErr %t", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// TestExtractWithPathMappings applies the same mappings with the native extractor and with the tar binary.
+func TestExtractWithPathMappings(t *testing.T) {
+	archivePath := writeFixture(t, []fixtureEntry{
+		dir("/ci/home", 0755, fixtureTime),
+		file("/ci/home/.npm/index", 0644, "mapped"),
+		file("/ci/home.txt", 0644, "same prefix, different component"),
+		file("/ci/homework/notes", 0644, "not mapped"),
+		file("/ci/cache,with$special.chars/file", 0644, "special characters"),
+		file("relative/file", 0644, "relative"),
+	})
+	mappings := []PathMapping{
+		{From: "/ci/home", To: "/Users/vagrant"},
+		{From: "/ci/cache,with$special.chars", To: "/cache&more"},
+	}
+
+	for _, useBinary := range []bool{false, true} {
+		backend := map[bool]string{false: "native", true: "tar binary"}[useBinary]
+		t.Run(backend, func(t *testing.T) {
+			if useBinary {
+				for _, binary := range []string{"tar", "zstd"} {
+					if _, err := exec.LookPath(binary); err != nil {
+						t.Skipf("%s binary is not installed", binary)
+					}
+				}
+			}
+			destination := t.TempDir()
+
+			archiver := NewArchiver(log.NewLogger(), env.NewRepository(), fakeDependencyChecker(useBinary))
+			opts := DecompressOptions{DestinationDirectory: destination, PathMappings: mappings}
+			if err := archiver.Decompress(context.Background(), archivePath, opts); err != nil {
+				t.Fatalf("Decompress() error = %s", err)
+			}
+
+			want := map[string]string{
+				"Users/vagrant/.npm/index": "mapped",
+				"ci/home.txt":              "same prefix, different component",
+				"ci/homework/notes":        "not mapped",
+				"cache&more/file":          "special characters",
+				"relative/file":            "relative",
+			}
+			for path, content := range want {
+				assertFileContent(t, filepath.Join(destination, path), content)
+			}
+		})
+	}
+}
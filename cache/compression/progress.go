@@ -0,0 +1,99 @@
+package compression
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/docker/go-units"
+)
+
+// extractionProgress counts the extracted entries and the compressed archive bytes read so far.
+// Entries are only counted if the entries are extracted (or filtered) by the native implementation,
+// the tar binary doesn't report its progress. All methods are no-ops on a nil progress.
+type extractionProgress struct {
+	entries     int64
+	bytes       int64
+	archiveRead int64
+	// archiveSize is the size of the compressed archive, 0 if unknown (such as when streaming)
+	archiveSize int64
+}
+
+// startExtractionProgress logs the extraction progress every opts.ProgressInterval until the returned function is called.
+// The progress is nil if reporting is disabled.
+func (a *Archiver) startExtractionProgress(opts DecompressOptions, archiveSize int64) (*extractionProgress, func()) {
+	if opts.ProgressInterval <= 0 {
+		return nil, func() {}
+	}
+
+	progress := &extractionProgress{archiveSize: archiveSize}
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(opts.ProgressInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				a.logger.Printf("%s", progress.String())
+			}
+		}
+	}()
+
+	return progress, func() {
+		close(done)
+		<-stopped
+	}
+}
+
+func (p *extractionProgress) addEntry(size int64) {
+	if p == nil {
+		return
+	}
+	atomic.AddInt64(&p.entries, 1)
+	atomic.AddInt64(&p.bytes, size)
+}
+
+// countReader returns a reader counting the compressed archive bytes read from r.
+func (p *extractionProgress) countReader(r io.Reader) io.Reader {
+	if p == nil {
+		return r
+	}
+	return &progressReader{reader: r, progress: p}
+}
+
+func (p *extractionProgress) String() string {
+	var parts []string
+	if entries := atomic.LoadInt64(&p.entries); entries > 0 {
+		parts = append(parts, fmt.Sprintf("%d entries extracted (%s)", entries, humanSize(atomic.LoadInt64(&p.bytes))))
+	}
+
+	archiveRead := atomic.LoadInt64(&p.archiveRead)
+	if p.archiveSize > 0 {
+		parts = append(parts, fmt.Sprintf("%s of %s archive read (%d%%)", humanSize(archiveRead), humanSize(p.archiveSize), archiveRead*100/p.archiveSize))
+	} else {
+		parts = append(parts, fmt.Sprintf("%s archive read", humanSize(archiveRead)))
+	}
+
+	return "Extraction progress: " + strings.Join(parts, ", ")
+}
+
+type progressReader struct {
+	reader   io.Reader
+	progress *extractionProgress
+}
+
+func (r *progressReader) Read(b []byte) (int, error) {
+	n, err := r.reader.Read(b)
+	atomic.AddInt64(&r.progress.archiveRead, int64(n))
+	return n, err
+}
+
+func humanSize(size int64) string {
+	return units.HumanSizeWithPrecision(float64(size), 3)
+}
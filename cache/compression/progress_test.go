@@ -0,0 +1,105 @@
+//go:build linux || darwin
+
+package compression
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bitrise-io/go-utils/v2/env"
+	"github.com/bitrise-io/go-utils/v2/log"
+)
+
+// countingLogger counts the Printf calls, the rest of the log goes to the standard logger.
+type countingLogger struct {
+	log.Logger
+	mu    sync.Mutex
+	count int
+}
+
+func (l *countingLogger) Printf(string, ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.count++
+}
+
+func (l *countingLogger) printed() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.count
+}
+
+func TestExtractionProgressString(t *testing.T) {
+	tests := []struct {
+		name     string
+		progress extractionProgress
+		want     string
+	}{
+		{
+			name:     "known archive size",
+			progress: extractionProgress{entries: 12, bytes: 3000, archiveRead: 500, archiveSize: 2000},
+			want:     "Extraction progress: 12 entries extracted (3kB), 500B of 2kB archive read (25%)",
+		},
+		{
+			name:     "streamed archive",
+			progress: extractionProgress{entries: 1, bytes: 10, archiveRead: 500},
+			want:     "Extraction progress: 1 entries extracted (10B), 500B archive read",
+		},
+		{
+			// The tar binary doesn't report the extracted entries
+			name:     "tar binary",
+			progress: extractionProgress{archiveRead: 1000, archiveSize: 4000},
+			want:     "Extraction progress: 1kB of 4kB archive read (25%)",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.progress.String(); got != tt.want {
+				t.Errorf("String() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExtractionProgressInterval(t *testing.T) {
+	logger := &countingLogger{Logger: log.NewLogger()}
+	archiver := NewArchiver(logger, env.NewRepository(), fakeDependencyChecker(false))
+
+	progress, stop := archiver.startExtractionProgress(DecompressOptions{ProgressInterval: 20 * time.Millisecond}, 100)
+	if _, err := io.Copy(io.Discard, progress.countReader(strings.NewReader("archive"))); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(110 * time.Millisecond)
+	stop()
+
+	printed := logger.printed()
+	// 5 ticks are expected, a loaded machine can skip some of them
+	if printed < 2 || printed > 5 {
+		t.Errorf("logged %d progress lines in 110ms with a 20ms interval", printed)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if logger.printed() != printed {
+		t.Errorf("progress was logged after the extraction finished")
+	}
+}
+
+func TestExtractionProgressDisabled(t *testing.T) {
+	logger := &countingLogger{Logger: log.NewLogger()}
+	archiver := NewArchiver(logger, env.NewRepository(), fakeDependencyChecker(false))
+
+	progress, stop := archiver.startExtractionProgress(DecompressOptions{}, 100)
+	defer stop()
+	if progress != nil {
+		t.Fatalf("progress is reported without an interval")
+	}
+	// A nil progress is a no-op
+	progress.addEntry(10)
+	reader := bytes.NewReader([]byte("archive"))
+	if progress.countReader(reader) != io.Reader(reader) {
+		t.Errorf("countReader() wrapped the reader of a disabled progress")
+	}
+}
@@ -0,0 +1,230 @@
+package compression
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const maxReportedUnsafeEntries = 50
+
+// UnsafeEntry is an archive entry rejected by safe extraction.
+type UnsafeEntry struct {
+	Name   string
+	Reason string
+}
+
+// UnsafeEntriesError is returned when safe extraction finds entries that could write outside the allowed paths.
+type UnsafeEntriesError struct {
+	Entries []UnsafeEntry
+}
+
+func (e *UnsafeEntriesError) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "archive contains %d unsafe entries:", len(e.Entries))
+	for i, entry := range e.Entries {
+		if i == maxReportedUnsafeEntries {
+			fmt.Fprintf(&b, "\n- ... and %d more", len(e.Entries)-maxReportedUnsafeEntries)
+			break
+		}
+		fmt.Fprintf(&b, "\n- %s: %s", entry.Name, entry.Reason)
+	}
+	return b.String()
+}
+
+// entryValidator checks archive entries against the safe extraction rules. Entries have to be validated in archive order,
+// because the validator keeps track of the symlinks extracted so far.
+type entryValidator struct {
+	opts          DecompressOptions
+	workDir       string
+	symlinks      map[string]bool
+	unsafeEntries []UnsafeEntry
+}
+
+func newEntryValidator(opts DecompressOptions) (*entryValidator, error) {
+	workDir, err := os.Getwd()
+	if err != nil {
+		return nil, err
+	}
+	return &entryValidator{
+		opts:     opts,
+		workDir:  workDir,
+		symlinks: map[string]bool{},
+	}, nil
+}
+
+// validate returns false if the entry must not be extracted. The reason is recorded for the final report.
+func (v *entryValidator) validate(header *tar.Header) bool {
+	reason := v.check(header)
+	if reason != "" {
+		v.unsafeEntries = append(v.unsafeEntries, UnsafeEntry{Name: header.Name, Reason: reason})
+		return false
+	}
+
+	if header.Typeflag == tar.TypeSymlink {
+		v.symlinks[v.targetPath(header.Name)] = true
+	}
+	return true
+}
+
+func (v *entryValidator) err() error {
+	if len(v.unsafeEntries) == 0 {
+		return nil
+	}
+	return &UnsafeEntriesError{Entries: v.unsafeEntries}
+}
+
+func (v *entryValidator) check(header *tar.Header) string {
+	switch header.Typeflag {
+	case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+		return "device and FIFO entries are not allowed"
+	}
+
+	if hasDotDotComponent(header.Name) {
+		return "path contains a `..` component"
+	}
+
+	target := v.targetPath(header.Name)
+	if !v.isAllowed(target) {
+		return fmt.Sprintf("%s is outside of the allowed paths", target)
+	}
+	if link := v.symlinkAncestor(target); link != "" {
+		return fmt.Sprintf("would write through the symlink %s extracted earlier", link)
+	}
+	if header.Typeflag != tar.TypeSymlink && v.symlinks[target] {
+		return "would write through the symlink extracted earlier to the same path"
+	}
+
+	if header.Typeflag == tar.TypeLink {
+		if hasDotDotComponent(header.Linkname) {
+			return "hard link target contains a `..` component"
+		}
+		linkTarget := v.targetPath(header.Linkname)
+		if !v.isAllowed(linkTarget) {
+			return fmt.Sprintf("hard link target %s is outside of the allowed paths", linkTarget)
+		}
+		// The link target is resolved by the filesystem, so it must not go through the symlinks of the archive either
+		if link := v.symlinkAncestor(linkTarget); link != "" {
+			return fmt.Sprintf("hard link target resolves through the symlink %s extracted earlier", link)
+		}
+		if v.symlinks[linkTarget] {
+			return "hard link target is a symlink extracted earlier"
+		}
+	}
+
+	return ""
+}
+
+// targetPath returns the absolute path where an entry is extracted, taking path mappings and the destination into account.
+func (v *entryValidator) targetPath(name string) string {
+	target := extractTarget(name, v.opts)
+	if !filepath.IsAbs(target) {
+		return filepath.Join(v.workDir, target)
+	}
+	return filepath.Clean(target)
+}
+
+func (v *entryValidator) isAllowed(target string) bool {
+	if len(v.opts.AllowedPaths) == 0 {
+		return true
+	}
+	for _, allowedPath := range v.opts.AllowedPaths {
+		if hasPathPrefix(target, filepath.Clean(allowedPath)) || filepath.Clean(allowedPath) == "/" {
+			return true
+		}
+	}
+	return false
+}
+
+func (v *entryValidator) symlinkAncestor(target string) string {
+	for dir := filepath.Dir(target); dir != filepath.Dir(dir); dir = filepath.Dir(dir) {
+		if v.symlinks[dir] {
+			return dir
+		}
+	}
+	return ""
+}
+
+func hasDotDotComponent(name string) bool {
+	for _, component := range strings.Split(filepath.ToSlash(name), "/") {
+		if component == ".." {
+			return true
+		}
+	}
+	return false
+}
+
+// validateArchive checks every entry of the archive before anything is extracted.
+func validateArchive(archivePath string, opts DecompressOptions) error {
+	validator, err := newEntryValidator(opts)
+	if err != nil {
+		return err
+	}
+
+	compressedFile, err := os.Open(archivePath)
+	if err != nil {
+		return fmt.Errorf("read file %s: %w", archivePath, err)
+	}
+	defer compressedFile.Close() //nolint:errcheck
+
+	zr, err := zstd.NewReader(compressedFile)
+	if err != nil {
+		return fmt.Errorf("create zstd reader: %w", err)
+	}
+	defer zr.Close()
+
+	tr := tar.NewReader(zr)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("read tar file: %w", err)
+		}
+		validator.validate(header)
+	}
+
+	return validator.err()
+}
+
+// filterUnsafeEntries decompresses the archive and writes only the safe entries to dest, as an uncompressed tar stream.
+// Rejected entries are recorded by the validator.
+func filterUnsafeEntries(archive io.Reader, dest io.Writer, validator *entryValidator, progress *extractionProgress) error {
+	zr, err := zstd.NewReader(archive)
+	if err != nil {
+		return fmt.Errorf("create zstd reader: %w", err)
+	}
+	defer zr.Close()
+
+	tr := tar.NewReader(zr)
+	tw := tar.NewWriter(dest)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("read tar file: %w", err)
+		}
+
+		if !validator.validate(header) {
+			continue
+		}
+
+		if err := tw.WriteHeader(header); err != nil {
+			return fmt.Errorf("write tar header: %w", err)
+		}
+		if _, err := io.Copy(tw, tr); err != nil {
+			return fmt.Errorf("copy tar entry: %w", err)
+		}
+		progress.addEntry(header.Size)
+	}
+
+	return tw.Close()
+}
@@ -0,0 +1,116 @@
+package compression
+
+import (
+	"archive/tar"
+	"path/filepath"
+	"testing"
+)
+
+func TestEntryValidator(t *testing.T) {
+	dest := t.TempDir()
+	tests := []struct {
+		name    string
+		entries []*tar.Header
+		// wantRejected are the names of the rejected entries, in archive order
+		wantRejected []string
+	}{
+		{
+			name: "regular entries",
+			entries: []*tar.Header{
+				{Name: "dir/", Typeflag: tar.TypeDir},
+				{Name: "dir/file", Typeflag: tar.TypeReg},
+				{Name: "dir/link", Typeflag: tar.TypeSymlink, Linkname: "file"},
+				{Name: "dir/hardlink", Typeflag: tar.TypeLink, Linkname: "dir/file"},
+			},
+		},
+		{
+			name: "path traversal",
+			entries: []*tar.Header{
+				{Name: "../escape", Typeflag: tar.TypeReg},
+				{Name: "hardlink", Typeflag: tar.TypeLink, Linkname: "../escape"},
+			},
+			wantRejected: []string{"../escape", "hardlink"},
+		},
+		{
+			name: "write through a symlink",
+			entries: []*tar.Header{
+				{Name: "a", Typeflag: tar.TypeSymlink, Linkname: "/etc"},
+				{Name: "a/passwd", Typeflag: tar.TypeReg},
+			},
+			wantRejected: []string{"a/passwd"},
+		},
+		{
+			name: "hard link through a symlink",
+			entries: []*tar.Header{
+				{Name: "a", Typeflag: tar.TypeSymlink, Linkname: "/etc"},
+				{Name: "b", Typeflag: tar.TypeLink, Linkname: "a/passwd"},
+			},
+			wantRejected: []string{"b"},
+		},
+		{
+			name: "hard link to a symlink",
+			entries: []*tar.Header{
+				{Name: "a", Typeflag: tar.TypeSymlink, Linkname: "/etc/passwd"},
+				{Name: "b", Typeflag: tar.TypeLink, Linkname: "a"},
+			},
+			wantRejected: []string{"b"},
+		},
+		{
+			name: "devices",
+			entries: []*tar.Header{
+				{Name: "fifo", Typeflag: tar.TypeFifo},
+			},
+			wantRejected: []string{"fifo"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			validator, err := newEntryValidator(DecompressOptions{
+				DestinationDirectory: dest,
+				SafeExtraction:       true,
+				AllowedPaths:         []string{dest},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var rejected []string
+			for _, header := range tt.entries {
+				if !validator.validate(header) {
+					rejected = append(rejected, header.Name)
+				}
+			}
+
+			if len(rejected) != len(tt.wantRejected) {
+				t.Fatalf("rejected entries = %v, want %v", rejected, tt.wantRejected)
+			}
+			for i := range rejected {
+				if rejected[i] != tt.wantRejected[i] {
+					t.Fatalf("rejected entries = %v, want %v", rejected, tt.wantRejected)
+				}
+			}
+			if (validator.err() != nil) != (len(tt.wantRejected) > 0) {
+				t.Fatalf("err() = %v", validator.err())
+			}
+		})
+	}
+}
+
+func TestEntryValidatorAllowedPaths(t *testing.T) {
+	allowed := t.TempDir()
+	validator, err := newEntryValidator(DecompressOptions{SafeExtraction: true, AllowedPaths: []string{allowed}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !validator.validate(&tar.Header{Name: filepath.Join(allowed, "file"), Typeflag: tar.TypeReg}) {
+		t.Errorf("entry inside the allowed path is rejected")
+	}
+	if validator.validate(&tar.Header{Name: "/etc/passwd", Typeflag: tar.TypeReg}) {
+		t.Errorf("entry outside of the allowed paths is accepted")
+	}
+	if validator.validate(&tar.Header{Name: filepath.Join(allowed, "link"), Typeflag: tar.TypeLink, Linkname: "/etc/passwd"}) {
+		t.Errorf("hard link to a file outside of the allowed paths is accepted")
+	}
+}
@@ -0,0 +1,323 @@
+package compression
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	stagingDirPrefix = ".restore-cache-staging-"
+	backupSuffix     = ".restore-cache-backup"
+	// staleStagingAge is the age after which staging directories of interrupted restores are removed.
+	staleStagingAge = 24 * time.Hour
+)
+
+// commitMu serializes the commits of concurrent restores (cache groups), as they can create the same parent directories.
+var commitMu sync.Mutex
+
+// StagedRestore is an archive extracted into a staging directory. The target locations are only changed by Commit.
+type StagedRestore struct {
+	stagingDir string
+	// targetRoot is the directory the staging directory mirrors: the destination directory, or the filesystem root.
+	// Without a destination, relative entries are staged under the path of the working directory.
+	targetRoot string
+	journal    []movedEntry
+}
+
+// movedEntry is a staged entry moved into place, backup is the path of the entry it replaced (empty if there was none).
+type movedEntry struct {
+	target string
+	backup string
+}
+
+// CommitError is returned if the staged files couldn't be moved into place.
+type CommitError struct {
+	Err error
+	// RollbackErr is set if the files moved into place before the failure couldn't be moved back.
+	RollbackErr error
+}
+
+func (e *CommitError) Error() string {
+	if e.RollbackErr != nil {
+		return fmt.Sprintf("move restored files into place: %s, rollback failed: %s", e.Err, e.RollbackErr)
+	}
+	return fmt.Sprintf("move restored files into place: %s, changes were rolled back", e.Err)
+}
+
+func (e *CommitError) Unwrap() error {
+	return e.Err
+}
+
+// Stage works like Decompress, but extracts the archive into a staging directory. Nothing is written to the target
+// locations until the returned StagedRestore is committed. The staging directory is removed if the extraction fails.
+func (a *Archiver) Stage(ctx context.Context, archivePath string, opts DecompressOptions) (*StagedRestore, error) {
+	staged, extractOpts, err := newStagedRestore(opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := a.decompress(ctx, archivePath, opts, extractOpts); err != nil {
+		staged.Discard()
+		return nil, err
+	}
+	return staged, nil
+}
+
+// StageStream works like DecompressStream, but extracts the archive into a staging directory, see Stage.
+func (a *Archiver) StageStream(ctx context.Context, archive io.Reader, opts DecompressOptions) (*StagedRestore, error) {
+	staged, extractOpts, err := newStagedRestore(opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := a.decompressStream(ctx, archive, opts, extractOpts); err != nil {
+		staged.Discard()
+		return nil, err
+	}
+	return staged, nil
+}
+
+// newStagedRestore creates the staging directory, and returns the options extracting the archive into it.
+// The staging directory is created in the destination directory, or in the home directory if the archive
+// is extracted to the original locations, so that the entries can be renamed into place on the same filesystem.
+func newStagedRestore(opts DecompressOptions) (*StagedRestore, DecompressOptions, error) {
+	if err := prepareDestination(opts); err != nil {
+		return nil, opts, err
+	}
+
+	extractOpts := opts
+	targetRoot := opts.DestinationDirectory
+	base := opts.DestinationDirectory
+	if targetRoot == "" {
+		workDir, err := os.Getwd()
+		if err != nil {
+			return nil, opts, err
+		}
+		// Relative entries are restored to the working directory, the same place tar extracts them to
+		extractOpts.relativeRoot = workDir
+		targetRoot = string(filepath.Separator)
+		if home, err := os.UserHomeDir(); err == nil {
+			base = home
+		} else {
+			base = os.TempDir()
+		}
+	}
+	removeStaleStagingDirs(base)
+
+	stagingDir, err := os.MkdirTemp(base, stagingDirPrefix)
+	if err != nil {
+		return nil, opts, fmt.Errorf("create staging directory: %w", err)
+	}
+
+	extractOpts.DestinationDirectory = stagingDir
+	return &StagedRestore{stagingDir: stagingDir, targetRoot: targetRoot}, extractOpts, nil
+}
+
+// Commit moves the staged entries into place. New entries are moved as a whole, existing directories are merged,
+// and existing files (or directories replaced by a file) are replaced. If moving an entry fails, the entries moved
+// so far are moved back, and the replaced entries are restored. The staging directory is removed in both cases.
+func (s *StagedRestore) Commit() error {
+	commitMu.Lock()
+	defer commitMu.Unlock()
+	defer s.Discard()
+
+	if err := s.merge(s.stagingDir, s.targetRoot); err != nil {
+		return &CommitError{Err: err, RollbackErr: s.rollback()}
+	}
+
+	for _, entry := range s.journal {
+		if entry.backup != "" {
+			os.RemoveAll(entry.backup) //nolint:errcheck
+		}
+	}
+	return nil
+}
+
+// Discard removes the staging directory without changing the target locations.
+func (s *StagedRestore) Discard() {
+	os.RemoveAll(s.stagingDir) //nolint:errcheck
+}
+
+func (s *StagedRestore) merge(stagedDir, targetDir string) error {
+	entries, err := os.ReadDir(stagedDir)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		staged := filepath.Join(stagedDir, entry.Name())
+		target := filepath.Join(targetDir, entry.Name())
+
+		// Existing directory symlinks are followed, the same way tar extracts through them
+		targetInfo, err := os.Stat(target)
+		if entry.IsDir() && err == nil && targetInfo.IsDir() {
+			if err := s.merge(staged, target); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if err := s.replace(staged, target); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// replace moves the staged entry to target. An existing target is renamed to a backup next to it first.
+func (s *StagedRestore) replace(staged, target string) error {
+	backup := ""
+	if _, err := os.Lstat(target); err == nil {
+		backup = target + backupSuffix
+		if err := os.RemoveAll(backup); err != nil {
+			return err
+		}
+		if err := os.Rename(target, backup); err != nil {
+			return err
+		}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	if err := moveEntry(staged, target); err != nil {
+		if backup != "" {
+			os.Rename(backup, target) //nolint:errcheck
+		}
+		return err
+	}
+	s.journal = append(s.journal, movedEntry{target: target, backup: backup})
+	return nil
+}
+
+// rollback moves back the replaced entries in reverse order, and removes the entries that didn't exist before.
+func (s *StagedRestore) rollback() error {
+	var errs []error
+	for i := len(s.journal) - 1; i >= 0; i-- {
+		entry := s.journal[i]
+		if err := os.RemoveAll(entry.target); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if entry.backup != "" {
+			if err := os.Rename(entry.backup, entry.target); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	s.journal = nil
+	return errors.Join(errs...)
+}
+
+// moveEntry renames src to dst. If they are on different filesystems, src is copied next to dst first,
+// and renamed into place from there, so dst never contains a partial copy.
+func moveEntry(src, dst string) error {
+	err := os.Rename(src, dst)
+	if err == nil || !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+
+	tmp := dst + ".restore-cache-tmp"
+	if err := os.RemoveAll(tmp); err != nil {
+		return err
+	}
+	if err := copyTree(src, tmp); err != nil {
+		os.RemoveAll(tmp) //nolint:errcheck
+		return fmt.Errorf("copy %s across filesystems: %w", dst, err)
+	}
+	return os.Rename(tmp, dst)
+}
+
+// copyTree copies src to dst recursively, keeping symlinks, modes and modification times.
+func copyTree(src, dst string) error {
+	var dirs []string
+	err := filepath.WalkDir(src, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, strings.TrimPrefix(path, src))
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case entry.IsDir():
+			dirs = append(dirs, path)
+			return os.MkdirAll(target, 0700)
+		case info.Mode()&fs.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		default:
+			if err := copyFile(path, target, info.Mode().Perm()); err != nil {
+				return err
+			}
+			return os.Chtimes(target, info.ModTime(), info.ModTime())
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	// Directory metadata is copied last (deepest first), as copying the content would change it
+	for i := len(dirs) - 1; i >= 0; i-- {
+		info, err := os.Stat(dirs[i])
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, strings.TrimPrefix(dirs[i], src))
+		if err := os.Chmod(target, info.Mode().Perm()); err != nil {
+			return err
+		}
+		if err := os.Chtimes(target, info.ModTime(), info.ModTime()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func copyFile(src, dst string, mode fs.FileMode) error {
+	source, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer source.Close() //nolint:errcheck
+
+	dest, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dest, source); err != nil {
+		dest.Close() //nolint:errcheck
+		return err
+	}
+	return dest.Close()
+}
+
+// removeStaleStagingDirs removes the staging directories left behind by restores that were killed.
+// Recent ones are kept, as they can belong to a restore in progress.
+func removeStaleStagingDirs(base string) {
+	entries, err := os.ReadDir(base)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() || !strings.HasPrefix(entry.Name(), stagingDirPrefix) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil || time.Since(info.ModTime()) < staleStagingAge {
+			continue
+		}
+		os.RemoveAll(filepath.Join(base, entry.Name())) //nolint:errcheck
+	}
+}
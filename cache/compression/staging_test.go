@@ -0,0 +1,267 @@
+//go:build linux || darwin
+
+package compression
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bitrise-io/go-utils/v2/env"
+	"github.com/bitrise-io/go-utils/v2/log"
+)
+
+// TestStageWithoutDestination restores an archive of relative and absolute entries without a destination directory:
+// the relative entries have to land in the working directory (where tar extracts them), not in the filesystem root.
+func TestStageWithoutDestination(t *testing.T) {
+	workDir := t.TempDir()
+	absoluteDir := t.TempDir()
+	// The staging directory is created in the home directory
+	t.Setenv("HOME", t.TempDir())
+	chdir(t, workDir)
+
+	archivePath := writeFixture(t, []fixtureEntry{
+		dir("node_modules", 0755, fixtureTime),
+		dir("node_modules/pkg", 0755, fixtureTime),
+		file("node_modules/pkg/index.js", 0644, "module.exports = 1"),
+		symlink("node_modules/link", "pkg/index.js"),
+		hardLink("node_modules/hard", "node_modules/pkg/index.js"),
+		file(filepath.Join(absoluteDir, "absolute.txt"), 0644, "absolute"),
+	})
+
+	for _, backend := range []struct {
+		name      string
+		useBinary bool
+	}{
+		{name: "native", useBinary: false},
+		{name: "tar binary", useBinary: true},
+	} {
+		t.Run(backend.name, func(t *testing.T) {
+			if backend.useBinary {
+				for _, binary := range []string{"tar", "zstd"} {
+					if _, err := exec.LookPath(binary); err != nil {
+						t.Skipf("%s binary is not installed", binary)
+					}
+				}
+			}
+			for _, path := range []string{filepath.Join(workDir, "node_modules"), filepath.Join(absoluteDir, "absolute.txt")} {
+				if err := os.RemoveAll(path); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			archiver := NewArchiver(log.NewLogger(), env.NewRepository(), fakeDependencyChecker(backend.useBinary))
+			staged, err := archiver.Stage(context.Background(), archivePath, DecompressOptions{})
+			if err != nil {
+				t.Fatalf("Stage() error = %s", err)
+			}
+			if err := staged.Commit(); err != nil {
+				t.Fatalf("Commit() error = %s", err)
+			}
+
+			assertFileContent(t, filepath.Join(workDir, "node_modules", "pkg", "index.js"), "module.exports = 1")
+			assertFileContent(t, filepath.Join(absoluteDir, "absolute.txt"), "absolute")
+			if link, err := os.Readlink(filepath.Join(workDir, "node_modules", "link")); err != nil || link != "pkg/index.js" {
+				t.Errorf("symlink target = %q, %v, want pkg/index.js", link, err)
+			}
+			original, err := os.Stat(filepath.Join(workDir, "node_modules", "pkg", "index.js"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			hard, err := os.Stat(filepath.Join(workDir, "node_modules", "hard"))
+			if err != nil || !os.SameFile(original, hard) {
+				t.Errorf("hard link is not linked to node_modules/pkg/index.js: %v", err)
+			}
+
+			if _, err := os.Lstat(string(filepath.Separator) + "node_modules"); !errors.Is(err, fs.ErrNotExist) {
+				t.Errorf("relative entries were restored to the filesystem root")
+			}
+			homeEntries, err := os.ReadDir(os.Getenv("HOME"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, entry := range homeEntries {
+				if strings.HasPrefix(entry.Name(), stagingDirPrefix) {
+					t.Errorf("staging directory %s was not removed", entry.Name())
+				}
+			}
+		})
+	}
+}
+
+func TestStagedRestoreCommit(t *testing.T) {
+	destination := t.TempDir()
+	writeTestFile(t, filepath.Join(destination, "node_modules", "kept.js"), "kept")
+	writeTestFile(t, filepath.Join(destination, "node_modules", "replaced.js"), "old")
+	writeTestFile(t, filepath.Join(destination, "dir-to-file", "old.txt"), "old")
+
+	archivePath := writeFixture(t, []fixtureEntry{
+		dir("node_modules", 0755, fixtureTime),
+		file("node_modules/replaced.js", 0644, "new"),
+		file("node_modules/added.js", 0644, "added"),
+		file("dir-to-file", 0644, "file"),
+	})
+
+	archiver := NewArchiver(log.NewLogger(), env.NewRepository(), fakeDependencyChecker(false))
+	staged, err := archiver.Stage(context.Background(), archivePath, DecompressOptions{DestinationDirectory: destination})
+	if err != nil {
+		t.Fatalf("Stage() error = %s", err)
+	}
+	// Nothing changes before the commit
+	assertFileContent(t, filepath.Join(destination, "node_modules", "replaced.js"), "old")
+
+	if err := staged.Commit(); err != nil {
+		t.Fatalf("Commit() error = %s", err)
+	}
+
+	// Existing directories are merged, existing files are replaced
+	assertFileContent(t, filepath.Join(destination, "node_modules", "kept.js"), "kept")
+	assertFileContent(t, filepath.Join(destination, "node_modules", "replaced.js"), "new")
+	assertFileContent(t, filepath.Join(destination, "node_modules", "added.js"), "added")
+	assertFileContent(t, filepath.Join(destination, "dir-to-file"), "file")
+	assertNoLeftovers(t, destination)
+}
+
+// TestStagedRestoreCommitRollback makes the commit fail after some entries were already moved into place:
+// the name of the last entry is too long to add the backup suffix to it.
+func TestStagedRestoreCommitRollback(t *testing.T) {
+	destination := t.TempDir()
+	longName := "z" + strings.Repeat("x", 255-len(backupSuffix))
+	writeTestFile(t, filepath.Join(destination, "a-replaced.txt"), "old")
+	writeTestFile(t, filepath.Join(destination, longName), "old")
+
+	archivePath := writeFixture(t, []fixtureEntry{
+		file("a-replaced.txt", 0644, "new"),
+		file("b-added.txt", 0644, "added"),
+		file(longName, 0644, "new"),
+	})
+
+	archiver := NewArchiver(log.NewLogger(), env.NewRepository(), fakeDependencyChecker(false))
+	staged, err := archiver.Stage(context.Background(), archivePath, DecompressOptions{DestinationDirectory: destination})
+	if err != nil {
+		t.Fatalf("Stage() error = %s", err)
+	}
+
+	err = staged.Commit()
+	var commitErr *CommitError
+	if !errors.As(err, &commitErr) {
+		t.Fatalf("Commit() error = %v, want a CommitError", err)
+	}
+	if commitErr.RollbackErr != nil {
+		t.Errorf("rollback error = %s", commitErr.RollbackErr)
+	}
+
+	// The target is left as it was before the commit
+	assertFileContent(t, filepath.Join(destination, "a-replaced.txt"), "old")
+	assertFileContent(t, filepath.Join(destination, longName), "old")
+	if _, err := os.Lstat(filepath.Join(destination, "b-added.txt")); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("added entry was not removed by the rollback")
+	}
+	assertNoLeftovers(t, destination)
+}
+
+func TestStagedRestoreDiscard(t *testing.T) {
+	destination := t.TempDir()
+	writeTestFile(t, filepath.Join(destination, "a.txt"), "old")
+	archivePath := writeFixture(t, []fixtureEntry{file("a.txt", 0644, "new")})
+
+	archiver := NewArchiver(log.NewLogger(), env.NewRepository(), fakeDependencyChecker(false))
+	staged, err := archiver.Stage(context.Background(), archivePath, DecompressOptions{DestinationDirectory: destination})
+	if err != nil {
+		t.Fatalf("Stage() error = %s", err)
+	}
+	staged.Discard()
+
+	assertFileContent(t, filepath.Join(destination, "a.txt"), "old")
+	assertNoLeftovers(t, destination)
+}
+
+func TestRemoveStaleStagingDirs(t *testing.T) {
+	base := t.TempDir()
+	stale := filepath.Join(base, stagingDirPrefix+"stale")
+	recent := filepath.Join(base, stagingDirPrefix+"recent")
+	other := filepath.Join(base, "other")
+	for _, dir := range []string{stale, recent, other} {
+		if err := os.Mkdir(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	staleTime := time.Now().Add(-staleStagingAge - time.Hour)
+	for _, dir := range []string{stale, other} {
+		if err := os.Chtimes(dir, staleTime, staleTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	removeStaleStagingDirs(base)
+
+	if _, err := os.Stat(stale); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("stale staging directory was not removed")
+	}
+	for _, dir := range []string{recent, other} {
+		if _, err := os.Stat(dir); err != nil {
+			t.Errorf("%s was removed: %s", dir, err)
+		}
+	}
+}
+
+func writeTestFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// assertNoLeftovers checks that the staging directory and the backups were removed from dir.
+func assertNoLeftovers(t *testing.T, dir string) {
+	t.Helper()
+	err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(entry.Name(), stagingDirPrefix) || strings.HasSuffix(entry.Name(), backupSuffix) {
+			t.Errorf("%s was left behind", path)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func chdir(t *testing.T, dir string) {
+	t.Helper()
+	oldDir, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := os.Chdir(oldDir); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func assertFileContent(t *testing.T, path, want string) {
+	t.Helper()
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Errorf("%s: %s", path, err)
+		return
+	}
+	if string(content) != want {
+		t.Errorf("%s = %q, want %q", path, content, want)
+	}
+}
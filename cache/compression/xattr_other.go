@@ -0,0 +1,16 @@
+//go:build !linux && !darwin
+
+package compression
+
+import (
+	"errors"
+	"time"
+)
+
+func setXattr(path, name string, value []byte) error {
+	return errors.New("extended attributes are not supported on this platform")
+}
+
+func setSymlinkTimes(path string, accessTime, modTime time.Time) error {
+	return errors.New("symlink times are not supported on this platform")
+}
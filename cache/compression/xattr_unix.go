@@ -0,0 +1,18 @@
+//go:build linux || darwin
+
+package compression
+
+import (
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func setXattr(path, name string, value []byte) error {
+	return unix.Lsetxattr(path, name, value, 0)
+}
+
+func setSymlinkTimes(path string, accessTime, modTime time.Time) error {
+	times := []unix.Timespec{unix.NsecToTimespec(accessTime.UnixNano()), unix.NsecToTimespec(modTime.UnixNano())}
+	return unix.UtimesNanoAt(unix.AT_FDCWD, path, times, unix.AT_SYMLINK_NOFOLLOW)
+}
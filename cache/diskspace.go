@@ -0,0 +1,136 @@
+package cache
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/bitrise-steplib/bitrise-step-restore-cache/cache/network"
+	"github.com/docker/go-units"
+)
+
+// DiskSpacePolicy decides what happens if the pre-flight check finds that the archive doesn't fit on the disk.
+type DiskSpacePolicy string
+
+const (
+	// DiskSpacePolicyFail fails the restore before downloading the archive.
+	DiskSpacePolicyFail DiskSpacePolicy = "fail"
+	// DiskSpacePolicySkip skips the restore and continues as a cache miss.
+	DiskSpacePolicySkip DiskSpacePolicy = "skip"
+)
+
+var errInsufficientDiskSpace = errors.New("insufficient disk space")
+
+func validateDiskSpacePolicy(policy DiskSpacePolicy) (DiskSpacePolicy, error) {
+	switch policy {
+	case "":
+		return DiskSpacePolicyFail, nil
+	case DiskSpacePolicyFail, DiskSpacePolicySkip:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("unknown disk space policy: %s", policy)
+	}
+}
+
+// diskRequirement is the space a phase of the restore needs on the filesystem of path.
+type diskRequirement struct {
+	path    string
+	size    int64
+	purpose string
+}
+
+// filesystemUsage sums the requirements on the same filesystem.
+type filesystemUsage struct {
+	path     string
+	free     uint64
+	required int64
+	purposes []string
+}
+
+// diskSpacePreflight returns the check the downloader runs once the archive is found, nil in lookup only mode.
+func (r *restorer) diskSpacePreflight(config restoreCacheConfig) func(network.ArchiveInfo) error {
+	if config.IsLookupOnly {
+		return nil
+	}
+	return func(archive network.ArchiveInfo) error {
+		return r.checkDiskSpace(archive, config)
+	}
+}
+
+// checkDiskSpace returns errInsufficientDiskSpace if the downloaded archive (unless it's streamed) or the extracted
+// files don't fit on their filesystems. Sizes the storage doesn't know about are not checked.
+func (r *restorer) checkDiskSpace(archive network.ArchiveInfo, config restoreCacheConfig) error {
+	var requirements []diskRequirement
+	if !config.IsStreaming {
+		if archive.Size > 0 {
+			requirements = append(requirements, diskRequirement{path: os.TempDir(), size: archive.Size, purpose: "downloaded archive"})
+		} else {
+			r.logger.Debugf("Archive size is unknown, skipping the disk space check of the download")
+		}
+	}
+	if archive.UncompressedSize > 0 {
+		// An atomic restore extracts into a staging directory on the same filesystem, which is renamed into place
+		requirements = append(requirements, diskRequirement{path: extractionDir(config), size: archive.UncompressedSize, purpose: "extracted files"})
+	} else {
+		r.logger.Debugf("Uncompressed archive size is unknown, skipping the disk space check of the extraction")
+	}
+
+	var filesystems []uint64
+	usages := map[uint64]*filesystemUsage{}
+	for _, requirement := range requirements {
+		free, device, err := filesystemStats(requirement.path)
+		if err != nil {
+			r.logger.Debugf("Skipping the disk space check of %s: %s", requirement.path, err)
+			continue
+		}
+		usage, ok := usages[device]
+		if !ok {
+			usage = &filesystemUsage{path: requirement.path, free: free}
+			usages[device] = usage
+			filesystems = append(filesystems, device)
+		}
+		usage.required += requirement.size
+		usage.purposes = append(usage.purposes, requirement.purpose)
+	}
+
+	for _, device := range filesystems {
+		usage := usages[device]
+		required := units.HumanSizeWithPrecision(float64(usage.required), 3)
+		available := units.HumanSizeWithPrecision(float64(usage.free), 3)
+		r.logger.Debugf("Disk space of %s: %s required, %s available", usage.path, required, available)
+		if uint64(usage.required) > usage.free {
+			return fmt.Errorf("%w on %s: %s required for the %s, %s available",
+				errInsufficientDiskSpace, usage.path, required, strings.Join(usage.purposes, " and "), available)
+		}
+	}
+	return nil
+}
+
+// extractionDir is a directory on the filesystem the archive is extracted to. Without a destination directory,
+// the files are restored to their original locations, which are typically in the home directory.
+func extractionDir(config restoreCacheConfig) string {
+	if config.Decompression.DestinationDirectory != "" {
+		return config.Decompression.DestinationDirectory
+	}
+	if home, err := os.UserHomeDir(); err == nil {
+		return home
+	}
+	return os.TempDir()
+}
+
+// existingAncestor returns path, or its closest parent that exists, as the destination directory
+// is only created by the extraction.
+func existingAncestor(path string) string {
+	for {
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+		parent := filepath.Dir(path)
+		if parent == path {
+			return path
+		}
+		path = parent
+	}
+}
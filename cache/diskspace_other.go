@@ -0,0 +1,11 @@
+//go:build !linux && !darwin
+
+package cache
+
+import "errors"
+
+// The step only runs on Linux and macOS, the disk space check is skipped on other platforms.
+
+func filesystemStats(path string) (uint64, uint64, error) {
+	return 0, 0, errors.New("not supported on this platform")
+}
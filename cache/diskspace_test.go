@@ -0,0 +1,123 @@
+package cache
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bitrise-steplib/bitrise-step-restore-cache/cache/compression"
+	"github.com/bitrise-steplib/bitrise-step-restore-cache/cache/network"
+)
+
+// tooLarge doesn't fit on any test machine
+const tooLarge = int64(1) << 60
+
+func TestValidateDiskSpacePolicy(t *testing.T) {
+	tests := []struct {
+		policy  DiskSpacePolicy
+		want    DiskSpacePolicy
+		wantErr bool
+	}{
+		{policy: "", want: DiskSpacePolicyFail},
+		{policy: DiskSpacePolicyFail, want: DiskSpacePolicyFail},
+		{policy: DiskSpacePolicySkip, want: DiskSpacePolicySkip},
+		{policy: "ignore", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.policy), func(t *testing.T) {
+			got, err := validateDiskSpacePolicy(tt.policy)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("validateDiskSpacePolicy() error = %v, wantErr %t", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("validateDiskSpacePolicy() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckDiskSpace(t *testing.T) {
+	tests := []struct {
+		name        string
+		archive     network.ArchiveInfo
+		isStreaming bool
+		wantErr     bool
+	}{
+		{name: "fits", archive: network.ArchiveInfo{Size: 1024, UncompressedSize: 4096}},
+		{name: "unknown sizes", archive: network.ArchiveInfo{}},
+		{name: "archive doesn't fit", archive: network.ArchiveInfo{Size: tooLarge}, wantErr: true},
+		{name: "extracted files don't fit", archive: network.ArchiveInfo{Size: 1024, UncompressedSize: tooLarge}, wantErr: true},
+		// A streamed archive is never written to the disk
+		{name: "streamed archive", archive: network.ArchiveInfo{Size: tooLarge, UncompressedSize: 4096}, isStreaming: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newFakeRestorer(t, fakeDownloader{})
+			config := restoreCacheConfig{
+				IsStreaming:   tt.isStreaming,
+				Decompression: compression.DecompressOptions{DestinationDirectory: t.TempDir()},
+			}
+			err := r.checkDiskSpace(tt.archive, config)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("checkDiskSpace() error = %v, wantErr %t", err, tt.wantErr)
+			}
+			if err != nil && !errors.Is(err, errInsufficientDiskSpace) {
+				t.Errorf("checkDiskSpace() error = %s, want errInsufficientDiskSpace", err)
+			}
+		})
+	}
+}
+
+func TestRestoreWithInsufficientDiskSpace(t *testing.T) {
+	tests := []struct {
+		policy         DiskSpacePolicy
+		wantErr        bool
+		wantMissReason string
+	}{
+		{policy: DiskSpacePolicyFail, wantErr: true},
+		{policy: DiskSpacePolicySkip, wantMissReason: missReasonInsufficientDiskSpace},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.policy), func(t *testing.T) {
+			outputs := fakeEnvman(t)
+			destination := t.TempDir()
+			downloader := fakeDownloader{
+				archives:         map[string][]byte{"key": testArchive(t, archiveEntry{name: "a.txt", content: []byte("a")})},
+				uncompressedSize: tooLarge,
+			}
+
+			r := newFakeRestorer(t, downloader)
+			input := testInput(t, destination, "key")
+			input.DiskSpacePolicy = tt.policy
+			err := r.Restore(input)
+			if tt.wantErr {
+				if !errors.Is(err, errInsufficientDiskSpace) {
+					t.Fatalf("Restore() error = %v, want errInsufficientDiskSpace", err)
+				}
+			} else if err != nil {
+				t.Fatalf("Restore() error = %s", err)
+			}
+
+			if _, err := os.Stat(filepath.Join(destination, "a.txt")); !errors.Is(err, os.ErrNotExist) {
+				t.Errorf("archive was extracted")
+			}
+			if tt.wantMissReason != "" {
+				got := outputs()
+				if got[cacheHitEnvVar] != "false" || got[missReasonEnvVar] != tt.wantMissReason {
+					t.Errorf("cache hit = %q, miss reason = %q, want false, %s", got[cacheHitEnvVar], got[missReasonEnvVar], tt.wantMissReason)
+				}
+			}
+		})
+	}
+}
+
+func TestExistingAncestor(t *testing.T) {
+	dir := t.TempDir()
+	if got := existingAncestor(filepath.Join(dir, "not", "created", "yet")); got != dir {
+		t.Errorf("existingAncestor() = %s, want %s", got, dir)
+	}
+	if got := existingAncestor(dir); got != dir {
+		t.Errorf("existingAncestor() = %s, want %s", got, dir)
+	}
+}
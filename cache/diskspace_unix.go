@@ -0,0 +1,21 @@
+//go:build linux || darwin
+
+package cache
+
+import "golang.org/x/sys/unix"
+
+// filesystemStats returns the space available to unprivileged users on the filesystem of path,
+// and the ID of the filesystem.
+func filesystemStats(path string) (uint64, uint64, error) {
+	path = existingAncestor(path)
+
+	var fsStat unix.Statfs_t
+	if err := unix.Statfs(path, &fsStat); err != nil {
+		return 0, 0, err
+	}
+	var stat unix.Stat_t
+	if err := unix.Stat(path, &stat); err != nil {
+		return 0, 0, err
+	}
+	return uint64(fsStat.Bavail) * uint64(fsStat.Bsize), uint64(stat.Dev), nil
+}
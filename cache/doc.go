@@ -0,0 +1,7 @@
+// Package cache restores cache archives saved by the Save Cache Step.
+//
+// It is a fork of the restore half of github.com/bitrise-io/go-steputils/v2/cache (the save and upload code is not
+// included), so the restore features of this Step can evolve without a go-steputils release. The cache key format,
+// the key limits and the archive format are shared with the Save Cache Step, which still uses go-steputils:
+// changes to those have to land in go-steputils too, otherwise the keys and archives of the two Steps diverge.
+package cache
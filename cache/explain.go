@@ -0,0 +1,109 @@
+package cache
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/bitrise-io/go-steputils/v2/export"
+	"github.com/bitrise-steplib/bitrise-step-restore-cache/cache/keytemplate"
+	"github.com/bitrise-steplib/bitrise-step-restore-cache/cache/network"
+)
+
+const keyExplanationEnvVar = "BITRISE_CACHE_KEY_EXPLANATION_PATH"
+
+// keyReport is the JSON key explanation report, its path is exported as BITRISE_CACHE_KEY_EXPLANATION_PATH.
+// Diffing the reports of two builds tells why they got different keys.
+type keyReport struct {
+	Keys []keyExplanation `json:"keys"`
+}
+
+type keyExplanation struct {
+	// Group is the cache group of the key, empty for the keys of the step
+	Group     string            `json:"group,omitempty"`
+	MatchMode network.MatchMode `json:"match_mode"`
+	keytemplate.Explanation
+	// ShortenedKey is the key used instead of Key, if Key is longer than network.MaxKeyLength
+	ShortenedKey string `json:"shortened_key,omitempty"`
+}
+
+// explainKey evaluates a key template, adds its explanation to the report and logs it in verbose mode.
+// The returned key is shortened if it's longer than network.MaxKeyLength.
+func (r *restorer) explainKey(model keytemplate.Model, template string, matchMode network.MatchMode, group string, report *keyReport) (string, error) {
+	explanation, err := model.Explain(template)
+	entry := keyExplanation{Group: group, MatchMode: matchMode, Explanation: explanation}
+	key := network.ShortenKey(explanation.Key)
+	if key != explanation.Key {
+		entry.ShortenedKey = key
+		r.logger.Warnf("Key is longer than %d bytes, it's shortened to: %s", network.MaxKeyLength, key)
+	}
+	report.Keys = append(report.Keys, entry)
+	r.logKeyExplanation(entry)
+
+	return key, err
+}
+
+// validateKeys returns an error listing every invalid key of the report, together with the template it comes from.
+func validateKeys(report keyReport) error {
+	var invalidKeys []string
+	for _, entry := range report.Keys {
+		if err := network.ValidateKey(entry.Key); err != nil {
+			invalidKeys = append(invalidKeys, fmt.Sprintf("- %q (template: %s): %s", entry.Key, entry.Template, err))
+		}
+	}
+	if len(invalidKeys) > 0 {
+		return fmt.Errorf("invalid keys:\n%s", strings.Join(invalidKeys, "\n"))
+	}
+	return nil
+}
+
+// validateKeyCount returns an error if there are more keys than network.MaxKeyCount.
+func validateKeyCount(keys []string) error {
+	if len(keys) > network.MaxKeyCount {
+		return fmt.Errorf("maximum number of keys is %d, %d provided", network.MaxKeyCount, len(keys))
+	}
+	return nil
+}
+
+func (r *restorer) logKeyExplanation(entry keyExplanation) {
+	names := make([]string, 0, len(entry.Variables))
+	for name := range entry.Variables {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		r.logger.Debugf("Variable .%s: %s", name, entry.Variables[name])
+	}
+	for _, call := range entry.Functions {
+		r.logger.Debugf("Function %s %s: %s", call.Name, strings.Join(call.Args, " "), call.Result)
+		for _, input := range call.Inputs {
+			r.logger.Debugf("- %s: %s", input.Path, input.Checksum)
+		}
+	}
+}
+
+// exportKeyReport writes the key explanation report to a JSON file and exports its path.
+func (r *restorer) exportKeyReport(report keyReport) error {
+	content, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	reportFile, err := os.CreateTemp("", "restore-cache-keys-*.json")
+	if err != nil {
+		return err
+	}
+	if _, err := reportFile.Write(content); err != nil {
+		reportFile.Close() //nolint:errcheck
+		return err
+	}
+	if err := reportFile.Close(); err != nil {
+		return err
+	}
+	r.logger.Debugf("Key explanation report: %s", reportFile.Name())
+
+	exporter := export.NewExporter(r.cmdFactory)
+	return exporter.ExportOutputFile(keyExplanationEnvVar, reportFile.Name(), reportFile.Name())
+}
@@ -0,0 +1,140 @@
+package cache
+
+import (
+	"encoding/json"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/bitrise-io/go-utils/v2/command"
+	"github.com/bitrise-io/go-utils/v2/env"
+	"github.com/bitrise-io/go-utils/v2/log"
+	"github.com/bitrise-steplib/bitrise-step-restore-cache/cache/keytemplate"
+	"github.com/bitrise-steplib/bitrise-step-restore-cache/cache/network"
+)
+
+func newTestRestorer() *restorer {
+	envRepo := env.NewRepository()
+	return NewRestorer(envRepo, log.NewLogger(), command.NewFactory(envRepo), nil)
+}
+
+func TestExplainKeyShortensLongKeys(t *testing.T) {
+	r := newTestRestorer()
+	model := keytemplate.NewModel(env.NewRepository(), log.NewLogger())
+	long := "cache-" + strings.Repeat("ő", network.MaxKeyLength)
+
+	var report keyReport
+	key, err := r.explainKey(model, long, network.MatchPrefix, "", &report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key != network.ShortenKey(long) {
+		t.Errorf("explainKey() = %s, want %s", key, network.ShortenKey(long))
+	}
+	if len(report.Keys) != 1 || report.Keys[0].Key != long || report.Keys[0].ShortenedKey != key {
+		t.Errorf("report = %+v, want the evaluated and the shortened key", report.Keys)
+	}
+}
+
+func TestCacheHitValue(t *testing.T) {
+	long := "cache-" + strings.Repeat("ő", network.MaxKeyLength)
+	tests := []struct {
+		name          string
+		matchedKey    string
+		evaluatedKeys []string
+		want          string
+	}{
+		{name: "no match", matchedKey: "", evaluatedKeys: []string{"a"}, want: "false"},
+		{name: "first key", matchedKey: "a", evaluatedKeys: []string{"a", "b"}, want: "exact"},
+		{name: "fallback key", matchedKey: "b-123", evaluatedKeys: []string{"a", "b"}, want: "partial"},
+		{name: "shortened first key", matchedKey: network.ShortenKey(long), evaluatedKeys: []string{long}, want: "exact"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := (restoreResult{matchedKey: tt.matchedKey}).cacheHitValue(tt.evaluatedKeys); got != tt.want {
+				t.Errorf("cacheHitValue() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRestoreExportsKeyReport(t *testing.T) {
+	outputs := fakeEnvman(t)
+	t.Setenv("LOCK_HASH", "abc")
+	t.Setenv("EMPTY_VAR", "")
+
+	r := newFakeRestorer(t, fakeDownloader{})
+	input := testInput(t, t.TempDir(), `[exact] npm-{{ getenv "LOCK_HASH" }}`, `npm-{{ getenv "EMPTY_VAR" }}`)
+	if err := r.Restore(input); err != nil {
+		t.Fatalf("Restore() error = %s", err)
+	}
+
+	content, err := os.ReadFile(outputs()[keyExplanationEnvVar])
+	if err != nil {
+		t.Fatalf("key explanation report: %s", err)
+	}
+	var report keyReport
+	if err := json.Unmarshal(content, &report); err != nil {
+		t.Fatal(err)
+	}
+	want := []keyExplanation{
+		{
+			MatchMode: network.MatchExact,
+			Explanation: keytemplate.Explanation{
+				Template:  `npm-{{ getenv "LOCK_HASH" }}`,
+				Key:       "npm-abc",
+				Functions: []keytemplate.FunctionCall{{Name: "getenv", Args: []string{"LOCK_HASH"}, Result: "abc"}},
+			},
+		},
+		{
+			MatchMode: network.MatchPrefix,
+			Explanation: keytemplate.Explanation{
+				Template:  `npm-{{ getenv "EMPTY_VAR" }}`,
+				Key:       "npm-",
+				Functions: []keytemplate.FunctionCall{{Name: "getenv", Args: []string{"EMPTY_VAR"}, Result: ""}},
+				Warnings:  []string{"Environment variable EMPTY_VAR is empty"},
+			},
+		},
+	}
+	if !reflect.DeepEqual(report.Keys, want) {
+		t.Errorf("report = %+v, want %+v", report.Keys, want)
+	}
+}
+
+func TestRestoreFailsOnDegradedKeyInStrictMode(t *testing.T) {
+	fakeEnvman(t)
+	t.Setenv("EMPTY_VAR", "")
+
+	r := newFakeRestorer(t, fakeDownloader{})
+	input := testInput(t, t.TempDir(), `npm-{{ getenv "EMPTY_VAR" }}`)
+	input.IsStrictKeys = true
+	if err := r.Restore(input); err == nil || !strings.Contains(err.Error(), "strict mode") {
+		t.Errorf("Restore() error = %v, want the degraded key error", err)
+	}
+}
+
+func TestValidateKeysListsEveryInvalidKey(t *testing.T) {
+	report := keyReport{Keys: []keyExplanation{
+		{Explanation: keytemplate.Explanation{Template: `npm-{{ getenv "LOCK_HASH" }}`, Key: "npm-abc"}},
+		{Explanation: keytemplate.Explanation{Template: `{{ getenv "EMPTY_VAR" }}`, Key: ""}},
+		{Explanation: keytemplate.Explanation{Template: `npm-{{ getenv "LIST" }}`, Key: "npm-a,b"}},
+	}}
+
+	err := validateKeys(report)
+	if err == nil {
+		t.Fatal("validateKeys() error = nil, want the invalid keys")
+	}
+	for _, want := range []string{`{{ getenv "EMPTY_VAR" }}`, `npm-{{ getenv "LIST" }}`, "empty", "commas"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("validateKeys() error = %s, want it to contain %s", err, want)
+		}
+	}
+	if strings.Contains(err.Error(), "npm-abc") {
+		t.Errorf("validateKeys() error = %s, lists a valid key", err)
+	}
+
+	if err := validateKeys(keyReport{Keys: report.Keys[:1]}); err != nil {
+		t.Errorf("validateKeys() error = %s, want nil for valid keys", err)
+	}
+}
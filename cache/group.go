@@ -0,0 +1,120 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/bitrise-io/go-steputils/v2/export"
+)
+
+// groupCacheHitEnvVar returns the name of the cache hit output of a single cache group, such as BITRISE_CACHE_HIT_NPM
+func groupCacheHitEnvVar(groupName string) string {
+	return cacheHitEnvVar + "_" + strings.ToUpper(groupName)
+}
+
+// groupMatchedKeyEnvVar returns the name of the matched key output of a single cache group, such as BITRISE_CACHE_MATCHED_KEY_NPM
+func groupMatchedKeyEnvVar(groupName string) string {
+	return matchedKeyEnvVar + "_" + strings.ToUpper(groupName)
+}
+
+// restoreGroups restores every cache group concurrently. Outputs are exported only after all groups are finished,
+// because concurrent envman invocations could overwrite each other's changes.
+func (r *restorer) restoreGroups(ctx context.Context, config restoreCacheConfig, tracker stepTracker) error {
+	results := make([]restoreResult, len(config.Groups))
+	errs := make([]error, len(config.Groups))
+
+	var wg sync.WaitGroup
+	for i, group := range config.Groups {
+		wg.Add(1)
+		go func(i int, group CacheGroup) {
+			defer wg.Done()
+
+			groupRestorer := *r
+			groupRestorer.logger = newPrefixLogger(r.logger, fmt.Sprintf("[%s] ", group.Name))
+			groupConfig := config
+			groupConfig.Keys = group.Keys
+			groupConfig.MatchModes = group.matchModes
+			groupConfig.Groups = nil
+
+			results[i], errs[i] = groupRestorer.restoreArchive(ctx, groupConfig, tracker)
+		}(i, group)
+	}
+	wg.Wait()
+
+	r.logger.Println()
+	r.logger.Infof("Cache group results:")
+	exporter := export.NewExporter(r.cmdFactory)
+	var groupErrs []error
+	var cacheHitValues []string
+	var groupReports []groupRestoreReport
+	for i, group := range config.Groups {
+		cacheHitValue := results[i].cacheHitValue(group.Keys)
+		groupReport := groupRestoreReport{Name: group.Name, restoreReportEntry: newRestoreReportEntry(results[i], group.Keys)}
+		if errs[i] != nil {
+			r.logger.Errorf("- %s: %s", group.Name, errs[i])
+			groupErrs = append(groupErrs, fmt.Errorf("cache group %s: %w", group.Name, errs[i]))
+			cacheHitValue = "false"
+			groupReport.CacheHit = cacheHitValue
+			groupReport.Error = errs[i].Error()
+		} else {
+			r.logger.Printf("- %s: %s", group.Name, cacheHitValue)
+		}
+		cacheHitValues = append(cacheHitValues, cacheHitValue)
+		groupReports = append(groupReports, groupReport)
+
+		if err := exporter.ExportOutput(groupCacheHitEnvVar(group.Name), cacheHitValue); err != nil {
+			return err
+		}
+		if errs[i] != nil {
+			continue
+		}
+		if err := exporter.ExportOutput(groupMatchedKeyEnvVar(group.Name), results[i].matchedKey); err != nil {
+			return err
+		}
+		if err := r.exposeCacheHit(results[i], group.Keys); err != nil {
+			return err
+		}
+	}
+
+	overallCacheHitValue := aggregateCacheHitValues(cacheHitValues)
+	if err := exporter.ExportOutput(cacheHitEnvVar, overallCacheHitValue); err != nil {
+		return err
+	}
+	if err := r.envRepo.Set(cacheHitEnvVar, overallCacheHitValue); err != nil {
+		return err
+	}
+	report := restoreReport{
+		restoreReportEntry: restoreReportEntry{CacheHit: overallCacheHitValue, MatchedKeyIndex: -1, IsLookupOnly: config.IsLookupOnly},
+		Groups:             groupReports,
+	}
+	if err := r.exportRestoreReport(report); err != nil {
+		return err
+	}
+
+	return errors.Join(groupErrs...)
+}
+
+// aggregateCacheHitValues is `exact` if every group had an exact hit, `false` if no group was restored and `partial` otherwise.
+func aggregateCacheHitValues(values []string) string {
+	exactCount, missCount := 0, 0
+	for _, value := range values {
+		switch value {
+		case "exact":
+			exactCount++
+		case "false":
+			missCount++
+		}
+	}
+
+	switch {
+	case exactCount == len(values):
+		return "exact"
+	case missCount == len(values):
+		return "false"
+	default:
+		return "partial"
+	}
+}
@@ -0,0 +1,76 @@
+package cache
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAggregateCacheHitValues(t *testing.T) {
+	tests := []struct {
+		name   string
+		values []string
+		want   string
+	}{
+		{name: "every group exact", values: []string{"exact", "exact"}, want: "exact"},
+		{name: "every group missed", values: []string{"false", "false"}, want: "false"},
+		{name: "partial hit", values: []string{"exact", "partial"}, want: "partial"},
+		{name: "some groups missed", values: []string{"exact", "false"}, want: "partial"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := aggregateCacheHitValues(tt.values); got != tt.want {
+				t.Errorf("aggregateCacheHitValues() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRestoreGroupsFailureHandling(t *testing.T) {
+	outputs := fakeEnvman(t)
+	destination := t.TempDir()
+	downloader := fakeDownloader{
+		archives: map[string][]byte{
+			"npm-key": testArchive(t, archiveEntry{name: "node_modules/a.js", content: []byte("a")}),
+		},
+		errs: map[string]error{"pods-key": errors.New("connection reset")},
+	}
+
+	r := newFakeRestorer(t, downloader)
+	input := testInput(t, destination)
+	input.Groups = []CacheGroup{
+		{Name: "npm", Keys: []string{"npm-key"}},
+		{Name: "pods", Keys: []string{"pods-key"}},
+		{Name: "gradle", Keys: []string{"gradle-key"}},
+	}
+	err := r.Restore(input)
+	if err == nil || !strings.Contains(err.Error(), "cache group pods") {
+		t.Fatalf("Restore() error = %v, want the error of the pods group", err)
+	}
+	if strings.Contains(err.Error(), "npm") || strings.Contains(err.Error(), "gradle") {
+		t.Errorf("Restore() error = %s, want only the failed group", err)
+	}
+
+	// The failure of one group doesn't stop the others
+	if _, err := os.Stat(filepath.Join(destination, "node_modules", "a.js")); err != nil {
+		t.Errorf("npm group was not restored: %s", err)
+	}
+	got := outputs()
+	want := map[string]string{
+		groupCacheHitEnvVar("npm"):    "exact",
+		groupMatchedKeyEnvVar("npm"):  "npm-key",
+		groupCacheHitEnvVar("pods"):   "false",
+		groupCacheHitEnvVar("gradle"): "false",
+		cacheHitEnvVar:                "partial",
+	}
+	for key, value := range want {
+		if got[key] != value {
+			t.Errorf("%s = %q, want %q", key, got[key], value)
+		}
+	}
+	if _, ok := got[groupMatchedKeyEnvVar("pods")]; ok {
+		t.Errorf("matched key of the failed group was exported")
+	}
+}
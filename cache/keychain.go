@@ -0,0 +1,81 @@
+package cache
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/bitrise-steplib/bitrise-step-restore-cache/cache/keytemplate"
+	"github.com/bitrise-steplib/bitrise-step-restore-cache/cache/network"
+)
+
+// branchActionRegexp matches the {{ .Branch }} element of a key template, including the whitespace trimming variants.
+var branchActionRegexp = regexp.MustCompile(`\{\{-?\s*\.Branch\s*-?}}`)
+
+// expandKeyChain evaluates the base key template into keys in priority order: the exact key, then the prefix of
+// the base key up to the branch for the current branch, the PR target branch and the default branch.
+// The prefix keeps the text following {{ .Branch }} up to the next template element, such as the `-` of
+// `npm-{{ .Branch }}-{{ checksum "package-lock.json" }}`. Branches that are unknown or already in the chain are skipped.
+func (r *restorer) expandKeyChain(model keytemplate.Model, baseKey string, report *keyReport) ([]string, []network.MatchMode, error) {
+	prefixTemplate, err := branchPrefixTemplate(baseKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	r.logger.Println()
+	r.logger.Printf("Expanding base key template: %s", baseKey)
+	exactKey, err := r.explainKey(model, baseKey, network.MatchExact, "", report)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to evaluate base key template: %w", err)
+	}
+	keys := []string{exactKey}
+	matchModes := []network.MatchMode{network.MatchExact}
+
+	currentBranch, targetBranch, defaultBranch := model.Branches()
+	for _, branch := range []string{currentBranch, targetBranch, defaultBranch} {
+		if branch == "" {
+			continue
+		}
+		key, err := r.explainKey(model.WithBranch(branch), prefixTemplate, network.MatchPrefix, "", report)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to evaluate base key template: %w", err)
+		}
+		if slices.Contains(keys, key) {
+			continue
+		}
+		keys = append(keys, key)
+		matchModes = append(matchModes, network.MatchPrefix)
+	}
+
+	return keys, matchModes, nil
+}
+
+// branchPrefixTemplate returns the base key template cut before the first template element following {{ .Branch }}.
+func branchPrefixTemplate(baseKey string) (string, error) {
+	loc := branchActionRegexp.FindStringIndex(baseKey)
+	if loc == nil {
+		return "", fmt.Errorf("base key has to contain the {{ .Branch }} template element: %s", baseKey)
+	}
+	rest := baseKey[loc[1]:]
+	if i := strings.Index(rest, "{{"); i != -1 {
+		rest = rest[:i]
+	}
+	return baseKey[:loc[1]] + rest, nil
+}
+
+// appendKeyChain appends the chain to the keys, as long as the total fits in network.MaxKeyCount.
+// The lowest priority keys of the chain are dropped with a warning.
+func (r *restorer) appendKeyChain(keys []string, matchModes []network.MatchMode, chainKeys []string, chainMatchModes []network.MatchMode) ([]string, []network.MatchMode) {
+	room := max(network.MaxKeyCount-len(keys), 0)
+	if len(chainKeys) > room {
+		r.logger.Warnf("Key chain doesn't fit in the limit of %d keys, dropping: %s", network.MaxKeyCount, strings.Join(chainKeys[room:], ", "))
+		chainKeys, chainMatchModes = chainKeys[:room], chainMatchModes[:room]
+	}
+
+	r.logger.Donef("Key chain:")
+	for i, key := range chainKeys {
+		r.logger.Donef("- [%s] %s", chainMatchModes[i], key)
+	}
+	return append(keys, chainKeys...), append(matchModes, chainMatchModes...)
+}
@@ -0,0 +1,100 @@
+package cache
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/bitrise-io/go-utils/v2/env"
+	"github.com/bitrise-io/go-utils/v2/log"
+	"github.com/bitrise-steplib/bitrise-step-restore-cache/cache/keytemplate"
+	"github.com/bitrise-steplib/bitrise-step-restore-cache/cache/network"
+)
+
+func TestBranchPrefixTemplate(t *testing.T) {
+	tests := []struct {
+		baseKey string
+		want    string
+		wantErr bool
+	}{
+		{baseKey: `npm-{{ .Branch }}-{{ checksum "package-lock.json" }}`, want: "npm-{{ .Branch }}-"},
+		{baseKey: `npm-{{- .Branch -}}/{{ .OS }}`, want: "npm-{{- .Branch -}}/"},
+		{baseKey: `{{ .OS }}-{{.Branch}}`, want: "{{ .OS }}-{{.Branch}}"},
+		{baseKey: `npm-{{ .OS }}`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.baseKey, func(t *testing.T) {
+			got, err := branchPrefixTemplate(tt.baseKey)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("branchPrefixTemplate() error = %v, wantErr %t", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("branchPrefixTemplate() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExpandKeyChain(t *testing.T) {
+	const baseKey = `npm-{{ .Branch }}-{{ getenv "LOCK_HASH" }}`
+	tests := []struct {
+		name          string
+		branch        string
+		targetBranch  string
+		defaultBranch string
+		wantKeys      []string
+		wantModes     []network.MatchMode
+	}{
+		{
+			name:          "pull request",
+			branch:        "feature",
+			targetBranch:  "develop",
+			defaultBranch: "main",
+			wantKeys:      []string{"npm-feature-abc", "npm-feature-", "npm-develop-", "npm-main-"},
+			wantModes:     []network.MatchMode{network.MatchExact, network.MatchPrefix, network.MatchPrefix, network.MatchPrefix},
+		},
+		{
+			name:          "build of the default branch",
+			branch:        "main",
+			defaultBranch: "main",
+			wantKeys:      []string{"npm-main-abc", "npm-main-"},
+			wantModes:     []network.MatchMode{network.MatchExact, network.MatchPrefix},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("LOCK_HASH", "abc")
+			t.Setenv("BITRISE_GIT_BRANCH", tt.branch)
+			t.Setenv("BITRISEIO_GIT_BRANCH_DEST", tt.targetBranch)
+			model := keytemplate.NewModel(env.NewRepository(), log.NewLogger()).WithDefaultBranch(tt.defaultBranch)
+
+			keys, modes, err := newTestRestorer().expandKeyChain(model, baseKey, &keyReport{})
+			if err != nil {
+				t.Fatalf("expandKeyChain() error = %s", err)
+			}
+			if !reflect.DeepEqual(keys, tt.wantKeys) || !reflect.DeepEqual(modes, tt.wantModes) {
+				t.Errorf("expandKeyChain() = %q, %q, want %q, %q", keys, modes, tt.wantKeys, tt.wantModes)
+			}
+		})
+	}
+}
+
+func TestAppendKeyChain(t *testing.T) {
+	var keys []string
+	var modes []network.MatchMode
+	for i := 0; i < network.MaxKeyCount-2; i++ {
+		keys = append(keys, "key-"+strings.Repeat("a", i+1))
+		modes = append(modes, network.MatchPrefix)
+	}
+	chainKeys := []string{"npm-feature-abc", "npm-feature-", "npm-main-"}
+	chainModes := []network.MatchMode{network.MatchExact, network.MatchPrefix, network.MatchPrefix}
+
+	gotKeys, gotModes := newTestRestorer().appendKeyChain(keys, modes, chainKeys, chainModes)
+
+	// The lowest priority key of the chain is dropped
+	wantKeys := append(append([]string{}, keys...), "npm-feature-abc", "npm-feature-")
+	wantModes := append(append([]network.MatchMode{}, modes...), network.MatchExact, network.MatchPrefix)
+	if !reflect.DeepEqual(gotKeys, wantKeys) || !reflect.DeepEqual(gotModes, wantModes) {
+		t.Errorf("appendKeyChain() = %q, %q, want %q, %q", gotKeys, gotModes, wantKeys, wantModes)
+	}
+}
@@ -0,0 +1,374 @@
+package keytemplate
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/bitrise-io/go-utils/v2/pathutil"
+	"github.com/bmatcuk/doublestar/v4"
+)
+
+// normalizeOption is the argument of checksum and checksumDir enabling content normalization.
+const normalizeOption = "--normalize"
+
+// commentedLockfiles are the lockfile formats with `#` line comments, which normalization drops.
+var commentedLockfiles = []string{"yarn.lock", "Cargo.lock", "poetry.lock", "uv.lock", "pnpm-lock.yaml", "requirements*.txt"}
+
+type checksumOptions struct {
+	// normalize hashes the file contents with LF line endings, and without the comment lines of commentedLockfiles
+	normalize bool
+}
+
+// exclusion is a negated (`!`) path pattern, base is the absolute directory the pattern is relative to.
+type exclusion struct {
+	base    string
+	pattern string
+}
+
+// checksum returns a hex-encoded SHA-256 checksum of one or multiple files. Each file path can contain glob patterns,
+// including "doublestar" patterns (such as `**/*.gradle`). Patterns starting with `!` exclude the matching files,
+// and the files of the matching directories (such as `!**/build/**`). The `--normalize` argument enables normalization.
+// The path list is sorted alphabetically to produce consistent output.
+// Errors are logged as warnings and an empty string is returned in that case.
+// The checksums of the individual files are returned for the explanation of the key.
+func (m Model) checksum(args ...string) (string, []InputChecksum) {
+	options, paths, exclusions := m.parseChecksumArgs(args)
+	files := m.filterFilesOnly(m.excludePaths(m.evaluateGlobPatterns(paths), exclusions))
+	m.logger.Debugf("Files included in checksum:")
+	for _, path := range files {
+		m.logger.Debugf("- %s", path)
+	}
+
+	if len(files) == 0 {
+		m.warnf("No files to include in the checksum")
+		return "", nil
+	} else if len(files) == 1 {
+		checksum, err := checksumOfFile(files[0], options)
+		if err != nil {
+			m.warnf("Error while computing checksum %s: %s", files[0], err)
+			return "", nil
+		}
+		return hex.EncodeToString(checksum), []InputChecksum{{Path: files[0], Checksum: hex.EncodeToString(checksum)}}
+	}
+
+	finalChecksum := sha256.New()
+	var inputs []InputChecksum
+	sort.Strings(files)
+	for _, path := range files {
+		checksum, err := checksumOfFile(path, options)
+		if err != nil {
+			m.warnf("Error while hashing %s: %s", path, err)
+			continue
+		}
+
+		finalChecksum.Write(checksum)
+		inputs = append(inputs, InputChecksum{Path: path, Checksum: hex.EncodeToString(checksum)})
+	}
+
+	return hex.EncodeToString(finalChecksum.Sum(nil)), inputs
+}
+
+// checksumDir returns a hex-encoded SHA-256 checksum of one or multiple directory trees. It covers the path
+// (relative to the directory), the type and the executable bit of every entry, the content of the files
+// and the target of the symlinks, so it doesn't depend on where the directory is checked out.
+// Arguments work the same way as in checksum, but the paths have to match directories.
+// Directories that can't be hashed are skipped with a warning, an empty string is returned if none of them can be hashed.
+func (m Model) checksumDir(args ...string) (string, []InputChecksum) {
+	options, paths, exclusions := m.parseChecksumArgs(args)
+	dirs := m.filterDirsOnly(m.excludePaths(m.evaluateGlobPatterns(paths), exclusions))
+	m.logger.Debugf("Directories included in checksum:")
+	for _, dir := range dirs {
+		m.logger.Debugf("- %s", dir)
+	}
+
+	if len(dirs) == 0 {
+		m.warnf("No directories to include in the checksum")
+		return "", nil
+	}
+
+	finalChecksum := sha256.New()
+	var inputs []InputChecksum
+	sort.Strings(dirs)
+	for _, dir := range dirs {
+		checksum, err := checksumOfDir(dir, exclusions, options)
+		if err != nil {
+			m.warnf("Error while hashing directory %s: %s", dir, err)
+			continue
+		}
+
+		finalChecksum.Write(checksum)
+		inputs = append(inputs, InputChecksum{Path: dir, Checksum: hex.EncodeToString(checksum)})
+	}
+	if len(inputs) == 0 {
+		return "", nil
+	}
+
+	return hex.EncodeToString(finalChecksum.Sum(nil)), inputs
+}
+
+// parseChecksumArgs splits the arguments of checksum and checksumDir into options, paths and exclusions.
+func (m Model) parseChecksumArgs(args []string) (checksumOptions, []string, []exclusion) {
+	var options checksumOptions
+	var paths []string
+	var exclusions []exclusion
+	for _, arg := range args {
+		switch {
+		case arg == normalizeOption:
+			options.normalize = true
+		case strings.HasPrefix(arg, "!"):
+			base, pattern := doublestar.SplitPattern(strings.TrimPrefix(arg, "!"))
+			absBase, err := pathutil.NewPathModifier().AbsPath(base)
+			if err != nil {
+				m.warnf("Failed to convert %s to an absolute path: %s", arg, err)
+				continue
+			}
+			exclusions = append(exclusions, exclusion{base: absBase, pattern: pattern})
+		default:
+			paths = append(paths, arg)
+		}
+	}
+
+	return options, paths, exclusions
+}
+
+func (m Model) evaluateGlobPatterns(paths []string) []string {
+	var finalPaths []string
+
+	for _, path := range paths {
+		if strings.Contains(path, "*") {
+			base, pattern := doublestar.SplitPattern(path)
+			absBase, err := pathutil.NewPathModifier().AbsPath(base)
+			if err != nil {
+				m.warnf("Failed to convert %s to an absolute path: %s", path, err)
+				continue
+			}
+			m.logger.Debugf("Finding matches for %s/%s", absBase, pattern)
+			matches, err := doublestar.Glob(os.DirFS(absBase), pattern, doublestar.WithNoFollow())
+			if matches == nil {
+				m.warnf("No match for pattern: %s", path)
+				continue
+			}
+			if err != nil {
+				m.warnf("Error in pattern '%s': %s", path, err)
+				continue
+			}
+			for _, match := range matches {
+				finalPaths = append(finalPaths, filepath.Join(absBase, match))
+			}
+		} else {
+			finalPaths = append(finalPaths, path)
+		}
+	}
+
+	return finalPaths
+}
+
+// excludePaths returns the paths not matched by any of the exclusions.
+func (m Model) excludePaths(paths []string, exclusions []exclusion) []string {
+	if len(exclusions) == 0 {
+		return paths
+	}
+
+	var included []string
+	for _, path := range paths {
+		absPath, err := pathutil.NewPathModifier().AbsPath(path)
+		if err != nil {
+			m.warnf("Failed to convert %s to an absolute path: %s", path, err)
+			continue
+		}
+		if isExcluded(absPath, exclusions, true) {
+			m.logger.Debugf("Excluded: %s", path)
+			continue
+		}
+		included = append(included, path)
+	}
+
+	return included
+}
+
+// isExcluded returns true if an exclusion matches absPath, or (if withParents is set) one of its parent directories.
+func isExcluded(absPath string, exclusions []exclusion, withParents bool) bool {
+	for _, e := range exclusions {
+		rel, err := filepath.Rel(e.base, absPath)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			continue
+		}
+		for rel != "." {
+			if match, _ := doublestar.PathMatch(e.pattern, rel); match {
+				return true
+			}
+			if !withParents {
+				break
+			}
+			rel = filepath.Dir(rel)
+		}
+	}
+	return false
+}
+
+func checksumOfFile(path string, options checksumOptions) ([]byte, error) {
+	if options.normalize {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		checksum := sha256.Sum256(normalizeContent(path, content))
+		return checksum[:], nil
+	}
+
+	hash := sha256.New()
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close() //nolint:errcheck
+
+	_, err = io.Copy(hash, file)
+	if err != nil {
+		return nil, err
+	}
+
+	return hash.Sum(nil), nil
+}
+
+// checksumOfDir hashes the entries of dir in lexical order. The parents of excluded entries are already
+// skipped by the walk, so only the entries themselves are matched against the exclusions.
+func checksumOfDir(dir string, exclusions []exclusion, options checksumOptions) ([]byte, error) {
+	hash := sha256.New()
+	err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if path != dir && isExcluded(path, exclusions, false) {
+			if entry.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+
+		// The executable bit is the only part of the mode that is the same on every checkout (it's what git keeps)
+		executable := info.Mode().IsRegular() && info.Mode().Perm()&0111 != 0
+		fmt.Fprintf(hash, "%s\x00%s\x00%t\x00", entryType(info.Mode()), filepath.ToSlash(rel), executable)
+
+		switch {
+		case info.Mode().IsRegular():
+			checksum, err := checksumOfFile(path, options)
+			if err != nil {
+				return err
+			}
+			hash.Write(checksum)
+		case info.Mode()&fs.ModeSymlink != 0:
+			target, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			hash.Write([]byte(filepath.ToSlash(target)))
+		}
+		hash.Write([]byte{'\n'})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return hash.Sum(nil), nil
+}
+
+func entryType(mode fs.FileMode) string {
+	switch {
+	case mode.IsDir():
+		return "dir"
+	case mode.IsRegular():
+		return "file"
+	case mode&fs.ModeSymlink != 0:
+		return "symlink"
+	default:
+		return "other"
+	}
+}
+
+// normalizeContent converts CRLF line endings to LF, and drops the comment lines of commentedLockfiles,
+// so the checksum is the same on every platform and with every version of the package manager.
+func normalizeContent(path string, content []byte) []byte {
+	content = bytes.ReplaceAll(content, []byte("\r\n"), []byte("\n"))
+	if !hasLineComments(path) {
+		return content
+	}
+
+	lines := bytes.SplitAfter(content, []byte("\n"))
+	normalized := make([]byte, 0, len(content))
+	for _, line := range lines {
+		if bytes.HasPrefix(bytes.TrimSpace(line), []byte("#")) {
+			continue
+		}
+		normalized = append(normalized, line...)
+	}
+	return normalized
+}
+
+func hasLineComments(path string) bool {
+	name := filepath.Base(path)
+	for _, pattern := range commentedLockfiles {
+		if match, _ := filepath.Match(pattern, name); match {
+			return true
+		}
+	}
+	return false
+}
+
+func (m Model) filterFilesOnly(paths []string) []string {
+	var files []string
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			m.warnf("Failed to get file info for %s: %s", path, err)
+			continue
+		}
+		if info.IsDir() {
+			m.logger.Debugf("Skipping directory: %s", path)
+			continue
+		}
+		files = append(files, path)
+	}
+
+	return files
+}
+
+func (m Model) filterDirsOnly(paths []string) []string {
+	var dirs []string
+	for _, path := range paths {
+		absPath, err := pathutil.NewPathModifier().AbsPath(path)
+		if err != nil {
+			m.warnf("Failed to convert %s to an absolute path: %s", path, err)
+			continue
+		}
+		info, err := os.Stat(absPath)
+		if err != nil {
+			m.warnf("Failed to get file info for %s: %s", path, err)
+			continue
+		}
+		if !info.IsDir() {
+			m.logger.Debugf("Skipping file: %s", path)
+			continue
+		}
+		dirs = append(dirs, absPath)
+	}
+
+	return dirs
+}
@@ -0,0 +1,467 @@
+package keytemplate
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// dependencyParser returns the resolved dependencies of a manifest as canonical entries, in any order.
+type dependencyParser func(content []byte) ([]string, error)
+
+// pnpmIntegrityRegexp matches the checksum of a pnpm package, such as `resolution: {integrity: sha512-...}`.
+var pnpmIntegrityRegexp = regexp.MustCompile(`(integrity|tarball|commit): ([^,}\s]+)`)
+
+// dependencyChecksum returns a hex-encoded SHA-256 checksum of the resolved dependencies in one or multiple
+// lockfiles, in canonical order. Unlike checksum, it doesn't change if only the formatting, the comments or the
+// unrelated parts of the file change (such as the version of the project itself).
+// Arguments work the same way as in checksum. Files of unknown formats are hashed as a whole, with a warning.
+func (m Model) dependencyChecksum(args ...string) (string, []InputChecksum) {
+	_, paths, exclusions := m.parseChecksumArgs(args)
+	files := m.filterFilesOnly(m.excludePaths(m.evaluateGlobPatterns(paths), exclusions))
+	m.logger.Debugf("Files included in dependency checksum:")
+	for _, path := range files {
+		m.logger.Debugf("- %s", path)
+	}
+
+	if len(files) == 0 {
+		m.warnf("No files to include in the checksum")
+		return "", nil
+	}
+
+	finalChecksum := sha256.New()
+	var inputs []InputChecksum
+	sort.Strings(files)
+	for _, path := range files {
+		checksum, err := m.checksumOfDependencies(path)
+		if err != nil {
+			m.warnf("Error while hashing %s: %s", path, err)
+			continue
+		}
+		inputs = append(inputs, InputChecksum{Path: path, Checksum: hex.EncodeToString(checksum)})
+		if len(files) == 1 {
+			return hex.EncodeToString(checksum), inputs
+		}
+
+		finalChecksum.Write(checksum)
+	}
+	if len(inputs) == 0 {
+		return "", nil
+	}
+
+	return hex.EncodeToString(finalChecksum.Sum(nil)), inputs
+}
+
+func (m Model) checksumOfDependencies(path string) ([]byte, error) {
+	parse := dependencyParserFor(path)
+	if parse == nil {
+		m.warnf("Unknown lockfile format, hashing the whole file: %s", path)
+		return checksumOfFile(path, checksumOptions{normalize: true})
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := parse(bytes.ReplaceAll(content, []byte("\r\n"), []byte("\n")))
+	if err != nil {
+		m.warnf("Failed to parse %s, hashing the whole file: %s", path, err)
+		return checksumOfFile(path, checksumOptions{normalize: true})
+	}
+	m.logger.Debugf("%d dependencies in %s", len(entries), path)
+
+	slices.Sort(entries)
+	entries = slices.Compact(entries)
+	checksum := sha256.Sum256([]byte(strings.Join(entries, "\n")))
+	return checksum[:], nil
+}
+
+func dependencyParserFor(path string) dependencyParser {
+	name := filepath.Base(path)
+	switch {
+	case name == "package-lock.json" || name == "npm-shrinkwrap.json":
+		return parseNpmLock
+	case name == "yarn.lock":
+		return parseYarnLock
+	case name == "pnpm-lock.yaml":
+		return parsePnpmLock
+	case name == "Package.resolved":
+		return parsePackageResolved
+	case name == "Podfile.lock":
+		return parsePodfileLock
+	case name == "Gemfile.lock":
+		return parseGemfileLock
+	case name == "go.sum":
+		return parseGoSum
+	case strings.HasSuffix(name, ".versions.toml"):
+		return parseVersionCatalog
+	default:
+		return nil
+	}
+}
+
+type npmLock struct {
+	// Packages is the package list of lockfile version 2 and 3, keyed by the install path
+	Packages map[string]npmPackage `json:"packages"`
+	// Dependencies is the dependency tree of lockfile version 1
+	Dependencies map[string]npmDependency `json:"dependencies"`
+}
+
+type npmPackage struct {
+	Version   string `json:"version"`
+	Resolved  string `json:"resolved"`
+	Integrity string `json:"integrity"`
+	Link      bool   `json:"link"`
+}
+
+// npmDependency is a package of the lockfile version 1 dependency tree, with its nested dependencies.
+// The `dependencies` of the version 2 and 3 packages are version ranges instead.
+type npmDependency struct {
+	npmPackage
+	Dependencies map[string]npmDependency `json:"dependencies"`
+}
+
+func (p npmPackage) entry(path string) string {
+	source := p.Integrity
+	if source == "" {
+		source = p.Resolved
+	}
+	return fmt.Sprintf("%s@%s %s", path, p.Version, source)
+}
+
+// parseNpmLock returns the installed packages. The project and the workspace packages are left out,
+// as their entries change with their own version.
+func parseNpmLock(content []byte) ([]string, error) {
+	var lock npmLock
+	if err := json.Unmarshal(content, &lock); err != nil {
+		return nil, err
+	}
+
+	var entries []string
+	if len(lock.Packages) > 0 {
+		for path, pkg := range lock.Packages {
+			if pkg.Link || !strings.Contains(path, "node_modules/") {
+				continue
+			}
+			entries = append(entries, pkg.entry(path))
+		}
+		return entries, nil
+	}
+
+	var walk func(prefix string, dependencies map[string]npmDependency)
+	walk = func(prefix string, dependencies map[string]npmDependency) {
+		for name, dependency := range dependencies {
+			entries = append(entries, dependency.entry(prefix+name))
+			walk(prefix+name+"/", dependency.Dependencies)
+		}
+	}
+	walk("", lock.Dependencies)
+	return entries, nil
+}
+
+// parseYarnLock returns the resolved packages of a classic (v1) or a Berry yarn.lock. The version ranges of the
+// entry headers are left out, only the package name, the resolved version and its checksum are kept.
+func parseYarnLock(content []byte) ([]string, error) {
+	var entries []string
+	name, version, checksum := "", "", ""
+	flush := func() {
+		if name != "" {
+			entries = append(entries, fmt.Sprintf("%s@%s %s", name, version, checksum))
+		}
+		name, version, checksum = "", "", ""
+	}
+
+	for _, line := range strings.Split(string(content), "\n") {
+		if strings.TrimSpace(line) == "" || strings.HasPrefix(strings.TrimSpace(line), "#") {
+			continue
+		}
+		if !strings.HasPrefix(line, " ") {
+			flush()
+			header := strings.TrimSuffix(strings.TrimSpace(line), ":")
+			if header == "__metadata" {
+				continue
+			}
+			firstSpecifier, _, _ := strings.Cut(header, ",")
+			name = yarnPackageName(strings.Trim(strings.TrimSpace(firstSpecifier), `"`))
+			continue
+		}
+		if strings.HasPrefix(line, "   ") {
+			// Nested fields, such as the dependency ranges
+			continue
+		}
+
+		key, value := splitYarnField(strings.TrimSpace(line))
+		switch key {
+		case "version":
+			version = value
+		case "integrity", "checksum":
+			checksum = value
+		}
+	}
+	flush()
+
+	if len(entries) == 0 && len(bytes.TrimSpace(content)) > 0 && !bytes.Contains(content, []byte("__metadata")) {
+		return nil, fmt.Errorf("no package entries found")
+	}
+	return entries, nil
+}
+
+// yarnPackageName returns the name of a yarn.lock specifier, such as `@babel/core` of `@babel/core@npm:^7.0.0`.
+func yarnPackageName(specifier string) string {
+	// The first @ (after the leading @ of a scope) separates the range, which can contain @ itself (`npm:foo@1`)
+	if i := strings.Index(specifier[min(1, len(specifier)):], "@"); i != -1 {
+		return specifier[:i+min(1, len(specifier))]
+	}
+	return specifier
+}
+
+// splitYarnField splits `version "1.0.0"` (classic) and `version: 1.0.0` (Berry).
+func splitYarnField(line string) (string, string) {
+	key, value, found := strings.Cut(line, ":")
+	if !found || strings.Contains(key, " ") {
+		key, value, _ = strings.Cut(line, " ")
+	}
+	return strings.Trim(key, `"`), strings.Trim(strings.TrimSpace(value), `"`)
+}
+
+// parsePnpmLock returns the keys of the `packages` and `snapshots` sections (the resolved package versions,
+// including their peer dependencies), together with the checksum of the packages.
+func parsePnpmLock(content []byte) ([]string, error) {
+	var entries []string
+	section := ""
+	key := ""
+	for _, line := range strings.Split(string(content), "\n") {
+		if strings.TrimSpace(line) == "" || strings.HasPrefix(strings.TrimSpace(line), "#") {
+			continue
+		}
+		if !strings.HasPrefix(line, " ") {
+			section = strings.TrimSuffix(strings.TrimSpace(line), ":")
+			continue
+		}
+		if section != "packages" && section != "snapshots" {
+			continue
+		}
+
+		if strings.HasPrefix(line, "  ") && !strings.HasPrefix(line, "   ") {
+			key = pnpmPackageKey(strings.TrimSpace(line))
+			entries = append(entries, section+" "+key)
+			continue
+		}
+		if match := pnpmIntegrityRegexp.FindStringSubmatch(line); match != nil && strings.HasPrefix(strings.TrimSpace(line), "resolution:") {
+			entries = append(entries, fmt.Sprintf("%s %s %s", section, key, match[2]))
+		}
+	}
+
+	if len(entries) == 0 && !strings.Contains(string(content), "lockfileVersion") {
+		return nil, fmt.Errorf("not a pnpm lockfile")
+	}
+	return entries, nil
+}
+
+// pnpmPackageKey returns the package key of a `packages` or `snapshots` entry line, such as `react@18.2.0`
+// of `react@18.2.0:`, `'react@18.2.0':` or `react@18.2.0: {}`. The leading `/` of older lockfiles is dropped.
+func pnpmPackageKey(line string) string {
+	key := line
+	if quote := key[0]; quote == '\'' || quote == '"' {
+		if end := strings.IndexByte(key[1:], quote); end != -1 {
+			key = key[1 : end+1]
+		}
+	} else if before, _, found := strings.Cut(key, ": "); found {
+		key = before
+	} else {
+		key = strings.TrimSuffix(key, ":")
+	}
+	return strings.TrimPrefix(key, "/")
+}
+
+type swiftPin struct {
+	Identity string `json:"identity"`
+	// Package is the name of the package in version 1 of the file
+	Package string `json:"package"`
+	State   struct {
+		Branch   string `json:"branch"`
+		Revision string `json:"revision"`
+		Version  string `json:"version"`
+	} `json:"state"`
+}
+
+// parsePackageResolved returns the pinned revisions of the Swift packages. The originHash is left out,
+// as it changes with every edit of Package.swift.
+func parsePackageResolved(content []byte) ([]string, error) {
+	var resolved struct {
+		Pins   []swiftPin `json:"pins"`
+		Object struct {
+			Pins []swiftPin `json:"pins"`
+		} `json:"object"`
+	}
+	if err := json.Unmarshal(content, &resolved); err != nil {
+		return nil, err
+	}
+
+	var entries []string
+	for _, pin := range append(resolved.Pins, resolved.Object.Pins...) {
+		identity := pin.Identity
+		if identity == "" {
+			identity = pin.Package
+		}
+		entries = append(entries, fmt.Sprintf("%s %s %s %s", strings.ToLower(identity), pin.State.Version, pin.State.Branch, pin.State.Revision))
+	}
+	return entries, nil
+}
+
+// parsePodfileLock returns the installed pods, their spec checksums and the checkout options of the pods from git.
+// The Podfile checksum and the CocoaPods version are left out.
+func parsePodfileLock(content []byte) ([]string, error) {
+	var entries []string
+	section := ""
+	key := ""
+	for _, line := range strings.Split(string(content), "\n") {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" {
+			continue
+		}
+		if !strings.HasPrefix(line, " ") {
+			section, _, _ = strings.Cut(trimmed, ":")
+			continue
+		}
+
+		indent := len(line) - len(strings.TrimLeft(line, " "))
+		switch {
+		case section == "PODS" && indent == 2:
+			entries = append(entries, "pod "+strings.TrimSuffix(strings.TrimPrefix(trimmed, "- "), ":"))
+		case section == "SPEC CHECKSUMS":
+			entries = append(entries, "checksum "+trimmed)
+		case section == "CHECKOUT OPTIONS" && indent == 2:
+			key = strings.TrimSuffix(trimmed, ":")
+		case section == "CHECKOUT OPTIONS":
+			entries = append(entries, "checkout "+key+" "+trimmed)
+		}
+	}
+
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("no pods found")
+	}
+	return entries, nil
+}
+
+// parseGemfileLock returns the resolved gems, the git revisions, the platforms and the gem checksums.
+// The declared dependencies and the Bundler version are left out.
+func parseGemfileLock(content []byte) ([]string, error) {
+	var entries []string
+	section := ""
+	for _, line := range strings.Split(string(content), "\n") {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" {
+			continue
+		}
+		if !strings.HasPrefix(line, " ") {
+			section = trimmed
+			continue
+		}
+
+		indent := len(line) - len(strings.TrimLeft(line, " "))
+		switch {
+		case (section == "GEM" || section == "GIT" || section == "PATH") && indent == 4:
+			entries = append(entries, "gem "+trimmed)
+		case section == "GIT" && strings.HasPrefix(trimmed, "revision:"):
+			entries = append(entries, "git "+trimmed)
+		case section == "PLATFORMS":
+			entries = append(entries, "platform "+trimmed)
+		case section == "CHECKSUMS":
+			entries = append(entries, "checksum "+trimmed)
+		}
+	}
+
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("no gems found")
+	}
+	return entries, nil
+}
+
+// parseGoSum returns the module hashes with normalized whitespace.
+func parseGoSum(content []byte) ([]string, error) {
+	var entries []string
+	for _, line := range strings.Split(string(content), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("invalid go.sum line: %s", line)
+		}
+		entries = append(entries, strings.Join(fields, " "))
+	}
+	return entries, nil
+}
+
+// parseVersionCatalog returns the entries of a Gradle version catalog (libs.versions.toml) as `section.key=value`,
+// without comments and whitespace, so reordering or reformatting the catalog doesn't change the checksum.
+func parseVersionCatalog(content []byte) ([]string, error) {
+	var entries []string
+	section := ""
+	statement := ""
+	depth := 0
+	for _, line := range strings.Split(string(content), "\n") {
+		line, lineDepth := compactTOMLLine(line)
+		if line == "" {
+			continue
+		}
+		if depth == 0 && strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") && lineDepth == 0 {
+			section = strings.Trim(line, "[]")
+			continue
+		}
+
+		statement += line
+		depth += lineDepth
+		if depth > 0 {
+			// Multi-line arrays and inline tables continue on the next line
+			continue
+		}
+		if !strings.Contains(statement, "=") {
+			return nil, fmt.Errorf("invalid version catalog line: %s", statement)
+		}
+		entries = append(entries, section+"."+strings.ReplaceAll(statement, ",]", "]"))
+		statement = ""
+		depth = 0
+	}
+	if depth != 0 {
+		return nil, fmt.Errorf("unterminated array or table: %s", statement)
+	}
+	return entries, nil
+}
+
+// compactTOMLLine removes the whitespace and the comment of a TOML line, except within strings.
+// It returns the change of the bracket depth of the line too.
+func compactTOMLLine(line string) (string, int) {
+	var compact strings.Builder
+	depth := 0
+	var quote rune
+	for _, c := range line {
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#':
+			return compact.String(), depth
+		case c == ' ' || c == '\t':
+			continue
+		case c == '[' || c == '{':
+			depth++
+		case c == ']' || c == '}':
+			depth--
+		}
+		compact.WriteRune(c)
+	}
+	return compact.String(), depth
+}
@@ -0,0 +1,137 @@
+package keytemplate
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/bitrise-io/go-utils/v2/env"
+	"github.com/bitrise-io/go-utils/v2/log"
+)
+
+var updateGolden = flag.Bool("update", false, "update the golden files of the dependency checksum tests")
+
+// TestDependencyChecksum checks the lockfile fixtures of testdata/dependencies/<format>. Each format has the same lockfile
+// in three variants: original, reformatted (formatting-only changes, which must keep the checksum) and changed
+// (a dependency change, which must alter it). entries.golden is the canonical dependency list of the original.
+func TestDependencyChecksum(t *testing.T) {
+	formats, err := os.ReadDir("testdata/dependencies")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, format := range formats {
+		dir := filepath.Join("testdata", "dependencies", format.Name())
+		t.Run(format.Name(), func(t *testing.T) {
+			original := dependencyChecksumOf(t, filepath.Join(dir, "original"))
+			if reformatted := dependencyChecksumOf(t, filepath.Join(dir, "reformatted")); reformatted != original {
+				t.Errorf("formatting-only changes altered the checksum: %s, original: %s", reformatted, original)
+			}
+			if changed := dependencyChecksumOf(t, filepath.Join(dir, "changed")); changed == original {
+				t.Errorf("dependency changes kept the checksum: %s", changed)
+			}
+
+			entries := canonicalEntries(t, lockfileIn(t, filepath.Join(dir, "original")))
+			goldenPath := filepath.Join(dir, "entries.golden")
+			if *updateGolden {
+				if err := os.WriteFile(goldenPath, []byte(entries), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			golden, err := os.ReadFile(goldenPath)
+			if err != nil {
+				t.Fatalf("%s (run the test with -update to create it)", err)
+			}
+			if entries != string(golden) {
+				t.Errorf("dependencies of the original lockfile:\n%s\nwant (%s):\n%s", entries, goldenPath, golden)
+			}
+		})
+	}
+}
+
+func TestDependencyChecksumMultipleFiles(t *testing.T) {
+	npm := filepath.Join("testdata", "dependencies", "npm-v3", "original", "package-lock.json")
+	pods := filepath.Join("testdata", "dependencies", "podfile", "original", "Podfile.lock")
+
+	both := evaluateStrict(t, fmt.Sprintf(`{{ dependencyChecksum %q %q }}`, npm, pods))
+	reversed := evaluateStrict(t, fmt.Sprintf(`{{ dependencyChecksum %q %q }}`, pods, npm))
+	if both != reversed {
+		t.Errorf("the order of the arguments changed the checksum: %s, %s", both, reversed)
+	}
+	if single := evaluateStrict(t, fmt.Sprintf(`{{ dependencyChecksum %q }}`, npm)); single == both {
+		t.Errorf("the checksum of two lockfiles is the checksum of one of them")
+	}
+}
+
+func TestDependencyChecksumFallback(t *testing.T) {
+	dir := t.TempDir()
+	unknown := filepath.Join(dir, "deps.lock")
+	invalid := filepath.Join(dir, "package-lock.json")
+	for path, content := range map[string]string{unknown: "a 1.0.0\r\n", invalid: "{not json"} {
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, path := range []string{unknown, invalid} {
+		model := NewModel(env.NewRepository(), log.NewLogger())
+		explanation, err := model.Explain(fmt.Sprintf(`{{ dependencyChecksum %q }}`, path))
+		if err != nil {
+			t.Fatalf("%s: %s", path, err)
+		}
+		if explanation.Key == "" || len(explanation.Warnings) != 1 {
+			t.Errorf("%s: want the whole file hashed with a warning, got %q with warnings %v", path, explanation.Key, explanation.Warnings)
+		}
+
+		if _, err := model.WithStrict(true).Evaluate(fmt.Sprintf(`{{ dependencyChecksum %q }}`, path)); err == nil {
+			t.Errorf("%s: the fallback didn't fail the evaluation in strict mode", path)
+		}
+	}
+}
+
+func dependencyChecksumOf(t *testing.T, dir string) string {
+	t.Helper()
+	return evaluateStrict(t, fmt.Sprintf(`{{ dependencyChecksum %q }}`, lockfileIn(t, dir)))
+}
+
+// evaluateStrict evaluates the template in strict mode, so falling back to hashing the whole file fails the test.
+func evaluateStrict(t *testing.T, template string) string {
+	t.Helper()
+	key, err := NewModel(env.NewRepository(), log.NewLogger()).WithStrict(true).Evaluate(template)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func lockfileIn(t *testing.T, dir string) string {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("%s must contain exactly one lockfile", dir)
+	}
+	return filepath.Join(dir, entries[0].Name())
+}
+
+// canonicalEntries returns the dependencies the checksum is computed of, one per line.
+func canonicalEntries(t *testing.T, path string) string {
+	t.Helper()
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := dependencyParserFor(path)(bytes.ReplaceAll(content, []byte("\r\n"), []byte("\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	slices.Sort(entries)
+	return strings.Join(slices.Compact(entries), "\n") + "\n"
+}
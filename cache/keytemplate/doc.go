@@ -0,0 +1,9 @@
+// Package keytemplate evaluates cache key templates.
+//
+// It is a fork of github.com/bitrise-io/go-steputils/v2/cache/keytemplate, extended with:
+//   - the branch inventory (the PR target branch and the default branch), which the branch-aware key chains are built from
+//   - glob exclusions and content normalization in checksum, and the checksumDir function
+//   - the dependencyChecksum function, hashing only the resolved dependencies of lockfiles
+//   - the stack and tool version inventory and the version function, detected only if a template references them
+//   - the strict mode and the explanation of the evaluation (Model.Explain)
+package keytemplate
@@ -0,0 +1,147 @@
+package keytemplate
+
+import (
+	"fmt"
+	"reflect"
+	"slices"
+	"sort"
+	"text/template/parse"
+)
+
+// Explanation describes how a key template was evaluated, so the keys of two builds can be compared.
+type Explanation struct {
+	Template string `json:"template"`
+	Key      string `json:"key"`
+	// Variables are the template variables referenced by the template, with their values
+	Variables map[string]string `json:"variables,omitempty"`
+	// Functions are the function calls of the template, in evaluation order
+	Functions []FunctionCall `json:"functions,omitempty"`
+	// Warnings are the problems that degraded the key, they fail the evaluation in strict mode
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+// FunctionCall is a template function call and its result.
+type FunctionCall struct {
+	Name   string   `json:"name"`
+	Args   []string `json:"args,omitempty"`
+	Result string   `json:"result"`
+	// Inputs are the files or directories hashed by a checksum function, with their own checksums
+	Inputs []InputChecksum `json:"inputs,omitempty"`
+}
+
+// InputChecksum is the checksum of a single file or directory hashed by a checksum function.
+type InputChecksum struct {
+	Path     string `json:"path"`
+	Checksum string `json:"checksum"`
+}
+
+// evaluation collects the function calls and the warnings of a single template evaluation.
+type evaluation struct {
+	functions []FunctionCall
+	warnings  []string
+}
+
+// warnf logs a warning about a problem that degrades the key, and records it for the explanation.
+// A warning repeated by the same evaluation (such as the same empty env var read twice) is only logged once.
+func (m Model) warnf(format string, args ...interface{}) {
+	warning := fmt.Sprintf(format, args...)
+	if m.recordWarning(warning) {
+		m.logger.Warnf("%s", warning)
+	}
+}
+
+// recordWarning records the warning for the explanation, it returns false if it was already recorded.
+func (m Model) recordWarning(warning string) bool {
+	if m.eval == nil {
+		return true
+	}
+	if slices.Contains(m.eval.warnings, warning) {
+		return false
+	}
+	m.eval.warnings = append(m.eval.warnings, warning)
+	return true
+}
+
+// explainedChecksum wraps a checksum function for the template, recording its calls.
+func (m Model) explainedChecksum(name string, fn func(args ...string) (string, []InputChecksum)) func(args ...string) string {
+	return func(args ...string) string {
+		result, inputs := fn(args...)
+		m.eval.functions = append(m.eval.functions, FunctionCall{Name: name, Args: args, Result: result, Inputs: inputs})
+		return result
+	}
+}
+
+// explainedFunc wraps a single argument function for the template, recording its calls.
+func (m Model) explainedFunc(name string, fn func(arg string) string) func(arg string) string {
+	return func(arg string) string {
+		result := fn(arg)
+		m.eval.functions = append(m.eval.functions, FunctionCall{Name: name, Args: []string{arg}, Result: result})
+		return result
+	}
+}
+
+// referencedVariables returns the values of the inventory fields and methods referenced by the template, and the
+// names of the empty fields. The values are read after the evaluation, so the lazily detected versions are not
+// detected (or warned about) again. The methods warn about their own empty values, so only fields are returned as empty.
+func referencedVariables(root *parse.ListNode, inventory templateInventory) (map[string]string, []string) {
+	// Everything worth a warning was recorded by the evaluation
+	inventory.model.eval = nil
+	variables := map[string]string{}
+	emptyFields := map[string]bool{}
+	value := reflect.ValueOf(inventory)
+	var walk func(node parse.Node)
+	walk = func(node parse.Node) {
+		switch node := node.(type) {
+		case *parse.ListNode:
+			if node == nil {
+				return
+			}
+			for _, child := range node.Nodes {
+				walk(child)
+			}
+		case *parse.ActionNode:
+			walk(node.Pipe)
+		case *parse.PipeNode:
+			if node == nil {
+				return
+			}
+			for _, cmd := range node.Cmds {
+				walk(cmd)
+			}
+		case *parse.CommandNode:
+			for _, arg := range node.Args {
+				walk(arg)
+			}
+		case *parse.IfNode:
+			walkBranch(walk, node.BranchNode)
+		case *parse.RangeNode:
+			walkBranch(walk, node.BranchNode)
+		case *parse.WithNode:
+			walkBranch(walk, node.BranchNode)
+		case *parse.FieldNode:
+			name := node.Ident[0]
+			if field := value.FieldByName(name); field.IsValid() && field.Kind() == reflect.String {
+				variables[name] = field.String()
+				if field.String() == "" {
+					emptyFields[name] = true
+				}
+			} else if method := value.MethodByName(name); method.IsValid() && method.Type().NumIn() == 0 {
+				variables[name] = method.Call(nil)[0].String()
+			}
+		}
+	}
+	walk(root)
+
+	var emptyNames []string
+	for name := range emptyFields {
+		emptyNames = append(emptyNames, name)
+	}
+	sort.Strings(emptyNames)
+	return variables, emptyNames
+}
+
+func walkBranch(walk func(node parse.Node), node parse.BranchNode) {
+	walk(node.Pipe)
+	walk(node.List)
+	walk(node.ElseList)
+}
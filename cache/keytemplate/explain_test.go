@@ -0,0 +1,119 @@
+package keytemplate
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/bitrise-io/go-utils/v2/env"
+	"github.com/bitrise-io/go-utils/v2/log"
+)
+
+// TestExplainWarnsOncePerVariable references the same empty variables several times, each of them is warned about once.
+func TestExplainWarnsOncePerVariable(t *testing.T) {
+	t.Setenv("EMPTY_VAR", "")
+	t.Setenv("BITRISE_TRIGGERED_WORKFLOW_ID", "")
+	const tool = "restore-cache-missing-tool"
+	key := `{{ getenv "EMPTY_VAR" }}-{{ getenv "EMPTY_VAR" }}-{{ .Workflow }}-{{ .Workflow }}-` +
+		`{{ version "` + tool + `" }}-{{ version "` + tool + `" }}`
+
+	model := NewModel(env.NewRepository(), log.NewLogger())
+	explanation, err := model.Explain(key)
+	if err != nil {
+		t.Fatalf("Explain() error = %s", err)
+	}
+
+	wantWarnings := []string{
+		"Environment variable EMPTY_VAR is empty",
+		"The version of " + tool + " is unknown",
+		"Template variable .Workflow is empty",
+	}
+	if !reflect.DeepEqual(explanation.Warnings, wantWarnings) {
+		t.Errorf("warnings = %q, want %q", explanation.Warnings, wantWarnings)
+	}
+	if len(explanation.Functions) != 4 {
+		t.Errorf("function calls = %+v, want every call", explanation.Functions)
+	}
+
+	// The detected versions are shared by the keys, the next key is warned about the unknown version again
+	explanation, err = model.Explain(`{{ version "` + tool + `" }}`)
+	if err != nil {
+		t.Fatalf("Explain() error = %s", err)
+	}
+	if want := []string{"The version of " + tool + " is unknown"}; !reflect.DeepEqual(explanation.Warnings, want) {
+		t.Errorf("warnings = %q, want %q", explanation.Warnings, want)
+	}
+}
+
+func TestExplainStrictMode(t *testing.T) {
+	t.Setenv("EMPTY_VAR", "")
+	t.Setenv("LOCK_HASH", "abc")
+	dir := t.TempDir()
+
+	tests := []struct {
+		name    string
+		key     string
+		wantErr bool
+	}{
+		{name: "checksum without files", key: `npm-{{ checksum "` + filepath.Join(dir, "missing.lock") + `" }}`, wantErr: true},
+		{name: "empty env var", key: `npm-{{ getenv "EMPTY_VAR" }}`, wantErr: true},
+		{name: "complete key", key: `npm-{{ getenv "LOCK_HASH" }}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			model := NewModel(env.NewRepository(), log.NewLogger())
+			if _, err := model.Evaluate(tt.key); err != nil {
+				t.Fatalf("Evaluate() error = %s, a degraded key is only a warning without strict mode", err)
+			}
+			_, err := model.WithStrict(true).Evaluate(tt.key)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Evaluate() in strict mode error = %v, wantErr %t", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestExplainChecksumInputs(t *testing.T) {
+	t.Setenv("BITRISE_GIT_BRANCH", "main")
+	dir := t.TempDir()
+	for name, content := range map[string]string{"a.lock": "a", "b.lock": "b"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pattern := filepath.Join(dir, "*.lock")
+
+	explanation, err := NewModel(env.NewRepository(), log.NewLogger()).Explain(`npm-{{ .Branch }}-{{ checksum "` + pattern + `" }}`)
+	if err != nil {
+		t.Fatalf("Explain() error = %s", err)
+	}
+
+	if !reflect.DeepEqual(explanation.Variables, map[string]string{"Branch": "main"}) {
+		t.Errorf("variables = %v, want the referenced Branch", explanation.Variables)
+	}
+	if len(explanation.Functions) != 1 {
+		t.Fatalf("function calls = %+v, want the checksum call", explanation.Functions)
+	}
+	call := explanation.Functions[0]
+	if call.Name != "checksum" || !reflect.DeepEqual(call.Args, []string{pattern}) || explanation.Key != "npm-main-"+call.Result {
+		t.Errorf("checksum call = %+v, key = %s", call, explanation.Key)
+	}
+	wantInputs := []InputChecksum{
+		{Path: filepath.Join(dir, "a.lock"), Checksum: sha256Hex("a")},
+		{Path: filepath.Join(dir, "b.lock"), Checksum: sha256Hex("b")},
+	}
+	if !reflect.DeepEqual(call.Inputs, wantInputs) {
+		t.Errorf("checksum inputs = %+v, want %+v", call.Inputs, wantInputs)
+	}
+	if len(explanation.Warnings) != 0 {
+		t.Errorf("warnings = %q, want none", explanation.Warnings)
+	}
+}
+
+func sha256Hex(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,204 @@
+package keytemplate
+
+import (
+	"bytes"
+	"fmt"
+	"runtime"
+	"strings"
+	"text/template"
+
+	"github.com/bitrise-io/go-utils/v2/command"
+	"github.com/bitrise-io/go-utils/v2/env"
+	"github.com/bitrise-io/go-utils/v2/log"
+)
+
+// Model ...
+type Model struct {
+	envRepo    env.Repository
+	logger     log.Logger
+	cmdFactory command.Factory
+	os         string
+	arch       string
+	// versions caches the detected tool versions by tool name, it's shared by the copies of the model
+	versions map[string]string
+	// branch overrides the current branch (BITRISE_GIT_BRANCH) if not empty
+	branch        string
+	defaultBranch string
+	// strict fails the evaluation if the key is degraded, such as by a checksum without files
+	strict bool
+	// eval collects the explanation of the ongoing evaluation
+	eval *evaluation
+}
+
+type templateInventory struct {
+	OS         string
+	Arch       string
+	Workflow   string
+	Branch     string
+	CommitHash string
+	// TargetBranch is the target branch of the pull request, empty if the build is not a PR build
+	TargetBranch string
+	// DefaultBranch is the default branch of the repository, if it was provided
+	DefaultBranch string
+	// StackID is the ID of the Bitrise stack the build runs on
+	StackID string
+
+	// model detects the tool versions, only when the template references them
+	model Model
+}
+
+// OSVersion is the macOS version, or the version of the Linux distribution.
+func (i templateInventory) OSVersion() string { return i.model.osVersion() }
+
+// XcodeVersion is the version of the selected Xcode.
+func (i templateInventory) XcodeVersion() string { return i.model.version("xcode") }
+
+// JavaVersion is the version of the selected JDK.
+func (i templateInventory) JavaVersion() string { return i.model.version("java") }
+
+// NodeVersion is the version of the Node.js in PATH.
+func (i templateInventory) NodeVersion() string { return i.model.version("node") }
+
+// RubyVersion is the version of the Ruby in PATH.
+func (i templateInventory) RubyVersion() string { return i.model.version("ruby") }
+
+// NewModel ...
+func NewModel(envRepo env.Repository, logger log.Logger) Model {
+	return Model{
+		envRepo:    envRepo,
+		logger:     logger,
+		cmdFactory: command.NewFactory(envRepo),
+		os:         runtime.GOOS,
+		arch:       runtime.GOARCH,
+		versions:   map[string]string{},
+	}
+}
+
+// WithStrict returns a copy of the model, which fails the evaluation instead of logging a warning
+// if the key is degraded: a function fails or has no input (such as a checksum without matching files),
+// or a referenced template variable is empty.
+func (m Model) WithStrict(strict bool) Model {
+	m.strict = strict
+	return m
+}
+
+// WithCommandFactory returns a copy of the model, which detects the tool versions with cmdFactory.
+func (m Model) WithCommandFactory(cmdFactory command.Factory) Model {
+	m.cmdFactory = cmdFactory
+	return m
+}
+
+// WithDefaultBranch returns a copy of the model, which evaluates .DefaultBranch to branch.
+func (m Model) WithDefaultBranch(branch string) Model {
+	m.defaultBranch = branch
+	return m
+}
+
+// WithBranch returns a copy of the model, which evaluates .Branch to branch instead of the current branch.
+func (m Model) WithBranch(branch string) Model {
+	m.branch = branch
+	return m
+}
+
+// Branches returns the current branch, the PR target branch and the default branch. The ones not known are empty.
+func (m Model) Branches() (string, string, string) {
+	return m.currentBranch(), m.envRepo.Get("BITRISEIO_GIT_BRANCH_DEST"), m.defaultBranch
+}
+
+// Evaluate returns the final string from a key template
+func (m Model) Evaluate(key string) (string, error) {
+	explanation, err := m.Explain(key)
+	if err != nil {
+		return "", err
+	}
+	return explanation.Key, nil
+}
+
+// Explain evaluates a key template, and returns the key together with the variables, the function calls
+// and the warnings of the evaluation. The explanation is returned even if the evaluation fails in strict mode.
+func (m Model) Explain(key string) (Explanation, error) {
+	m.eval = &evaluation{}
+	explanation := Explanation{Template: key}
+
+	funcMap := template.FuncMap{
+		"getenv":             m.explainedFunc("getenv", m.getEnvVar),
+		"checksum":           m.explainedChecksum("checksum", m.checksum),
+		"checksumDir":        m.explainedChecksum("checksumDir", m.checksumDir),
+		"dependencyChecksum": m.explainedChecksum("dependencyChecksum", m.dependencyChecksum),
+		"version":            m.explainedFunc("version", m.version),
+	}
+
+	tmpl, err := template.New("").Funcs(funcMap).Parse(key)
+	if err != nil {
+		return explanation, fmt.Errorf("invalid template: %w", err)
+	}
+
+	workflow := m.envRepo.Get("BITRISE_TRIGGERED_WORKFLOW_ID")
+	branch, targetBranch, defaultBranch := m.Branches()
+	var commitHash = m.envRepo.Get("BITRISE_GIT_COMMIT")
+	if commitHash == "" {
+		commitHash = m.envRepo.Get("GIT_CLONE_COMMIT_HASH")
+		m.logger.Infof("Build trigger doesn't have an explicit git commit hash, using the Git Clone Step's output for the .CommitHash template variable (value: %s)", commitHash)
+	}
+
+	inventory := templateInventory{
+		OS:         m.os,
+		Arch:       m.arch,
+		Workflow:   workflow,
+		Branch:     branch,
+		CommitHash: commitHash,
+
+		TargetBranch:  targetBranch,
+		DefaultBranch: defaultBranch,
+		StackID:       m.envRepo.Get("BITRISE_STACK_ID"),
+
+		model: m,
+	}
+	m.validateInventory(inventory)
+
+	resultBuffer := bytes.Buffer{}
+	if err := tmpl.Execute(&resultBuffer, inventory); err != nil {
+		return explanation, err
+	}
+
+	explanation.Key = resultBuffer.String()
+	variables, emptyFields := referencedVariables(tmpl.Tree.Root, inventory)
+	explanation.Variables = variables
+	for _, name := range emptyFields {
+		m.recordWarning(fmt.Sprintf("Template variable .%s is empty", name))
+	}
+	explanation.Functions = m.eval.functions
+	explanation.Warnings = m.eval.warnings
+
+	if m.strict && len(explanation.Warnings) > 0 {
+		return explanation, fmt.Errorf("key is degraded (strict mode): %s", strings.Join(explanation.Warnings, "; "))
+	}
+	return explanation, nil
+}
+
+func (m Model) currentBranch() string {
+	if m.branch != "" {
+		return m.branch
+	}
+	return m.envRepo.Get("BITRISE_GIT_BRANCH")
+}
+
+func (m Model) getEnvVar(key string) string {
+	value := m.envRepo.Get(key)
+	if value == "" {
+		m.warnf("Environment variable %s is empty", key)
+	}
+	return value
+}
+
+func (m Model) validateInventory(inventory templateInventory) {
+	m.warnIfEmpty("Workflow", inventory.Workflow)
+	m.warnIfEmpty("Branch", inventory.Branch)
+	m.warnIfEmpty("CommitHash", inventory.CommitHash)
+}
+
+func (m Model) warnIfEmpty(name, value string) {
+	if value == "" {
+		m.logger.Debugf("Template variable .%s is not defined", name)
+	}
+}
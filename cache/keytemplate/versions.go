@@ -0,0 +1,111 @@
+package keytemplate
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// osReleasePath is the file the Linux distribution version is read from.
+const osReleasePath = "/etc/os-release"
+
+// versionRegexp matches the first dotted version number in the output of a version command,
+// such as `17.0.8` of `openjdk version "17.0.8" 2023-07-18`.
+var versionRegexp = regexp.MustCompile(`\d+(\.\d+)+`)
+
+// versionCommand is the command printing the version of a tool.
+type versionCommand struct {
+	name string
+	args []string
+}
+
+// versionCommands are the commands of the tools not supporting `--version`, or with a different executable name.
+// Other tools are queried with `<tool> --version`.
+var versionCommands = map[string]versionCommand{
+	"xcode":  {name: "xcodebuild", args: []string{"-version"}},
+	"java":   {name: "java", args: []string{"-version"}},
+	"go":     {name: "go", args: []string{"version"}},
+	"python": {name: "python3", args: []string{"--version"}},
+}
+
+// version returns the version of a tool installed on the stack (such as `node`, `ruby`, `java` or `xcode`),
+// detected by running its version command. The result is cached, so each tool is only queried once.
+// Errors are logged as warnings and an empty string is returned in that case.
+func (m Model) version(tool string) string {
+	version, ok := m.versions[tool]
+	if !ok {
+		cmd, ok := versionCommands[tool]
+		if !ok {
+			cmd = versionCommand{name: tool, args: []string{"--version"}}
+		}
+		version = m.detectVersion(cmd)
+		m.versions[tool] = version
+	}
+	if version == "" {
+		m.recordWarning(fmt.Sprintf("The version of %s is unknown", tool))
+	}
+	return version
+}
+
+// detectVersion runs the version command. Failures are only logged, the caller records a single warning for the
+// explanation, no matter how many times the version is referenced.
+func (m Model) detectVersion(cmd versionCommand) string {
+	// Some tools (such as java) print their version to stderr
+	output, err := m.cmdFactory.Create(cmd.name, cmd.args, nil).RunAndReturnTrimmedCombinedOutput()
+	if err != nil {
+		m.logger.Warnf("Failed to detect the version of %s: %s", cmd.name, err)
+		return ""
+	}
+
+	version := versionRegexp.FindString(output)
+	if version == "" {
+		m.logger.Warnf("No version number in the output of %s: %s", cmd.name, output)
+		return ""
+	}
+	m.logger.Debugf("Detected %s version: %s", cmd.name, version)
+	return version
+}
+
+// osVersion returns the macOS version, or the version of the Linux distribution (VERSION_ID of /etc/os-release).
+func (m Model) osVersion() string {
+	version, ok := m.versions["os"]
+	if !ok {
+		switch m.os {
+		case "darwin":
+			version = m.detectVersion(versionCommand{name: "sw_vers", args: []string{"-productVersion"}})
+		case "linux":
+			version = m.linuxVersion()
+		default:
+			m.logger.Warnf("OS version detection is not supported on %s", m.os)
+		}
+		m.versions["os"] = version
+	}
+	if version == "" {
+		m.recordWarning("The OS version is unknown")
+	}
+	return version
+}
+
+func (m Model) linuxVersion() string {
+	file, err := os.Open(osReleasePath)
+	if err != nil {
+		m.logger.Warnf("Failed to detect the OS version: %s", err)
+		return ""
+	}
+	defer file.Close() //nolint:errcheck
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if value, found := strings.CutPrefix(scanner.Text(), "VERSION_ID="); found {
+			return strings.Trim(value, `"'`)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		m.logger.Warnf("Failed to detect the OS version: %s", err)
+		return ""
+	}
+	m.logger.Warnf("No VERSION_ID in %s", osReleasePath)
+	return ""
+}
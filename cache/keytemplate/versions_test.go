@@ -0,0 +1,100 @@
+package keytemplate
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/bitrise-io/go-utils/v2/env"
+	"github.com/bitrise-io/go-utils/v2/log"
+)
+
+// fakeTools puts version command stubs on the PATH, and returns the number of times each of them was run so far.
+// tools maps the executable names to the output of their version command.
+func fakeTools(t *testing.T, tools map[string]string) func(name string) int {
+	t.Helper()
+	dir := t.TempDir()
+	callsDir := t.TempDir()
+	for name, output := range tools {
+		script := "#!/bin/sh\necho called >> " + filepath.Join(callsDir, name) + "\nprintf '%s\\n' '" + output + "' >&2\n"
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(script), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Only the stubs are on the PATH, so the tools of the machine running the tests are not detected
+	t.Setenv("PATH", dir)
+	return func(name string) int {
+		content, err := os.ReadFile(filepath.Join(callsDir, name))
+		if err != nil {
+			return 0
+		}
+		return strings.Count(string(content), "called")
+	}
+}
+
+func TestVersionVariables(t *testing.T) {
+	fakeTools(t, map[string]string{
+		"xcodebuild": "Xcode 15.2\nBuild version 15C500b",
+		"java":       `openjdk version "17.0.8" 2023-07-18`,
+		"node":       "v20.11.1",
+		"ruby":       "ruby 3.2.2 (2023-03-30 revision e51014f9c0) [arm64-darwin22]",
+		"go":         "go version go1.22.1 linux/amd64",
+		"python3":    "Python 3.12.2",
+		"flutter":    "Flutter 3.19.3 • channel stable",
+		"bazel":      "no version here",
+	})
+	t.Setenv("BITRISE_STACK_ID", "osx-xcode-15.2.x")
+
+	tests := []struct {
+		key  string
+		want string
+	}{
+		{key: "{{ .XcodeVersion }}", want: "15.2"},
+		{key: "{{ .JavaVersion }}", want: "17.0.8"},
+		{key: "{{ .NodeVersion }}", want: "20.11.1"},
+		{key: "{{ .RubyVersion }}", want: "3.2.2"},
+		{key: "{{ .StackID }}", want: "osx-xcode-15.2.x"},
+		{key: `{{ version "go" }}`, want: "1.22.1"},
+		{key: `{{ version "python" }}`, want: "3.12.2"},
+		{key: `{{ version "flutter" }}`, want: "3.19.3"},
+		{key: `{{ version "bazel" }}`, want: ""},
+		{key: `{{ version "missing" }}`, want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.key, func(t *testing.T) {
+			got, err := NewModel(env.NewRepository(), log.NewLogger()).Evaluate(tt.key)
+			if err != nil {
+				t.Fatalf("Evaluate() error = %s", err)
+			}
+			if got != tt.want {
+				t.Errorf("Evaluate() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestVersionsAreDetectedLazily(t *testing.T) {
+	calls := fakeTools(t, map[string]string{"node": "v20.11.1", "ruby": "ruby 3.2.2"})
+	model := NewModel(env.NewRepository(), log.NewLogger())
+
+	if _, err := model.Evaluate("npm-{{ .OS }}-{{ .Arch }}"); err != nil {
+		t.Fatal(err)
+	}
+	if calls("node") != 0 || calls("ruby") != 0 {
+		t.Errorf("versions were detected without being referenced")
+	}
+
+	for _, key := range []string{"npm-{{ .NodeVersion }}", `npm-{{ version "node" }}-{{ .NodeVersion }}`} {
+		got, err := model.Evaluate(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != "npm-20.11.1" && got != "npm-20.11.1-20.11.1" {
+			t.Errorf("Evaluate(%s) = %s", key, got)
+		}
+	}
+	if calls("node") != 1 || calls("ruby") != 0 {
+		t.Errorf("node was detected %d times, ruby %d times, want 1 and 0", calls("node"), calls("ruby"))
+	}
+}
@@ -0,0 +1,85 @@
+package cache
+
+import (
+	"github.com/bitrise-io/go-utils/v2/log"
+)
+
+// prefixLogger prepends a prefix to every log line, so the output of concurrent restores can be told apart.
+type prefixLogger struct {
+	logger log.Logger
+	prefix string
+}
+
+func newPrefixLogger(logger log.Logger, prefix string) log.Logger {
+	return prefixLogger{logger: logger, prefix: prefix}
+}
+
+// Infof ...
+func (l prefixLogger) Infof(format string, v ...interface{}) {
+	l.logger.Infof(l.prefix+format, v...)
+}
+
+// Warnf ...
+func (l prefixLogger) Warnf(format string, v ...interface{}) {
+	l.logger.Warnf(l.prefix+format, v...)
+}
+
+// Printf ...
+func (l prefixLogger) Printf(format string, v ...interface{}) {
+	l.logger.Printf(l.prefix+format, v...)
+}
+
+// Donef ...
+func (l prefixLogger) Donef(format string, v ...interface{}) {
+	l.logger.Donef(l.prefix+format, v...)
+}
+
+// Debugf ...
+func (l prefixLogger) Debugf(format string, v ...interface{}) {
+	l.logger.Debugf(l.prefix+format, v...)
+}
+
+// Errorf ...
+func (l prefixLogger) Errorf(format string, v ...interface{}) {
+	l.logger.Errorf(l.prefix+format, v...)
+}
+
+// TInfof ...
+func (l prefixLogger) TInfof(format string, v ...interface{}) {
+	l.logger.TInfof(l.prefix+format, v...)
+}
+
+// TWarnf ...
+func (l prefixLogger) TWarnf(format string, v ...interface{}) {
+	l.logger.TWarnf(l.prefix+format, v...)
+}
+
+// TPrintf ...
+func (l prefixLogger) TPrintf(format string, v ...interface{}) {
+	l.logger.TPrintf(l.prefix+format, v...)
+}
+
+// TDonef ...
+func (l prefixLogger) TDonef(format string, v ...interface{}) {
+	l.logger.TDonef(l.prefix+format, v...)
+}
+
+// TDebugf ...
+func (l prefixLogger) TDebugf(format string, v ...interface{}) {
+	l.logger.TDebugf(l.prefix+format, v...)
+}
+
+// TErrorf ...
+func (l prefixLogger) TErrorf(format string, v ...interface{}) {
+	l.logger.TErrorf(l.prefix+format, v...)
+}
+
+// Println ...
+func (l prefixLogger) Println() {
+	l.logger.Println()
+}
+
+// EnableDebugLog ...
+func (l prefixLogger) EnableDebugLog(enable bool) {
+	l.logger.EnableDebugLog(enable)
+}
@@ -0,0 +1,54 @@
+package cache
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/bitrise-steplib/bitrise-step-restore-cache/cache/network"
+)
+
+const matchStrategyEnvVar = "BITRISE_CACHE_MATCH_STRATEGY"
+
+// Values of BITRISE_CACHE_MATCH_STRATEGY besides the match modes, it's empty if there was no match.
+const (
+	// matchStrategyExact means the archive was saved with the same key as the one that matched
+	matchStrategyExact = "exact"
+)
+
+// parseKeyMatchMode splits the optional match mode prefix off a key, such as `[exact] npm-{{ .Branch }}`.
+func parseKeyMatchMode(key string) (network.MatchMode, string, error) {
+	key = strings.TrimSpace(key)
+	if !strings.HasPrefix(key, "[") {
+		return network.MatchPrefix, key, nil
+	}
+	rawMode, rest, found := strings.Cut(strings.TrimPrefix(key, "["), "]")
+	if !found {
+		return "", "", fmt.Errorf("missing closing bracket of the match mode in key: %s", key)
+	}
+	mode, err := network.ParseMatchMode(strings.TrimSpace(rawMode))
+	if err != nil {
+		return "", "", fmt.Errorf("%w in key: %s", err, key)
+	}
+	return mode, strings.TrimSpace(rest), nil
+}
+
+// matchStrategy tells how the archive of matchedKey was found: `exact` if it was saved with the key that matched
+// (other than by a default-branch key), otherwise the match mode of the key. Empty if there was no match.
+func matchStrategy(matchedKey string, evaluatedKeys []string, matchModes []network.MatchMode) string {
+	if matchedKey == "" {
+		return ""
+	}
+	i := network.MatchingKeyIndex(matchedKey, evaluatedKeys, matchModes)
+	if i == -1 {
+		return ""
+	}
+
+	mode := network.MatchPrefix
+	if i < len(matchModes) {
+		mode = matchModes[i]
+	}
+	if mode != network.MatchDefaultBranch && matchedKey == evaluatedKeys[i] {
+		return matchStrategyExact
+	}
+	return string(mode)
+}
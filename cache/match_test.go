@@ -0,0 +1,61 @@
+package cache
+
+import (
+	"testing"
+
+	"github.com/bitrise-steplib/bitrise-step-restore-cache/cache/network"
+)
+
+func TestParseKeyMatchMode(t *testing.T) {
+	tests := []struct {
+		key      string
+		wantMode network.MatchMode
+		wantKey  string
+		wantErr  bool
+	}{
+		{key: "npm-{{ .Branch }}", wantMode: network.MatchPrefix, wantKey: "npm-{{ .Branch }}"},
+		{key: "[exact] npm-{{ .Branch }}", wantMode: network.MatchExact, wantKey: "npm-{{ .Branch }}"},
+		{key: " [ default-branch ]npm-", wantMode: network.MatchDefaultBranch, wantKey: "npm-"},
+		{key: "[prefix] npm-", wantMode: network.MatchPrefix, wantKey: "npm-"},
+		{key: "[] npm-", wantMode: network.MatchPrefix, wantKey: "npm-"},
+		{key: "[newest] npm-", wantErr: true},
+		{key: "[exact npm-", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.key, func(t *testing.T) {
+			mode, key, err := parseKeyMatchMode(tt.key)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseKeyMatchMode() error = %v, wantErr %t", err, tt.wantErr)
+			}
+			if mode != tt.wantMode || key != tt.wantKey {
+				t.Errorf("parseKeyMatchMode() = %q, %q, want %q, %q", mode, key, tt.wantMode, tt.wantKey)
+			}
+		})
+	}
+}
+
+func TestMatchStrategy(t *testing.T) {
+	keys := []string{"npm-main-abc", "npm-main-", "npm-"}
+	modes := []network.MatchMode{network.MatchExact, network.MatchPrefix, network.MatchDefaultBranch}
+	tests := []struct {
+		name       string
+		matchedKey string
+		want       string
+	}{
+		{name: "exact key", matchedKey: "npm-main-abc", want: matchStrategyExact},
+		{name: "same key as a prefix key", matchedKey: "npm-main-", want: matchStrategyExact},
+		{name: "prefix key", matchedKey: "npm-main-def", want: string(network.MatchPrefix)},
+		{name: "default branch key", matchedKey: "npm-develop-abc", want: string(network.MatchDefaultBranch)},
+		// The archive of a default branch build can have the same key, it's still found by its branch
+		{name: "same key as a default branch key", matchedKey: "npm-", want: string(network.MatchDefaultBranch)},
+		{name: "no match", matchedKey: "", want: ""},
+		{name: "unknown key", matchedKey: "gradle-abc", want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := matchStrategy(tt.matchedKey, keys, modes); got != tt.want {
+				t.Errorf("matchStrategy() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,157 @@
+package network
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/bitrise-io/go-utils/v2/log"
+	"github.com/hashicorp/go-retryablehttp"
+)
+
+// MaxKeyLength is the maximum length of a cache key in bytes, longer keys are shortened by ShortenKey.
+const MaxKeyLength = 512
+
+// MaxKeyCount is the maximum number of keys of a restore.
+const MaxKeyCount = 8
+
+type restoreResponse struct {
+	URL        string `json:"url"`
+	MatchedKey string `json:"matched_cache_key"`
+	// ArchiveChecksum, ArchiveSize and UncompressedSize are recorded at upload time, they are empty for archives saved by older clients
+	ArchiveChecksum  string `json:"archive_checksum,omitempty"`
+	ArchiveSize      int64  `json:"archive_size_in_bytes,omitempty"`
+	UncompressedSize int64  `json:"uncompressed_size_in_bytes,omitempty"`
+	// MatchMode is the match mode the API applied, only returned by API versions supporting match modes
+	MatchMode string `json:"match_mode,omitempty"`
+}
+
+type apiClient struct {
+	httpClient  *retryablehttp.Client
+	baseURL     string
+	accessToken string
+	logger      log.Logger
+}
+
+func newAPIClient(client *retryablehttp.Client, baseURL string, accessToken string, logger log.Logger) apiClient {
+	return apiClient{
+		httpClient:  client,
+		baseURL:     baseURL,
+		accessToken: accessToken,
+		logger:      logger,
+	}
+}
+
+// restore finds the archive of the first key with a match. The cache API matches every key by prefix, so with other
+// match modes the keys are looked up one by one, and the matched key is checked against the key's match mode,
+// the same way as with the other storage backends.
+func (c apiClient) restore(ctx context.Context, cacheKeys []string, matchModes []MatchMode) (restoreResponse, error) {
+	if _, err := validateKeys(cacheKeys); err != nil {
+		return restoreResponse{}, err
+	}
+	if !hasNonDefaultMatchMode(matchModes) {
+		return c.restoreMatching(ctx, cacheKeys, MatchPrefix)
+	}
+
+	for i, key := range cacheKeys {
+		response, err := c.restoreMatching(ctx, []string{key}, matchMode(matchModes, i))
+		if errors.Is(err, ErrCacheNotFound) {
+			continue
+		}
+		return response, err
+	}
+	return restoreResponse{}, ErrCacheNotFound
+}
+
+// restoreMatching calls the restore endpoint with keys sharing the same match mode. MatchDefaultBranch is sent as
+// the `match_modes` query parameter, and the API confirms it in the `match_mode` field of the response. Older API
+// versions ignore the parameter and match by prefix, so their matches are not used.
+func (c apiClient) restoreMatching(ctx context.Context, cacheKeys []string, mode MatchMode) (restoreResponse, error) {
+	keysInQuery, err := validateKeys(cacheKeys)
+	if err != nil {
+		return restoreResponse{}, err
+	}
+	apiURL := fmt.Sprintf("%s/restore?cache_keys=%s", c.baseURL, keysInQuery)
+	if mode == MatchDefaultBranch {
+		apiURL += "&match_modes=" + url.QueryEscape(string(mode))
+	}
+
+	req, err := retryablehttp.NewRequestWithContext(ctx, http.MethodGet, apiURL, nil)
+	if err != nil {
+		return restoreResponse{}, err
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", c.accessToken))
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return restoreResponse{}, err
+	}
+	defer func(body io.ReadCloser) {
+		err := body.Close()
+		if err != nil {
+			c.logger.Printf(err.Error())
+		}
+	}(resp.Body)
+
+	if resp.StatusCode == http.StatusNotFound {
+		return restoreResponse{}, ErrCacheNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		return restoreResponse{}, unwrapError(resp)
+	}
+
+	var response restoreResponse
+	err = json.NewDecoder(resp.Body).Decode(&response)
+	if err != nil {
+		return restoreResponse{}, err
+	}
+	if mode == MatchDefaultBranch && MatchMode(response.MatchMode) != MatchDefaultBranch {
+		c.logger.Warnf("The cache API doesn't support the %s match mode, ignoring the match of key %s", MatchDefaultBranch, cacheKeys[0])
+		return restoreResponse{}, ErrCacheNotFound
+	}
+	modes := make([]MatchMode, len(cacheKeys))
+	for i := range modes {
+		modes[i] = mode
+	}
+	if MatchingKeyIndex(response.MatchedKey, shortenKeys(cacheKeys), modes) == -1 {
+		// Exact keys must never restore a different archive
+		c.logger.Debugf("Matched key %s doesn't match the keys with their match modes, ignoring it", response.MatchedKey)
+		return restoreResponse{}, ErrCacheNotFound
+	}
+
+	return response, nil
+}
+
+func unwrapError(resp *http.Response) error {
+	errorResp, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	return fmt.Errorf("HTTP %d: %s", resp.StatusCode, errorResp)
+}
+
+func validateKeys(keys []string) (string, error) {
+	if len(keys) > MaxKeyCount {
+		return "", fmt.Errorf("maximum number of keys is %d, %d provided", MaxKeyCount, len(keys))
+	}
+	for _, key := range keys {
+		if strings.Contains(key, ",") {
+			return "", fmt.Errorf("commas are not allowed in keys (invalid key: %s)", key)
+		}
+	}
+
+	return url.QueryEscape(strings.Join(shortenKeys(keys), ",")), nil
+}
+
+func shortenKeys(keys []string) []string {
+	shortenedKeys := make([]string, 0, len(keys))
+	for _, key := range keys {
+		shortenedKeys = append(shortenedKeys, ShortenKey(key))
+	}
+	return shortenedKeys
+}
@@ -0,0 +1,125 @@
+package network
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/bitrise-io/go-utils/v2/log"
+	"github.com/bitrise-io/go-utils/v2/retryhttp"
+)
+
+// fakeCacheAPI matches every key by prefix like the cache API does. savedKeys are ordered from the newest.
+type fakeCacheAPI struct {
+	savedKeys []string
+	// defaultBranchKeys are the saved keys of default branch builds, only used if supportsMatchModes is set
+	defaultBranchKeys  []string
+	supportsMatchModes bool
+	requests           []string
+}
+
+func (a *fakeCacheAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	a.requests = append(a.requests, r.URL.RawQuery)
+	query := r.URL.Query()
+
+	savedKeys, matchMode := a.savedKeys, ""
+	if a.supportsMatchModes && query.Get("match_modes") == string(MatchDefaultBranch) {
+		savedKeys, matchMode = a.defaultBranchKeys, string(MatchDefaultBranch)
+	}
+	for _, key := range strings.Split(query.Get("cache_keys"), ",") {
+		for _, saved := range savedKeys {
+			if saved == key {
+				writeRestoreResponse(w, saved, matchMode)
+				return
+			}
+		}
+		for _, saved := range savedKeys {
+			if strings.HasPrefix(saved, key) {
+				writeRestoreResponse(w, saved, matchMode)
+				return
+			}
+		}
+	}
+	w.WriteHeader(http.StatusNotFound)
+}
+
+func writeRestoreResponse(w http.ResponseWriter, matchedKey, matchMode string) {
+	json.NewEncoder(w).Encode(restoreResponse{URL: "https://storage.example.com/" + matchedKey, MatchedKey: matchedKey, MatchMode: matchMode}) //nolint:errcheck
+}
+
+func TestAPIClientRestoreMatchModes(t *testing.T) {
+	tests := []struct {
+		name               string
+		keys               []string
+		modes              []MatchMode
+		supportsMatchModes bool
+		wantMatchedKey     string
+		wantRequests       []string
+	}{
+		{
+			name:           "prefix keys are sent in one request",
+			keys:           []string{"npm-feature-", "npm-"},
+			wantMatchedKey: "npm-main-abc",
+			wantRequests:   []string{"cache_keys=npm-feature-%2Cnpm-"},
+		},
+		{
+			name:           "exact key ignores the prefix match of the API",
+			keys:           []string{"npm-main", "npm-"},
+			modes:          []MatchMode{MatchExact, MatchPrefix},
+			wantMatchedKey: "npm-main-abc",
+			wantRequests:   []string{"cache_keys=npm-main", "cache_keys=npm-"},
+		},
+		{
+			name:           "exact key",
+			keys:           []string{"npm-main-abc", "npm-"},
+			modes:          []MatchMode{MatchExact},
+			wantMatchedKey: "npm-main-abc",
+			wantRequests:   []string{"cache_keys=npm-main-abc"},
+		},
+		{
+			name:               "default branch key",
+			keys:               []string{"npm-"},
+			modes:              []MatchMode{MatchDefaultBranch},
+			supportsMatchModes: true,
+			wantMatchedKey:     "npm-default-abc",
+			wantRequests:       []string{"cache_keys=npm-&match_modes=default-branch"},
+		},
+		{
+			name:         "default branch key with an API not supporting match modes",
+			keys:         []string{"npm-"},
+			modes:        []MatchMode{MatchDefaultBranch},
+			wantRequests: []string{"cache_keys=npm-&match_modes=default-branch"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api := &fakeCacheAPI{
+				savedKeys:          []string{"npm-main-abc", "npm-default-abc"},
+				defaultBranchKeys:  []string{"npm-default-abc"},
+				supportsMatchModes: tt.supportsMatchModes,
+			}
+			server := httptest.NewServer(api)
+			defer server.Close()
+
+			client := newAPIClient(retryhttp.NewClient(log.NewLogger()), server.URL, "token", log.NewLogger())
+			response, err := client.restore(context.Background(), tt.keys, tt.modes)
+			if tt.wantMatchedKey == "" {
+				if !errors.Is(err, ErrCacheNotFound) {
+					t.Errorf("restore() error = %v, want ErrCacheNotFound", err)
+				}
+			} else if err != nil {
+				t.Fatalf("restore() error = %s", err)
+			} else if response.MatchedKey != tt.wantMatchedKey {
+				t.Errorf("matched key = %s, want %s", response.MatchedKey, tt.wantMatchedKey)
+			}
+			if !reflect.DeepEqual(api.requests, tt.wantRequests) {
+				t.Errorf("requests = %q, want %q", api.requests, tt.wantRequests)
+			}
+		})
+	}
+}
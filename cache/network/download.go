@@ -0,0 +1,402 @@
+package network
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/bitrise-io/go-utils/retry"
+	"github.com/bitrise-io/go-utils/v2/log"
+	"github.com/bitrise-steplib/bitrise-step-restore-cache/cache/network/got"
+	"github.com/hashicorp/go-retryablehttp"
+)
+
+// DefaultDownloader ...
+type DefaultDownloader struct{}
+
+// DownloadParams ...
+type DownloadParams struct {
+	APIBaseURL string
+	Token      string
+	CacheKeys  []string
+	// MatchModes are the match modes of CacheKeys, by index. Keys without a match mode use MatchPrefix.
+	MatchModes     []MatchMode
+	DownloadPath   string
+	NumFullRetries int
+	// Tuning are the advanced network settings of the download
+	Tuning DownloadTuning
+	// Network configures the proxies and the TLS settings of every request
+	Network NetworkConfig
+	// LocalCacheDir is a directory on the local disk where downloaded archives are kept for later builds on the same host.
+	// Disabled if empty.
+	LocalCacheDir string
+	// LocalCacheMaxSize is the size budget of LocalCacheDir in bytes.
+	LocalCacheMaxSize int64
+	// Storage selects where the archives are restored from. APIBaseURL and Token are only used by the Bitrise backend.
+	Storage StorageConfig
+	// ProgressInterval is how often the download progress is logged. Disabled if zero.
+	ProgressInterval time.Duration
+	// LookupTimeout is the time budget of finding the archive, DownloadTimeout of downloading it.
+	// The download budget starts once the archive is first found. No limit (other than the context) if zero.
+	LookupTimeout   time.Duration
+	DownloadTimeout time.Duration
+	// DiscardPartialOnTimeout removes the partially downloaded archive if the download times out,
+	// instead of keeping it for a later attempt to resume.
+	DiscardPartialOnTimeout bool
+	// Preflight is called with the archive once it's found, before anything is downloaded. The archive size is
+	// looked up from the storage first if the lookup didn't provide it. An error returned by Preflight aborts
+	// the download (and the lookup) without retrying, and is returned as is.
+	Preflight func(ArchiveInfo) error
+}
+
+// ArchiveInfo describes the cache archive that matched one of the requested keys.
+type ArchiveInfo struct {
+	URL        string
+	MatchedKey string
+	// Checksum is the SHA-256 checksum (hex encoded) of the archive, if the cache API provided it
+	Checksum string
+	// Size is the size of the archive in bytes, if the cache API provided it
+	Size int64
+	// UncompressedSize is the total size of the archive content in bytes, if Save Cache recorded it
+	UncompressedSize int64
+	// FromLocalCache is true if the archive is (going to be) read from the local cache instead of the remote one
+	FromLocalCache bool
+}
+
+// ErrCacheNotFound ...
+var ErrCacheNotFound = errors.New("no cache archive found for the provided keys")
+
+// Download archive from the cache API based on the provided keys in params.
+// If there is no match for any of the keys, the error is ErrCacheNotFound.
+func (d DefaultDownloader) Download(ctx context.Context, params DownloadParams, logger log.Logger) (ArchiveInfo, error) {
+	retryableHTTPClient, err := newHTTPClient(params, logger)
+	if err != nil {
+		return ArchiveInfo{}, err
+	}
+
+	return downloadWithClient(ctx, retryableHTTPClient, params, logger)
+}
+
+// Lookup asks the cache API for the archive matching the provided keys without downloading it.
+// If there is no match for any of the keys, the error is ErrCacheNotFound.
+func (d DefaultDownloader) Lookup(ctx context.Context, params DownloadParams, logger log.Logger) (ArchiveInfo, error) {
+	retryableHTTPClient, err := newHTTPClient(params, logger)
+	if err != nil {
+		return ArchiveInfo{}, err
+	}
+
+	return lookupWithClient(ctx, retryableHTTPClient, params, logger)
+}
+
+// DownloadStream writes the archive found by Lookup into dest, in order, while the download is in progress.
+// Failed chunks are retried, but the whole download can't be restarted once data has been written to dest.
+// If the cache API provided the size and checksum of the archive, the end of the archive is only written
+// to dest once the whole archive is verified, so a corrupted archive never completes the extraction.
+func (d DefaultDownloader) DownloadStream(ctx context.Context, archive ArchiveInfo, params DownloadParams, dest io.Writer, logger log.Logger) error {
+	ctx, cancel := withTimeout(ctx, params.DownloadTimeout)
+	defer cancel()
+
+	if err := d.downloadStream(ctx, archive, params, dest, logger); err != nil {
+		return phaseError(ctx, ErrDownloadTimedOut, err)
+	}
+	return nil
+}
+
+func (d DefaultDownloader) downloadStream(ctx context.Context, archive ArchiveInfo, params DownloadParams, dest io.Writer, logger log.Logger) error {
+	retryableHTTPClient, err := newHTTPClient(params, logger)
+	if err != nil {
+		return err
+	}
+
+	store := openLocalStore(params, logger)
+	if store != nil && archive.FromLocalCache {
+		file, err := store.open(archive)
+		if err != nil {
+			logger.Warnf("Failed to read the local cache: %s", err)
+		}
+		if file != nil {
+			defer file.Close() //nolint:errcheck
+			logger.Printf("Reading archive from the local cache")
+			_, err := io.Copy(dest, file)
+			return err
+		}
+		logger.Warnf("Archive is no longer in the local cache or it's corrupted, downloading it")
+	}
+
+	if !HasDigest(archive) {
+		logger.Debugf("The cache API didn't provide the archive checksum, skipping integrity check")
+		return streamFile(ctx, retryableHTTPClient, archive, dest, params, logger)
+	}
+
+	verifier := newVerifyingWriter(dest, archive)
+	// A copy of the archive is written to the local cache next to the stream
+	var writer io.Writer = verifier
+	var storeFile *os.File
+	if store != nil && archive.Checksum != "" {
+		var err error
+		storeFile, err = store.createTemp()
+		if err != nil {
+			logger.Warnf("Failed to add archive to the local cache: %s", err)
+		} else {
+			defer os.Remove(storeFile.Name()) //nolint:errcheck
+			defer storeFile.Close()           //nolint:errcheck
+			writer = io.MultiWriter(storeFile, verifier)
+		}
+	}
+
+	if err := streamFile(ctx, retryableHTTPClient, archive, writer, params, logger); err != nil {
+		return err
+	}
+	if err := verifier.finish(); err != nil {
+		return err
+	}
+	logger.Printf("Archive integrity verified")
+
+	if storeFile != nil {
+		err := storeFile.Close()
+		if err == nil {
+			err = store.add(storeFile.Name(), archive)
+		}
+		if err != nil {
+			logger.Warnf("Failed to add archive to the local cache: %s", err)
+		}
+	}
+	return nil
+}
+
+// openLocalStore returns the local cache configured in params, or nil if it's disabled or unusable.
+func openLocalStore(params DownloadParams, logger log.Logger) *localStore {
+	if params.LocalCacheDir == "" {
+		return nil
+	}
+	store, err := newLocalStore(params.LocalCacheDir, params.LocalCacheMaxSize, logger)
+	if err != nil {
+		logger.Warnf("Local cache is disabled: %s", err)
+		return nil
+	}
+	return store
+}
+
+func validateParams(params DownloadParams) error {
+	if err := ValidateStorageConfig(params.Storage); err != nil {
+		return err
+	}
+
+	if params.Storage.backend() == StorageBitrise {
+		if params.APIBaseURL == "" {
+			return fmt.Errorf("API base URL is empty")
+		}
+
+		if params.Token == "" {
+			return fmt.Errorf("API token is empty")
+		}
+	}
+
+	if len(params.CacheKeys) == 0 {
+		return fmt.Errorf("cache key list is empty")
+	}
+
+	if len(params.MatchModes) > len(params.CacheKeys) {
+		return fmt.Errorf("%d match modes provided for %d keys", len(params.MatchModes), len(params.CacheKeys))
+	}
+	return ValidateMatchModes(params.MatchModes, params.Storage)
+}
+
+func lookupWithClient(ctx context.Context, httpClient *retryablehttp.Client, params DownloadParams, logger log.Logger) (ArchiveInfo, error) {
+	if err := validateParams(params); err != nil {
+		return ArchiveInfo{}, err
+	}
+
+	lookupCtx, cancel := withTimeout(ctx, params.LookupTimeout)
+	defer cancel()
+
+	var archive ArchiveInfo
+	err := retry.Times(uint(params.NumFullRetries)).Wait(5 * time.Second).TryWithAbort(func(attempt uint) (error, bool) {
+		if attempt != 0 {
+			logger.Debugf("Retrying cache lookup... (attempt %d)", attempt+1)
+		}
+
+		logger.Debugf("Fetching download URL...")
+		resolved, err := resolveArchive(lookupCtx, httpClient, params, logger)
+		if err != nil {
+			if errors.Is(err, ErrCacheNotFound) {
+				return err, true // Do not retry if cache key not found
+			}
+			if lookupCtx.Err() != nil {
+				return phaseError(lookupCtx, ErrLookupTimedOut, lookupCtx.Err()), true
+			}
+
+			logger.Debugf("Failed to get download URL: %s", err)
+			return fmt.Errorf("failed to get download URL: %w", err), false
+		}
+
+		archive = resolved
+		return nil, false
+	})
+	if err != nil {
+		return archive, err
+	}
+	if archive, err = preflight(lookupCtx, httpClient, archive, params, logger); err != nil {
+		return ArchiveInfo{}, err
+	}
+
+	if store := openLocalStore(params, logger); store != nil {
+		archive.FromLocalCache = store.contains(archive)
+	}
+	return archive, nil
+}
+
+func downloadWithClient(ctx context.Context, httpClient *retryablehttp.Client, params DownloadParams, logger log.Logger) (ArchiveInfo, error) {
+	if err := validateParams(params); err != nil {
+		return ArchiveInfo{}, err
+	}
+
+	store := openLocalStore(params, logger)
+
+	// The lookup budget covers finding the archive for the first time, the download budget everything after it,
+	// including fetching a new download URL for a retry.
+	lookupCtx, cancelLookup := withTimeout(ctx, params.LookupTimeout)
+	defer cancelLookup()
+	var downloadCtx context.Context
+	cancelDownload := context.CancelFunc(func() {})
+	defer func() { cancelDownload() }()
+
+	var archive ArchiveInfo
+	err := retry.Times(uint(params.NumFullRetries)).Wait(5 * time.Second).TryWithAbort(func(attempt uint) (error, bool) {
+		if attempt != 0 {
+			logger.Debugf("Retrying archive download... (attempt %d)", attempt+1)
+		}
+
+		phaseCtx, timeoutErr := lookupCtx, ErrLookupTimedOut
+		if downloadCtx != nil {
+			phaseCtx, timeoutErr = downloadCtx, ErrDownloadTimedOut
+		}
+
+		logger.Debugf("Fetching download URL...")
+		resolved, err := resolveArchive(phaseCtx, httpClient, params, logger)
+		if err != nil {
+			if errors.Is(err, ErrCacheNotFound) {
+				return err, true // Do not retry if cache key not found
+			}
+			if phaseCtx.Err() != nil {
+				return phaseError(phaseCtx, timeoutErr, fmt.Errorf("failed to get download URL: %w", err)), true
+			}
+
+			logger.Debugf("Failed to get download URL: %s", err)
+			return fmt.Errorf("failed to get download URL: %w", err), false
+		}
+
+		archive = resolved
+		if downloadCtx == nil {
+			if archive, err = preflight(lookupCtx, httpClient, archive, params, logger); err != nil {
+				return err, true
+			}
+			cancelLookup()
+			downloadCtx, cancelDownload = withTimeout(ctx, params.DownloadTimeout)
+		}
+		if store != nil {
+			found, err := store.copyTo(archive, params.DownloadPath)
+			if err != nil {
+				logger.Warnf("Failed to read the local cache: %s", err)
+			}
+			if found {
+				logger.Printf("Archive found in the local cache")
+				archive.FromLocalCache = true
+				return nil, false
+			}
+		}
+
+		logger.Debugf("Downloading archive...")
+		downloadErr := downloadFile(downloadCtx, httpClient, archive, params, logger)
+		if downloadErr != nil {
+			err = fmt.Errorf("failed to download archive: %w", downloadErr)
+			if downloadCtx.Err() != nil {
+				logger.Warnf("Download timed out.")
+				return phaseError(downloadCtx, ErrDownloadTimedOut, err), true
+			}
+			logger.Debugf("Failed to download archive: %s", downloadErr)
+			return err, false
+		}
+
+		if err := verifyDownload(params.DownloadPath, archive, logger); err != nil {
+			// A corrupted or truncated archive must never be extracted, the next attempt downloads it again
+			logger.Warnf("Downloaded archive is corrupted: %s", err)
+			if removeErr := os.Remove(params.DownloadPath); removeErr != nil {
+				logger.Debugf("Failed to remove corrupted archive: %s", removeErr)
+			}
+			return err, false
+		}
+
+		return nil, false
+	})
+	if err != nil {
+		return ArchiveInfo{}, err
+	}
+
+	if store != nil && !archive.FromLocalCache {
+		if archive.Checksum == "" {
+			logger.Debugf("The cache API didn't provide the archive checksum, not adding archive to the local cache")
+		} else if err := store.addFile(params.DownloadPath, archive); err != nil {
+			logger.Warnf("Failed to add archive to the local cache: %s", err)
+		}
+	}
+	return archive, nil
+}
+
+func archiveInfo(response restoreResponse) ArchiveInfo {
+	return ArchiveInfo{
+		URL:              response.URL,
+		MatchedKey:       response.MatchedKey,
+		Checksum:         response.ArchiveChecksum,
+		Size:             response.ArchiveSize,
+		UncompressedSize: response.UncompressedSize,
+	}
+}
+
+// downloadFile downloads the archive to params.DownloadPath. The download is resumable: it's written to a stable location first,
+// together with a manifest of the downloaded chunks, so a later attempt (or a re-run of the step) only downloads
+// the missing chunks, provided the remote archive is unchanged.
+func downloadFile(ctx context.Context, httpClient *retryablehttp.Client, archive ArchiveInfo, params DownloadParams, logger log.Logger) error {
+	if isFileURL, err := copyFileURL(archive.URL, params.DownloadPath); isFileURL {
+		return err
+	}
+
+	partial, err := newPartialDownload(archive)
+	if err != nil {
+		return err
+	}
+	defer partial.release()
+
+	downloader := got.New()
+	downloader.Client = httpClient.StandardClient()
+	if params.ProgressInterval > 0 {
+		downloader.ProgressFunc = func(d *got.Download) {
+			logDownloadProgress(logger, d.Size(), d.TotalSize(), d.AvgSpeed(), d.ActiveChunks())
+		}
+	}
+
+	gDownload := got.NewDownload(ctx, archive.URL, partial.path)
+	gDownload.ManifestPath = partial.manifestPath()
+	// Client has to be set on "Download" as well,
+	// as depending on how downloader is called
+	// either the Client from the downloader or from the Download will be used.
+	gDownload.Client = httpClient.StandardClient()
+	// Concurrency is only the upper limit, it's adjusted to the throughput during the download
+	gDownload.Concurrency = params.Tuning.maxConcurrency(false)
+	gDownload.Adaptive = true
+	gDownload.Interval = uint64(params.ProgressInterval.Milliseconds())
+	gDownload.Logger = logger
+	gDownload.MaxRetryPerChunk = params.Tuning.maxRetryPerChunk()
+	gDownload.ChunkRetryThreshold = params.Tuning.chunkRetryThreshold()
+
+	if err := downloader.Do(gDownload); err != nil {
+		if !partial.resumable || (params.DiscardPartialOnTimeout && ctx.Err() != nil) {
+			partial.remove()
+		}
+		return err
+	}
+	return partial.moveTo(params.DownloadPath)
+}
@@ -0,0 +1,147 @@
+package got
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+type OffsetWriter struct {
+	io.WriterAt
+	offset int64
+	// chunk, if set, is the chunk being written. Writes stop at the end of the chunk (which can shrink when
+	// the chunk is split), and the chunk progress is updated, so it can be persisted.
+	chunk *Chunk
+}
+
+func (dst *OffsetWriter) Write(b []byte) (n int, err error) {
+	if dst.chunk != nil {
+		n, err = dst.chunk.write(dst.WriterAt, b)
+	} else {
+		n, err = dst.WriteAt(b, dst.offset)
+	}
+	dst.offset += int64(n)
+	return
+}
+
+// errChunkEnd is returned when a write reaches the end of the chunk before the end of the range request,
+// because the chunk was split in the meantime.
+var errChunkEnd = errors.New("end of chunk reached")
+
+// Chunk represents the partial content range
+type Chunk struct {
+	Start uint64 `json:"start"`
+	End   uint64 `json:"end"`
+	// Done is the number of bytes already downloaded from Start.
+	Done uint64 `json:"done"`
+
+	mu sync.Mutex
+}
+
+func (c *Chunk) progress() (start, end, done uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.Start, c.End, c.Done
+}
+
+func (c *Chunk) done() uint64 {
+	_, _, done := c.progress()
+	return done
+}
+
+func (c *Chunk) isComplete() bool {
+	start, end, done := c.progress()
+	return start+done > end
+}
+
+// remaining returns the number of bytes left to download.
+func (c *Chunk) remaining() uint64 {
+	start, end, done := c.progress()
+	if start+done > end {
+		return 0
+	}
+	return end - start - done + 1
+}
+
+// write writes b at the current position of the chunk, but never past its end.
+func (c *Chunk) write(dest io.WriterAt, b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	pos := c.Start + c.Done
+	if pos > c.End {
+		return 0, errChunkEnd
+	}
+	truncated := false
+	if left := c.End - pos + 1; uint64(len(b)) > left {
+		b = b[:left]
+		truncated = true
+	}
+
+	n, err := dest.WriteAt(b, int64(pos))
+	c.Done += uint64(n)
+	if err == nil && truncated {
+		err = errChunkEnd
+	}
+	return n, err
+}
+
+// split cuts the remaining part of the chunk in half, and returns the second half as a new chunk.
+// Returns nil if the halves would be smaller than minSize.
+func (c *Chunk) split(minSize uint64) *Chunk {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	pos := c.Start + c.Done
+	if pos > c.End || c.End-pos+1 < 2*minSize {
+		return nil
+	}
+
+	mid := pos + (c.End-pos+1)/2
+	second := &Chunk{Start: mid, End: c.End}
+	c.End = mid - 1
+	return second
+}
+
+type chunkStatistics struct {
+	sum            time.Duration
+	finishedChunks int
+	mu             sync.Mutex
+}
+
+func (cs *chunkStatistics) update(d time.Duration) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.sum += d
+	cs.finishedChunks++
+}
+
+func (cs *chunkStatistics) finishedCount() int {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	return cs.finishedChunks
+}
+
+func (cs *chunkStatistics) average() time.Duration {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	if cs.finishedChunks == 0 {
+		return 0
+	}
+	return cs.sum / time.Duration(cs.finishedChunks)
+}
+
+func (cs *chunkStatistics) String() string {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	var avg time.Duration
+	if cs.finishedChunks > 0 {
+		avg = cs.sum / time.Duration(cs.finishedChunks)
+	}
+
+	return fmt.Sprintf("[finishedChunks=%d][avg=%s]", cs.finishedChunks, avg.Round(time.Second))
+}
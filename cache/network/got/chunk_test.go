@@ -0,0 +1,131 @@
+package got
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestChunkSplit(t *testing.T) {
+	tests := []struct {
+		name    string
+		chunk   *Chunk
+		minSize uint64
+		// wantEnd is the end of the chunk after the split, wantStolen is the new chunk (nil if not split)
+		wantEnd    uint64
+		wantStolen *Chunk
+	}{
+		{
+			name:       "new chunk",
+			chunk:      &Chunk{Start: 0, End: 99},
+			minSize:    10,
+			wantEnd:    49,
+			wantStolen: &Chunk{Start: 50, End: 99},
+		},
+		{
+			name:       "remaining part is split",
+			chunk:      &Chunk{Start: 100, End: 199, Done: 60},
+			minSize:    10,
+			wantEnd:    179,
+			wantStolen: &Chunk{Start: 180, End: 199},
+		},
+		{
+			name:       "odd remaining size",
+			chunk:      &Chunk{Start: 0, End: 24},
+			minSize:    10,
+			wantEnd:    11,
+			wantStolen: &Chunk{Start: 12, End: 24},
+		},
+		{
+			name:    "halves smaller than the minimum",
+			chunk:   &Chunk{Start: 0, End: 99, Done: 81},
+			minSize: 10,
+			wantEnd: 99,
+		},
+		{
+			name:    "complete chunk",
+			chunk:   &Chunk{Start: 0, End: 99, Done: 100},
+			minSize: 1,
+			wantEnd: 99,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chunk := tt.chunk
+			stolen := chunk.split(tt.minSize)
+
+			if chunk.End != tt.wantEnd {
+				t.Errorf("End = %d, want %d", chunk.End, tt.wantEnd)
+			}
+			switch {
+			case tt.wantStolen == nil && stolen != nil:
+				t.Errorf("split() = %d-%d, want no split", stolen.Start, stolen.End)
+			case tt.wantStolen != nil && stolen == nil:
+				t.Errorf("split() = nil, want %d-%d", tt.wantStolen.Start, tt.wantStolen.End)
+			case stolen != nil && (stolen.Start != tt.wantStolen.Start || stolen.End != tt.wantStolen.End || stolen.Done != 0):
+				t.Errorf("split() = %d-%d (done %d), want %d-%d", stolen.Start, stolen.End, stolen.Done, tt.wantStolen.Start, tt.wantStolen.End)
+			}
+		})
+	}
+}
+
+func TestChunkWriteStopsAtEnd(t *testing.T) {
+	dest := &memoryWriterAt{}
+	chunk := &Chunk{Start: 2, End: 5}
+
+	n, err := chunk.write(dest, []byte("ab"))
+	if n != 2 || err != nil {
+		t.Fatalf("write() = %d, %v, want 2, nil", n, err)
+	}
+	// The chunk was split while the rest of the range was being downloaded
+	n, err = chunk.write(dest, []byte("cdef"))
+	if n != 2 || !errors.Is(err, errChunkEnd) {
+		t.Fatalf("write() = %d, %v, want 2, errChunkEnd", n, err)
+	}
+	if n, err := chunk.write(dest, []byte("g")); n != 0 || !errors.Is(err, errChunkEnd) {
+		t.Fatalf("write() past the end = %d, %v, want 0, errChunkEnd", n, err)
+	}
+
+	if got := string(dest.data[2:]); got != "abcd" {
+		t.Errorf("written data = %q, want %q", got, "abcd")
+	}
+	if !chunk.isComplete() || chunk.remaining() != 0 {
+		t.Errorf("chunk is not complete, %d bytes remaining", chunk.remaining())
+	}
+}
+
+func TestGetDefaultChunkSize(t *testing.T) {
+	const mb = 1024 * 1024
+	tests := []struct {
+		name                        string
+		totalSize, minSize, maxSize uint64
+		concurrency                 uint64
+		want                        uint64
+	}{
+		{name: "split between the concurrent downloads", totalSize: 100 * mb, concurrency: 10, want: 10 * mb},
+		{name: "default minimum size", totalSize: 10 * mb, concurrency: 10, want: 2 * mb},
+		{name: "configured minimum size", totalSize: 100 * mb, minSize: 20 * mb, concurrency: 10, want: 20 * mb},
+		{name: "configured maximum size", totalSize: 100 * mb, maxSize: 5 * mb, concurrency: 10, want: 5 * mb},
+		{name: "large chunks are halved", totalSize: 1000 * mb, concurrency: 4, want: 125 * mb},
+		{name: "at least two chunks", totalSize: 3 * mb, minSize: 4 * mb, concurrency: 4, want: 3 * mb / 2},
+		{name: "small file", totalSize: 10, concurrency: 4, want: 10},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := getDefaultChunkSize(tt.totalSize, tt.minSize, tt.maxSize, tt.concurrency); got != tt.want {
+				t.Errorf("getDefaultChunkSize() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+// memoryWriterAt is an in-memory io.WriterAt.
+type memoryWriterAt struct {
+	data []byte
+}
+
+func (w *memoryWriterAt) WriteAt(b []byte, off int64) (int, error) {
+	if end := int(off) + len(b); end > len(w.data) {
+		w.data = append(w.data, make([]byte, end-len(w.data))...)
+	}
+	return copy(w.data[off:], b), nil
+}
@@ -0,0 +1,5 @@
+// Package got is a concurrent, chunked HTTP downloader.
+//
+// It is a fork of github.com/bitrise-io/got (originally github.com/melbahja/got), extended with resumable downloads:
+// chunk progress can be persisted to a manifest file, so an interrupted download continues where it stopped.
+package got
@@ -2,24 +2,28 @@ package got
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"os"
 	"path/filepath"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
-	"github.com/bitrise-io/go-utils/retry"
 	"github.com/bitrise-io/go-utils/v2/log"
 )
 
 const (
 	smallFileSizeThreshold = 10
+
+	// manifestSaveInterval is how often the chunk progress of a resumable download is persisted.
+	manifestSaveInterval = 2 * time.Second
 )
 
 type (
@@ -28,6 +32,8 @@ type (
 	Info struct {
 		Size      uint64
 		Rangeable bool
+		// ETag and LastModified identify the version of the remote file, they are used to decide if a download can be resumed.
+		ETag, LastModified string
 	}
 
 	// ProgressFunc to show progress state, called by RunProgress based on interval.
@@ -39,6 +45,15 @@ type (
 
 		Concurrency uint
 
+		// Adaptive enables the adaptive scheduler: the download starts with a lower concurrency, which is raised
+		// (up to Concurrency) while the aggregate throughput improves, and halved on chunk errors and throttling
+		// responses (429, 503). Idle workers split the largest outstanding chunk (work stealing), so a single
+		// slow range doesn't dominate the end of the download.
+		Adaptive bool
+
+		// MinSplitSize is the size of the smallest chunk created by splitting a chunk, defaults to 4 MiB.
+		MinSplitSize uint64
+
 		URL, Dir, Dest string
 
 		Interval, ChunkSize, MinChunkSize, MaxChunkSize uint64
@@ -56,6 +71,12 @@ type (
 
 		StopProgress bool
 
+		// ManifestPath is the path of a file where the chunk progress is persisted during the download.
+		// If a manifest of an earlier, interrupted download of the same (unchanged) remote file exists at this path,
+		// the download continues from where it stopped. The manifest is removed once the download completes.
+		// Resuming is disabled if empty.
+		ManifestPath string
+
 		path string
 
 		unsafeName string
@@ -68,6 +89,17 @@ type (
 
 		chunks []*Chunk
 
+		resumed bool
+
+		resumedSize uint64
+
+		activeChunks int32
+
+		progressDone chan struct{}
+
+		// manifestMu serializes the manifest writes, chunksMu guards the chunk list, which grows when chunks are split.
+		manifestMu, chunksMu sync.Mutex
+
 		startedAt time.Time
 	}
 
@@ -105,7 +137,13 @@ func (d *Download) GetInfoOrDownload() (*Info, error) {
 	// Set content disposition non trusted name
 	d.unsafeName = res.Header.Get("content-disposition")
 
-	if dest, err = os.Create(d.Path()); err != nil {
+	// The first byte of a range request is written to the file without truncating it,
+	// as it might hold the data of an earlier download that is going to be resumed
+	flag := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+	if res.StatusCode == http.StatusPartialContent {
+		flag = os.O_CREATE | os.O_WRONLY
+	}
+	if dest, err = os.OpenFile(d.Path(), flag, 0666); err != nil {
 		return &Info{}, err
 	}
 	defer dest.Close()
@@ -122,8 +160,10 @@ func (d *Download) GetInfoOrDownload() (*Info, error) {
 			if length, err := strconv.ParseUint(l[1], 10, 64); err == nil {
 
 				return &Info{
-					Size:      length,
-					Rangeable: true,
+					Size:         length,
+					Rangeable:    true,
+					ETag:         res.Header.Get("ETag"),
+					LastModified: res.Header.Get("Last-Modified"),
 				}, nil
 			}
 		}
@@ -151,6 +191,11 @@ func (d *Download) Init() (err error) {
 		d.ctx = context.Background()
 	}
 
+	// Set default logger.
+	if d.Logger == nil {
+		d.Logger = discardLogger{}
+	}
+
 	// Get URL info and partial content support state
 	if d.info, err = d.GetInfoOrDownload(); err != nil {
 		return err
@@ -158,6 +203,7 @@ func (d *Download) Init() (err error) {
 
 	// Partial content not supported, and the file downladed.
 	if d.info.Rangeable == false {
+		d.removeManifest()
 		return nil
 	}
 
@@ -166,6 +212,10 @@ func (d *Download) Init() (err error) {
 		d.Concurrency = getDefaultConcurrency()
 	}
 
+	if d.resume() {
+		return nil
+	}
+
 	// Set default chunk size
 	if d.ChunkSize == 0 {
 		d.ChunkSize = getDefaultChunkSize(d.info.Size, d.MinChunkSize, d.MaxChunkSize, uint64(d.Concurrency))
@@ -207,7 +257,12 @@ func (d *Download) Start() (err error) {
 
 	// Otherwise there are always at least 2 chunks
 
-	file, err := os.Create(d.Path())
+	// A resumed download keeps the data downloaded earlier
+	flag := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+	if d.resumed {
+		flag = os.O_CREATE | os.O_WRONLY
+	}
+	file, err := os.OpenFile(d.Path(), flag, 0666)
 	if err != nil {
 		return err
 	}
@@ -216,20 +271,26 @@ func (d *Download) Start() (err error) {
 	// Allocate the file completely so that we can write concurrently
 	file.Truncate(int64(d.TotalSize()))
 
-	// Download chunks.
-	errs := make(chan error, 1)
-	go d.dl(file, errs)
+	stopSaving := d.saveManifestPeriodically()
+
+	// Download chunks, dl returns once every chunk download stopped, so the file can be closed safely.
+	err = d.dl(file)
 
-	select {
-	case err = <-errs:
-	case <-d.ctx.Done():
-		err = d.ctx.Err()
+	stopSaving()
+	if err == nil {
+		d.removeManifest()
+	} else {
+		d.saveManifest()
 	}
 
-	return
+	if d.ctx.Err() != nil {
+		return d.ctx.Err()
+	}
+	return err
 }
 
 // RunProgress runs ProgressFunc based on Interval and updates lastSize.
+// The first call happens after the first interval, and it stops once the download finished or StopProgress is set.
 func (d *Download) RunProgress(fn ProgressFunc) {
 
 	// Set default interval.
@@ -237,19 +298,21 @@ func (d *Download) RunProgress(fn ProgressFunc) {
 		d.Interval = uint64(400 / runtime.NumCPU())
 	}
 
-	sleepd := time.Duration(d.Interval) * time.Millisecond
+	ticker := time.NewTicker(time.Duration(d.Interval) * time.Millisecond)
+	defer ticker.Stop()
 
 	for {
 
-		if d.StopProgress {
-			break
-		}
-
-		// Context check.
 		select {
 		case <-d.ctx.Done():
 			return
-		default:
+		case <-d.progressDone:
+			return
+		case <-ticker.C:
+		}
+
+		if d.StopProgress {
+			break
 		}
 
 		// Run progress func.
@@ -257,9 +320,6 @@ func (d *Download) RunProgress(fn ProgressFunc) {
 
 		// Update last size
 		atomic.StoreUint64(&d.lastSize, atomic.LoadUint64(&d.size))
-
-		// Interval.
-		time.Sleep(sleepd)
 	}
 }
 
@@ -283,16 +343,21 @@ func (d *Download) Speed() uint64 {
 	return (atomic.LoadUint64(&d.size) - atomic.LoadUint64(&d.lastSize)) / d.Interval * 1000
 }
 
-// AvgSpeed returns average download speed.
+// AvgSpeed returns average download speed. Data downloaded by an earlier, resumed download is not included.
 func (d *Download) AvgSpeed() uint64 {
 
 	if totalMills := d.TotalCost().Milliseconds(); totalMills > 0 {
-		return uint64(atomic.LoadUint64(&d.size) / uint64(totalMills) * 1000)
+		return (atomic.LoadUint64(&d.size) - d.resumedSize) * 1000 / uint64(totalMills)
 	}
 
 	return 0
 }
 
+// ActiveChunks returns the number of chunks being downloaded at the moment.
+func (d *Download) ActiveChunks() int {
+	return int(atomic.LoadInt32(&d.activeChunks))
+}
+
 // TotalCost returns download duration.
 func (d *Download) TotalCost() time.Duration {
 	return time.Since(d.startedAt)
@@ -310,94 +375,6 @@ func (d *Download) IsRangeable() bool {
 	return d.info.Rangeable
 }
 
-// Download chunks
-func (d *Download) dl(dest io.WriterAt, errC chan error) {
-	var (
-		// Wait group.
-		wg sync.WaitGroup
-
-		// Concurrency limit.
-		max = make(chan int, d.Concurrency)
-	)
-
-	d.Logger.Debugf("Downloading %d chunks, %d concurrency", len(d.chunks), d.Concurrency)
-
-	var stats chunkStatistics
-	for i := 0; i < len(d.chunks); i++ {
-
-		max <- 1
-		wg.Add(1)
-
-		go func(i int) {
-			defer wg.Done()
-
-			// This OffsetWriter allows two things:
-			// - write to the offset of the file
-			// - in case of an interrupt and re-download, it will resume from the last position
-			offsetWriter := &OffsetWriter{dest, int64(d.chunks[i].Start)}
-
-			err := retry.Times(uint(d.MaxRetryPerChunk)).TryWithAbort(func(attempt uint) (error, bool) {
-				log := func(msg string, args ...interface{}) {
-					if d.Logger == nil {
-						return
-					}
-					prefix := fmt.Sprintf("[chunk=%d][attempt=%d]%s ", i, attempt, stats.String())
-					d.Logger.Debugf(prefix+msg, args...)
-				}
-
-				// Concurrently download and write chunk
-				start := time.Now()
-
-				// Per-chunk cancellation signal
-				chunkCtx, cancelChunk := context.WithCancel(d.ctx)
-				defer cancelChunk()
-
-				// Check for hanged downloads and interrupt them
-				downloadCheckTicker := time.NewTicker(time.Second)
-				defer downloadCheckTicker.Stop()
-
-				go func() {
-					if attempt == uint(d.MaxRetryPerChunk) {
-						log("last attempt, won't start ticker")
-						return // never interrupt the last try
-					}
-					log("start ticker")
-					for range downloadCheckTicker.C {
-						if stats.finishedChunks > 0 && time.Since(start)-stats.average() > d.ChunkRetryThreshold {
-							log("⚠️ found hanged chunk download, canceling request after %s", time.Since(start).Round(time.Second))
-							cancelChunk()
-							return
-						}
-					}
-					log("stop ticker")
-				}()
-
-				if err := d.DownloadChunk(chunkCtx, offsetWriter, d.chunks[i].End); err != nil {
-					if d.ctx.Err() != nil {
-						// Do not retry if context cancelled or deadline exceeded
-						log("timouted, aborting: %s", err)
-						return err, true
-					}
-					return err, false
-				}
-
-				took := time.Since(start)
-				stats.update(took)
-				log("finished chunk download, took %s", took)
-				return nil, false
-			})
-			if err != nil {
-				errC <- err
-			}
-
-			<-max
-		}(i)
-	}
-
-	wg.Wait()
-	errC <- nil
-}
-
 // Return constant path which will not change once the download starts
 func (d *Download) Path() string {
 
@@ -437,6 +414,11 @@ func (d *Download) DownloadChunk(ctx context.Context, dest *OffsetWriter, chunkE
 	if res, err = d.Client.Do(req); err != nil {
 		return err
 	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusTooManyRequests || res.StatusCode == http.StatusServiceUnavailable {
+		return &ThrottledError{StatusCode: res.StatusCode}
+	}
 
 	// Verify the length
 	if res.ContentLength != int64(chunkEnd-uint64(dest.offset)+1) {
@@ -446,13 +428,34 @@ func (d *Download) DownloadChunk(ctx context.Context, dest *OffsetWriter, chunkE
 		)
 	}
 
-	defer res.Body.Close()
-
-	_, err = io.CopyN(dest, io.TeeReader(res.Body, d), res.ContentLength)
+	// Only the bytes written to the chunk are counted, a split chunk stops before the end of the response
+	_, err = io.CopyN(writerFunc(func(b []byte) (int, error) {
+		n, err := dest.Write(b)
+		d.Write(b[:n]) //nolint:errcheck
+		return n, err
+	}), res.Body, res.ContentLength)
+	if errors.Is(err, errChunkEnd) {
+		return nil
+	}
 
 	return err
 }
 
+// ThrottledError is returned when the server asks to slow down (429 Too Many Requests or 503 Service Unavailable).
+type ThrottledError struct {
+	StatusCode int
+}
+
+func (e *ThrottledError) Error() string {
+	return fmt.Sprintf("server throttled the request: %d %s", e.StatusCode, http.StatusText(e.StatusCode))
+}
+
+type writerFunc func([]byte) (int, error)
+
+func (f writerFunc) Write(b []byte) (int, error) {
+	return f(b)
+}
+
 // NewDownload returns new *Download with context.
 func NewDownload(ctx context.Context, URL, dest string) *Download {
 	return &Download{
@@ -463,6 +466,11 @@ func NewDownload(ctx context.Context, URL, dest string) *Download {
 	}
 }
 
+// DefaultConcurrency is the concurrency used when Concurrency is not set, it's based on the number of CPUs.
+func DefaultConcurrency() uint {
+	return getDefaultConcurrency()
+}
+
 func getDefaultConcurrency() uint {
 
 	c := uint(runtime.NumCPU() * 3)
@@ -520,3 +528,110 @@ func getDefaultChunkSize(totalSize, min, max, concurrency uint64) uint64 {
 
 	return cs
 }
+
+// resume restores the chunks of an earlier, interrupted download from the manifest, if it belongs to the same remote file.
+func (d *Download) resume() bool {
+	if d.ManifestPath == "" {
+		return false
+	}
+
+	m, err := readManifest(d.ManifestPath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			d.Logger.Debugf("Failed to read download manifest, starting a new download: %s", err)
+		}
+		return false
+	}
+	if !m.matches(d.info) {
+		d.Logger.Debugf("Remote file changed since the interrupted download, starting a new download")
+		return false
+	}
+	if fileInfo, err := os.Stat(d.Path()); err != nil || uint64(fileInfo.Size()) != d.info.Size {
+		d.Logger.Debugf("Partially downloaded file is missing, starting a new download")
+		return false
+	}
+
+	var done uint64
+	for _, chunk := range m.Chunks {
+		done += chunk.Done
+	}
+	atomic.AddUint64(&d.size, done)
+	atomic.StoreUint64(&d.lastSize, done)
+	d.resumedSize = done
+
+	d.chunks = m.Chunks
+	d.resumed = true
+	d.Logger.Printf("Resuming interrupted download, %d of %d bytes were downloaded earlier", done, d.info.Size)
+	return true
+}
+
+// saveManifest persists the chunk progress, so a later download can continue from here.
+func (d *Download) saveManifest() {
+	if d.ManifestPath == "" {
+		return
+	}
+	if d.info.ETag == "" && d.info.LastModified == "" {
+		// Without these it's not possible to tell if the remote file changed in the meantime
+		return
+	}
+
+	d.manifestMu.Lock()
+	defer d.manifestMu.Unlock()
+
+	d.chunksMu.Lock()
+	chunks := make([]*Chunk, 0, len(d.chunks))
+	for _, chunk := range d.chunks {
+		start, end, done := chunk.progress()
+		chunks = append(chunks, &Chunk{Start: start, End: end, Done: done})
+	}
+	d.chunksMu.Unlock()
+	// Split chunks are appended to the end of the list
+	sort.Slice(chunks, func(i, j int) bool { return chunks[i].Start < chunks[j].Start })
+
+	m := manifest{
+		Size:         d.info.Size,
+		ETag:         d.info.ETag,
+		LastModified: d.info.LastModified,
+		Chunks:       chunks,
+	}
+	if err := writeManifest(d.ManifestPath, m); err != nil {
+		d.Logger.Debugf("Failed to save download manifest: %s", err)
+	}
+}
+
+// saveManifestPeriodically saves the chunk progress in the background until the returned function is called.
+func (d *Download) saveManifestPeriodically() func() {
+	if d.ManifestPath == "" {
+		return func() {}
+	}
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(manifestSaveInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				d.saveManifest()
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+func (d *Download) removeManifest() {
+	if d.ManifestPath == "" {
+		return
+	}
+	if err := os.Remove(d.ManifestPath); err != nil && !os.IsNotExist(err) {
+		d.Logger.Debugf("Failed to remove download manifest: %s", err)
+	}
+}
@@ -0,0 +1,158 @@
+package got
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDownloadResume(t *testing.T) {
+	content := make([]byte, 64*1024)
+	if _, err := rand.Read(content); err != nil {
+		t.Fatal(err)
+	}
+	half := uint64(len(content) / 2)
+
+	tests := []struct {
+		name string
+		// manifestETag is the ETag of the remote file when the interrupted download started
+		manifestETag string
+		wantResumed  bool
+	}{
+		{name: "unchanged remote file is resumed", manifestETag: `"v1"`, wantResumed: true},
+		{name: "changed remote file is downloaded again", manifestETag: `"v0"`, wantResumed: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, ranges := newRangeServer(t, content, `"v1"`)
+			dir := t.TempDir()
+			dest := filepath.Join(dir, "archive.part")
+			manifestPath := dest + ".json"
+
+			// The first half was downloaded by the interrupted download, the rest of the file is a placeholder.
+			// If the remote file changed, the first half is stale too, so it has to be downloaded again.
+			partial := bytes.Repeat([]byte{'x'}, len(content))
+			if tt.wantResumed {
+				copy(partial, content[:half])
+			}
+			if err := os.WriteFile(dest, partial, 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := writeManifest(manifestPath, manifest{
+				Size: uint64(len(content)),
+				ETag: tt.manifestETag,
+				Chunks: []*Chunk{
+					{Start: 0, End: half - 1, Done: half},
+					{Start: half, End: uint64(len(content)) - 1},
+				},
+			}); err != nil {
+				t.Fatal(err)
+			}
+
+			download := NewDownload(context.Background(), server.URL, dest)
+			download.ManifestPath = manifestPath
+			download.Concurrency = 2
+			if err := New().Do(download); err != nil {
+				t.Fatalf("Do() error = %s", err)
+			}
+
+			got, err := os.ReadFile(dest)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, content) {
+				t.Errorf("downloaded file differs from the remote file")
+			}
+			if download.resumed != tt.wantResumed {
+				t.Errorf("resumed = %t, want %t", download.resumed, tt.wantResumed)
+			}
+			if _, err := os.Stat(manifestPath); !os.IsNotExist(err) {
+				t.Errorf("manifest was not removed after the download: %v", err)
+			}
+
+			downloadedFirstHalf := false
+			for _, r := range ranges() {
+				// bytes=0-0 is the size probe, every other range starting at 0 downloads the first half again
+				if strings.HasPrefix(r, "bytes=0-") && r != "bytes=0-0" {
+					downloadedFirstHalf = true
+				}
+			}
+			if downloadedFirstHalf == tt.wantResumed {
+				t.Errorf("requested ranges = %v, first half downloaded again: %t", ranges(), downloadedFirstHalf)
+			}
+		})
+	}
+}
+
+func TestDownloadSavesManifestOnInterrupt(t *testing.T) {
+	content := make([]byte, 64*1024)
+	if _, err := rand.Read(content); err != nil {
+		t.Fatal(err)
+	}
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v1"`)
+		// Only the first chunk arrives, the rest of the file hangs
+		if !strings.HasPrefix(r.Header.Get("Range"), "bytes=0-") {
+			select {
+			case <-release:
+			case <-r.Context().Done():
+			}
+			return
+		}
+		http.ServeContent(w, r, "archive", time.Time{}, bytes.NewReader(content))
+	}))
+	defer server.Close()
+	defer close(release)
+
+	dest := filepath.Join(t.TempDir(), "archive.part")
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	download := NewDownload(ctx, server.URL, dest)
+	download.ManifestPath = dest + ".json"
+	download.Concurrency = 2
+	download.ChunkSize = uint64(len(content) / 2)
+	if err := NewWithContext(ctx).Do(download); err == nil {
+		t.Fatal("Do() succeeded, want the interrupted download to fail")
+	}
+
+	m, err := readManifest(download.ManifestPath)
+	if err != nil {
+		t.Fatalf("manifest of the interrupted download: %s", err)
+	}
+	if m.ETag != `"v1"` || m.Size != uint64(len(content)) {
+		t.Errorf("manifest = %+v, want the ETag and the size of the remote file", m)
+	}
+	if len(m.Chunks) != 2 || m.Chunks[0].Done != m.Chunks[0].End+1 || m.Chunks[1].Done != 0 {
+		t.Errorf("manifest chunks = %+v, want the first chunk downloaded", m.Chunks)
+	}
+}
+
+// newRangeServer serves content with range requests, and returns the requested ranges.
+func newRangeServer(t *testing.T, content []byte, etag string) (*httptest.Server, func() []string) {
+	t.Helper()
+	var mu sync.Mutex
+	var ranges []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		ranges = append(ranges, r.Header.Get("Range"))
+		mu.Unlock()
+		w.Header().Set("ETag", etag)
+		http.ServeContent(w, r, "archive", time.Time{}, bytes.NewReader(content))
+	}))
+	t.Cleanup(server.Close)
+
+	return server, func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), ranges...)
+	}
+}
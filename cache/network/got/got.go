@@ -52,11 +52,18 @@ func (g Got) Do(dl *Download) error {
 
 	if g.ProgressFunc != nil {
 
+		// Progress reporting is stopped before returning, so no progress is reported after the download finished.
+		dl.progressDone = make(chan struct{})
+		stopped := make(chan struct{})
 		defer func() {
-			dl.StopProgress = true
+			close(dl.progressDone)
+			<-stopped
 		}()
 
-		go dl.RunProgress(g.ProgressFunc)
+		go func() {
+			defer close(stopped)
+			dl.RunProgress(g.ProgressFunc)
+		}()
 	}
 
 	return dl.Start()
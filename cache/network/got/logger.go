@@ -0,0 +1,21 @@
+package got
+
+// discardLogger is the logger of a Download without a Logger, it drops every message.
+type discardLogger struct{}
+
+func (discardLogger) Infof(string, ...interface{})  {}
+func (discardLogger) Warnf(string, ...interface{})  {}
+func (discardLogger) Printf(string, ...interface{}) {}
+func (discardLogger) Donef(string, ...interface{})  {}
+func (discardLogger) Debugf(string, ...interface{}) {}
+func (discardLogger) Errorf(string, ...interface{}) {}
+
+func (discardLogger) TInfof(string, ...interface{})  {}
+func (discardLogger) TWarnf(string, ...interface{})  {}
+func (discardLogger) TPrintf(string, ...interface{}) {}
+func (discardLogger) TDonef(string, ...interface{})  {}
+func (discardLogger) TDebugf(string, ...interface{}) {}
+func (discardLogger) TErrorf(string, ...interface{}) {}
+
+func (discardLogger) Println()            {}
+func (discardLogger) EnableDebugLog(bool) {}
@@ -0,0 +1,71 @@
+package got
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+)
+
+// manifest is the persisted state of a download, stored next to the downloaded file.
+// A download is only resumed if the remote file is unchanged, which is checked with the ETag and Last-Modified headers.
+type manifest struct {
+	Size         uint64   `json:"size"`
+	ETag         string   `json:"etag,omitempty"`
+	LastModified string   `json:"last_modified,omitempty"`
+	Chunks       []*Chunk `json:"chunks"`
+}
+
+func readManifest(path string) (*manifest, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var m manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// writeManifest replaces the manifest atomically, so an interrupted write never leaves a corrupted manifest behind.
+func writeManifest(path string, m manifest) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	tempFile, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tempFile.Name()) //nolint:errcheck
+
+	if _, err := tempFile.Write(data); err != nil {
+		tempFile.Close() //nolint:errcheck
+		return err
+	}
+	if err := tempFile.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tempFile.Name(), path)
+}
+
+// matches returns true if the manifest describes a download of the same, unchanged remote file.
+func (m *manifest) matches(info *Info) bool {
+	if info.ETag == "" && info.LastModified == "" {
+		return false
+	}
+	if m.Size != info.Size || m.ETag != info.ETag || m.LastModified != info.LastModified {
+		return false
+	}
+
+	// Chunks have to cover the whole file, without gaps
+	var next uint64
+	for _, chunk := range m.Chunks {
+		if chunk.Start != next || chunk.End < chunk.Start || chunk.Done > chunk.End-chunk.Start+1 {
+			return false
+		}
+		next = chunk.End + 1
+	}
+	return len(m.Chunks) > 0 && next == m.Size
+}
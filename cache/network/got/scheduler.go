@@ -0,0 +1,306 @@
+package got
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bitrise-io/go-utils/retry"
+	"github.com/bitrise-io/go-utils/v2/log"
+)
+
+const (
+	// adjustInterval is how often the adaptive scheduler measures the throughput and adjusts the concurrency.
+	adjustInterval = time.Second
+
+	// initialAdaptiveConcurrency is where the adaptive scheduler starts ramping up from.
+	initialAdaptiveConcurrency = 4
+
+	// minAdaptiveConcurrency is the lowest concurrency the adaptive scheduler backs off to.
+	minAdaptiveConcurrency = 2
+
+	// throughputGain is the throughput improvement required to keep ramping up the concurrency.
+	throughputGain = 1.1
+
+	defaultMinSplitSize = 4 * 1024 * 1024
+
+	// throttleBackoff is the wait before retrying a chunk after a throttling response.
+	throttleBackoff = 2 * time.Second
+)
+
+type chunkResult struct {
+	chunk *Chunk
+	err   error
+}
+
+// Download chunks, returns the first error once every started chunk download stopped.
+func (d *Download) dl(dest io.WriterAt) error {
+	ctx, stop := context.WithCancel(d.ctx)
+	defer stop()
+
+	var pending []*Chunk
+	for _, chunk := range d.chunks {
+		if !chunk.isComplete() {
+			pending = append(pending, chunk)
+		}
+	}
+
+	controller := newConcurrencyController(d)
+	d.Logger.Debugf("Downloading %d chunks, %d concurrency", len(pending), controller.limit)
+
+	var (
+		wg       sync.WaitGroup
+		stats    chunkStatistics
+		firstErr error
+		results  = make(chan chunkResult)
+		active   = map[*Chunk]bool{}
+	)
+
+	startChunk := func(chunk *Chunk) {
+		active[chunk] = true
+		index := d.chunkIndex(chunk)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			atomic.AddInt32(&d.activeChunks, 1)
+			defer atomic.AddInt32(&d.activeChunks, -1)
+
+			err := d.downloadChunkWithRetry(ctx, dest, chunk, index, &stats, controller)
+			results <- chunkResult{chunk: chunk, err: err}
+		}()
+	}
+
+	ticker := time.NewTicker(adjustInterval)
+	defer ticker.Stop()
+
+	for {
+		// No new chunk is started once a chunk failed, the started ones are waited for
+		for firstErr == nil && len(active) < controller.limit {
+			if len(pending) > 0 {
+				startChunk(pending[0])
+				pending = pending[1:]
+				continue
+			}
+			if stolen := d.splitLargestChunk(active); stolen != nil {
+				startChunk(stolen)
+				continue
+			}
+			break
+		}
+
+		if len(active) == 0 {
+			break
+		}
+
+		select {
+		case result := <-results:
+			delete(active, result.chunk)
+			if result.err != nil && firstErr == nil {
+				firstErr = result.err
+				stop()
+			}
+		case <-ticker.C:
+			controller.adjust(atomic.LoadUint64(&d.size))
+		}
+	}
+
+	wg.Wait()
+	if firstErr == nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return firstErr
+}
+
+// downloadChunkWithRetry downloads a single chunk, retrying and resuming it from the last received byte on errors,
+// and interrupting it if it's much slower than the chunks downloaded so far.
+func (d *Download) downloadChunkWithRetry(ctx context.Context, dest io.WriterAt, chunk *Chunk, index int, stats *chunkStatistics, controller *concurrencyController) error {
+	// This OffsetWriter allows three things:
+	// - write to the offset of the file
+	// - in case of an interrupt and re-download, it will resume from the last position
+	// - keep track of the chunk progress, which makes resuming a later download (and splitting the chunk) possible
+	start, _, done := chunk.progress()
+	offsetWriter := &OffsetWriter{dest, int64(start + done), chunk}
+
+	return retry.Times(uint(d.MaxRetryPerChunk)).TryWithAbort(func(attempt uint) (error, bool) {
+		log := func(msg string, args ...interface{}) {
+			prefix := fmt.Sprintf("[chunk=%d][attempt=%d]%s ", index, attempt, stats.String())
+			d.Logger.Debugf(prefix+msg, args...)
+		}
+
+		// Concurrently download and write chunk
+		start := time.Now()
+
+		// Per-chunk cancellation signal
+		chunkCtx, cancelChunk := context.WithCancel(ctx)
+		defer cancelChunk()
+
+		// Check for hanged downloads and interrupt them
+		downloadCheckTicker := time.NewTicker(time.Second)
+		defer downloadCheckTicker.Stop()
+
+		go func() {
+			if attempt == uint(d.MaxRetryPerChunk) {
+				log("last attempt, won't start ticker")
+				return // never interrupt the last try
+			}
+			log("start ticker")
+			for {
+				select {
+				case <-chunkCtx.Done():
+					log("stop ticker")
+					return
+				case <-downloadCheckTicker.C:
+				}
+				if stats.finishedCount() > 0 && time.Since(start)-stats.average() > d.ChunkRetryThreshold {
+					log("⚠️ found hanged chunk download, canceling request after %s", time.Since(start).Round(time.Second))
+					cancelChunk()
+					return
+				}
+			}
+		}()
+
+		_, end, _ := chunk.progress()
+		if err := d.DownloadChunk(chunkCtx, offsetWriter, end); err != nil {
+			if ctx.Err() != nil {
+				// Do not retry if context cancelled or deadline exceeded
+				log("timouted, aborting: %s", err)
+				return err, true
+			}
+
+			controller.reportError()
+			var throttledErr *ThrottledError
+			if errors.As(err, &throttledErr) {
+				log("%s, backing off", err)
+				select {
+				case <-time.After(throttleBackoff):
+				case <-ctx.Done():
+					return ctx.Err(), true
+				}
+			}
+			return err, false
+		}
+
+		took := time.Since(start)
+		stats.update(took)
+		log("finished chunk download, took %s", took)
+		return nil, false
+	})
+}
+
+// splitLargestChunk splits the active chunk with the most bytes left, and returns the new chunk.
+// Returns nil if splitting is disabled, or no chunk is large enough to be split.
+func (d *Download) splitLargestChunk(active map[*Chunk]bool) *Chunk {
+	if !d.Adaptive {
+		return nil
+	}
+
+	minSplitSize := d.MinSplitSize
+	if minSplitSize == 0 {
+		minSplitSize = defaultMinSplitSize
+	}
+
+	var largest *Chunk
+	var largestRemaining uint64
+	for chunk := range active {
+		if remaining := chunk.remaining(); remaining > largestRemaining {
+			largest, largestRemaining = chunk, remaining
+		}
+	}
+	if largest == nil {
+		return nil
+	}
+
+	stolen := largest.split(minSplitSize)
+	if stolen == nil {
+		return nil
+	}
+
+	d.chunksMu.Lock()
+	d.chunks = append(d.chunks, stolen)
+	d.chunksMu.Unlock()
+
+	d.Logger.Debugf("Split chunk %d, %d bytes are downloaded by a new chunk", d.chunkIndex(largest), stolen.End-stolen.Start+1)
+	return stolen
+}
+
+func (d *Download) chunkIndex(chunk *Chunk) int {
+	d.chunksMu.Lock()
+	defer d.chunksMu.Unlock()
+
+	for i, c := range d.chunks {
+		if c == chunk {
+			return i
+		}
+	}
+	return -1
+}
+
+// concurrencyController decides how many chunks are downloaded at the same time.
+// Without the adaptive scheduler, the limit is always the configured concurrency.
+type concurrencyController struct {
+	adaptive bool
+	limit    int
+	min, max int
+	logger   log.Logger
+
+	errors         int32
+	lastSize       uint64
+	lastTick       time.Time
+	lastThroughput float64
+}
+
+func newConcurrencyController(d *Download) *concurrencyController {
+	concurrency := int(d.Concurrency)
+	c := &concurrencyController{
+		adaptive: d.Adaptive,
+		limit:    concurrency,
+		min:      concurrency,
+		max:      concurrency,
+		logger:   d.Logger,
+		lastSize: atomic.LoadUint64(&d.size),
+		lastTick: time.Now(),
+	}
+
+	if d.Adaptive {
+		c.limit = min(initialAdaptiveConcurrency, concurrency)
+		c.min = min(minAdaptiveConcurrency, concurrency)
+	}
+	return c
+}
+
+// reportError is called by the chunk downloads on errors and throttling responses, it's safe for concurrent use.
+func (c *concurrencyController) reportError() {
+	atomic.AddInt32(&c.errors, 1)
+}
+
+// adjust halves the concurrency if there were errors since the last adjustment (multiplicative decrease),
+// and raises it while the aggregate throughput keeps improving.
+func (c *concurrencyController) adjust(size uint64) {
+	now := time.Now()
+	throughput := float64(size-c.lastSize) / now.Sub(c.lastTick).Seconds()
+	c.lastSize, c.lastTick = size, now
+
+	if !c.adaptive {
+		return
+	}
+
+	limit := c.limit
+	if atomic.SwapInt32(&c.errors, 0) > 0 {
+		limit = max(c.min, c.limit/2)
+		// Ramping up starts again from the throughput measured at the lower concurrency
+		throughput = 0
+	} else if throughput > c.lastThroughput*throughputGain {
+		limit = min(c.max, c.limit+max(1, c.limit/2))
+	}
+	c.lastThroughput = throughput
+
+	if limit != c.limit {
+		c.logger.Debugf("Adjusting download concurrency from %d to %d", c.limit, limit)
+		c.limit = limit
+	}
+}
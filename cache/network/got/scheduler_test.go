@@ -0,0 +1,112 @@
+package got
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNewConcurrencyController(t *testing.T) {
+	tests := []struct {
+		name        string
+		adaptive    bool
+		concurrency uint
+		wantLimit   int
+		wantMin     int
+	}{
+		{name: "fixed concurrency", adaptive: false, concurrency: 16, wantLimit: 16, wantMin: 16},
+		{name: "adaptive starts low", adaptive: true, concurrency: 16, wantLimit: initialAdaptiveConcurrency, wantMin: minAdaptiveConcurrency},
+		{name: "adaptive below the initial concurrency", adaptive: true, concurrency: 3, wantLimit: 3, wantMin: minAdaptiveConcurrency},
+		{name: "adaptive with a single connection", adaptive: true, concurrency: 1, wantLimit: 1, wantMin: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newConcurrencyController(&Download{Adaptive: tt.adaptive, Concurrency: tt.concurrency, Logger: discardLogger{}})
+			if c.limit != tt.wantLimit || c.min != tt.wantMin || c.max != int(tt.concurrency) {
+				t.Errorf("limit = %d, min = %d, max = %d, want %d, %d, %d", c.limit, c.min, c.max, tt.wantLimit, tt.wantMin, tt.concurrency)
+			}
+		})
+	}
+}
+
+func TestConcurrencyControllerAdjust(t *testing.T) {
+	const mb = 1024 * 1024
+	tests := []struct {
+		name     string
+		adaptive bool
+		limit    int
+		// lastThroughput is the throughput measured at the previous adjustment, throughput is the current one (bytes/s)
+		lastThroughput float64
+		throughput     uint64
+		errors         int32
+		wantLimit      int
+	}{
+		{name: "fixed concurrency", adaptive: false, limit: 8, lastThroughput: mb, throughput: 10 * mb, wantLimit: 8},
+		{name: "improving throughput ramps up", adaptive: true, limit: 4, lastThroughput: mb, throughput: 2 * mb, wantLimit: 6},
+		{name: "ramp up stops at the maximum", adaptive: true, limit: 14, lastThroughput: mb, throughput: 2 * mb, wantLimit: 16},
+		{name: "flat throughput keeps the concurrency", adaptive: true, limit: 8, lastThroughput: 2 * mb, throughput: 2 * mb, wantLimit: 8},
+		{name: "errors halve the concurrency", adaptive: true, limit: 8, lastThroughput: mb, throughput: 2 * mb, errors: 1, wantLimit: 4},
+		{name: "back off stops at the minimum", adaptive: true, limit: 3, lastThroughput: mb, throughput: mb, errors: 3, wantLimit: minAdaptiveConcurrency},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &concurrencyController{
+				adaptive:       tt.adaptive,
+				limit:          tt.limit,
+				min:            minAdaptiveConcurrency,
+				max:            16,
+				logger:         discardLogger{},
+				errors:         tt.errors,
+				lastTick:       time.Now().Add(-time.Second),
+				lastThroughput: tt.lastThroughput,
+			}
+			c.adjust(tt.throughput)
+
+			if c.limit != tt.wantLimit {
+				t.Errorf("limit = %d, want %d", c.limit, tt.wantLimit)
+			}
+			if c.errors != 0 && tt.adaptive {
+				t.Errorf("errors were not reset")
+			}
+		})
+	}
+}
+
+func TestConcurrencyControllerRampsUpAgainAfterBackOff(t *testing.T) {
+	c := &concurrencyController{adaptive: true, limit: 8, min: minAdaptiveConcurrency, max: 16, logger: discardLogger{}}
+	c.lastTick = time.Now().Add(-time.Second)
+	c.lastThroughput = 100
+	c.reportError()
+	c.adjust(1000)
+	if c.limit != 4 {
+		t.Fatalf("limit after an error = %d, want 4", c.limit)
+	}
+
+	// The throughput measured at the lower concurrency is the new baseline
+	c.lastTick = time.Now().Add(-time.Second)
+	c.adjust(1500)
+	if c.limit != 6 {
+		t.Errorf("limit after the back off = %d, want 6", c.limit)
+	}
+}
+
+func TestSplitLargestChunk(t *testing.T) {
+	small := &Chunk{Start: 0, End: 99}
+	large := &Chunk{Start: 100, End: 499, Done: 100}
+	d := &Download{Adaptive: true, MinSplitSize: 10, Logger: discardLogger{}, chunks: []*Chunk{small, large}}
+
+	stolen := d.splitLargestChunk(map[*Chunk]bool{small: true, large: true})
+	if stolen == nil {
+		t.Fatal("splitLargestChunk() = nil, want a new chunk")
+	}
+	if stolen.Start != 350 || stolen.End != 499 || large.End != 349 {
+		t.Errorf("split %d-%d from the largest chunk (now ends at %d), want 350-499 and 349", stolen.Start, stolen.End, large.End)
+	}
+	if len(d.chunks) != 3 || d.chunks[2] != stolen {
+		t.Errorf("the new chunk was not added to the chunk list")
+	}
+
+	d.Adaptive = false
+	if stolen := d.splitLargestChunk(map[*Chunk]bool{large: true}); stolen != nil {
+		t.Errorf("splitLargestChunk() split a chunk without the adaptive scheduler")
+	}
+}
@@ -0,0 +1,24 @@
+package network
+
+import (
+	"context"
+	"io"
+
+	"github.com/bitrise-io/go-utils/v2/log"
+)
+
+// Downloader ...
+type Downloader interface {
+	Download(context.Context, DownloadParams, log.Logger) (ArchiveInfo, error)
+}
+
+// ArchiveLookup finds the archive matching the keys of DownloadParams without downloading it.
+type ArchiveLookup interface {
+	Lookup(context.Context, DownloadParams, log.Logger) (ArchiveInfo, error)
+}
+
+// StreamDownloader ...
+type StreamDownloader interface {
+	ArchiveLookup
+	DownloadStream(context.Context, ArchiveInfo, DownloadParams, io.Writer, log.Logger) error
+}
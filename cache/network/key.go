@@ -0,0 +1,42 @@
+package network
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// ShortenKey returns the key unchanged if it fits in MaxKeyLength bytes. A longer key is cut at a UTF-8 character
+// boundary and suffixed with `-` and the hex-encoded SHA-256 hash of the whole key, so that the result is at most
+// MaxKeyLength bytes and two distinct long keys don't end up the same. The Save Cache Step shortens keys the same way,
+// so both Steps agree on the final key byte-for-byte.
+func ShortenKey(key string) string {
+	if len(key) <= MaxKeyLength {
+		return key
+	}
+
+	hash := sha256.Sum256([]byte(key))
+	suffix := "-" + hex.EncodeToString(hash[:])
+	cut := MaxKeyLength - len(suffix)
+	for cut > 0 && !utf8.RuneStart(key[cut]) {
+		cut--
+	}
+	return key[:cut] + suffix
+}
+
+// ValidateKey returns an error if the key can't be used with any of the storage backends.
+func ValidateKey(key string) error {
+	switch {
+	case key == "":
+		// An empty key would prefix match every archive
+		return fmt.Errorf("the key is empty")
+	case strings.Contains(key, ","):
+		return fmt.Errorf("commas are not allowed in keys")
+	case !utf8.ValidString(key):
+		return fmt.Errorf("the key is not valid UTF-8")
+	default:
+		return nil
+	}
+}
@@ -0,0 +1,81 @@
+package network
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/url"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestShortenKey(t *testing.T) {
+	long := strings.Repeat("gradle-cache-", 50)
+	tests := []struct {
+		name string
+		key  string
+		// wantPrefix is the part of the key kept before the hash suffix, the whole key if it's not shortened
+		wantPrefix string
+	}{
+		{name: "short key", key: "npm-cache-main"},
+		{name: "key of the maximum length", key: strings.Repeat("a", MaxKeyLength)},
+		{name: "long key", key: long, wantPrefix: long[:MaxKeyLength-65]},
+		{
+			// The cut at 447 bytes falls into the middle of the 2-byte é characters
+			name:       "long key of multibyte characters",
+			key:        "kk" + strings.Repeat("é", 300),
+			wantPrefix: "kk" + strings.Repeat("é", 222),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := ShortenKey(tt.key)
+			if tt.wantPrefix == "" {
+				if got != tt.key {
+					t.Errorf("ShortenKey() = %s, want the key unchanged", got)
+				}
+				return
+			}
+
+			hash := sha256.Sum256([]byte(tt.key))
+			if want := tt.wantPrefix + "-" + hex.EncodeToString(hash[:]); got != want {
+				t.Errorf("ShortenKey() = %s, want %s", got, want)
+			}
+			if len(got) > MaxKeyLength {
+				t.Errorf("shortened key is %d bytes, longer than %d", len(got), MaxKeyLength)
+			}
+			if !utf8.ValidString(got) {
+				t.Errorf("shortened key is not valid UTF-8: %q", got)
+			}
+			if ShortenKey(got) != got {
+				t.Errorf("shortening the shortened key changed it")
+			}
+		})
+	}
+}
+
+func TestShortenKeyKeepsLongKeysDistinct(t *testing.T) {
+	common := strings.Repeat("x", 2*MaxKeyLength)
+	first, second := ShortenKey(common+"-first"), ShortenKey(common+"-second")
+	if first == second {
+		t.Errorf("long keys with the same first %d bytes were shortened to the same key: %s", len(common), first)
+	}
+	if ShortenKey(common+"-first") != first {
+		t.Errorf("ShortenKey() is not deterministic")
+	}
+}
+
+func TestValidateKeysSendsShortenedKeys(t *testing.T) {
+	long := strings.Repeat("ü", MaxKeyLength)
+	query, err := validateKeys([]string{"short", long})
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := url.QueryUnescape(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "short," + ShortenKey(long); keys != want {
+		t.Errorf("keys in the query = %s, want %s", keys, want)
+	}
+}
@@ -0,0 +1,293 @@
+package network
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/bitrise-io/go-utils/v2/log"
+)
+
+// staleTempFileAge is the age after which temporary files of interrupted downloads are removed from the store.
+const staleTempFileAge = 24 * time.Hour
+
+// localStore is an archive store on the local disk, shared by the builds running on the same host.
+// Entries are keyed by the matched cache key and the archive checksum, so an entry is never reused for a different archive.
+// The least recently used entries are evicted once the store grows over maxSize.
+// Every change to the store happens while holding an exclusive lock on a lock file, so concurrent builds can share it safely.
+type localStore struct {
+	dir     string
+	maxSize int64
+	logger  log.Logger
+}
+
+func newLocalStore(dir string, maxSize int64, logger log.Logger) (*localStore, error) {
+	store := &localStore{dir: dir, maxSize: maxSize, logger: logger}
+	for _, d := range []string{store.entriesDir(), store.tempDir()} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			return nil, fmt.Errorf("create local cache directory: %w", err)
+		}
+	}
+	return store, nil
+}
+
+func (s *localStore) entriesDir() string {
+	return filepath.Join(s.dir, "entries")
+}
+
+func (s *localStore) tempDir() string {
+	return filepath.Join(s.dir, "tmp")
+}
+
+func (s *localStore) entryPath(archive ArchiveInfo) string {
+	keyHash := sha256.Sum256([]byte(archive.MatchedKey))
+	name := fmt.Sprintf("%s-%s.tzst", hex.EncodeToString(keyHash[:8]), strings.ToLower(archive.Checksum))
+	return filepath.Join(s.entriesDir(), name)
+}
+
+func (s *localStore) withLock(fn func() error) error {
+	lock, err := os.OpenFile(filepath.Join(s.dir, "lock"), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return fmt.Errorf("open local cache lock: %w", err)
+	}
+	defer lock.Close() //nolint:errcheck
+
+	if err := lockFile(lock); err != nil {
+		return fmt.Errorf("lock local cache: %w", err)
+	}
+	defer unlockFile(lock) //nolint:errcheck
+
+	return fn()
+}
+
+// contains reports whether the store has an entry for the archive.
+func (s *localStore) contains(archive ArchiveInfo) bool {
+	if archive.Checksum == "" {
+		return false
+	}
+	info, err := os.Stat(s.entryPath(archive))
+	return err == nil && (archive.Size == 0 || info.Size() == archive.Size)
+}
+
+// open returns the stored archive, or nil if the store has no intact entry for it.
+// The entry is verified against the archive checksum on every use, a corrupted or tampered entry is removed.
+// The returned file stays readable even if the entry is evicted by another build in the meantime.
+func (s *localStore) open(archive ArchiveInfo) (*os.File, error) {
+	if archive.Checksum == "" {
+		return nil, nil
+	}
+
+	file, err := s.openEntry(archive)
+	if err != nil || file == nil {
+		return nil, err
+	}
+
+	// The entry is hashed without holding the lock, so other builds can use the store in the meantime
+	if err := verifyEntry(file, archive); err != nil {
+		info, statErr := file.Stat()
+		file.Close() //nolint:errcheck
+		if !errors.Is(err, ErrIntegrityCheckFailed) {
+			return nil, err
+		}
+		if statErr != nil {
+			return nil, statErr
+		}
+		s.logger.Warnf("Removing corrupted local cache entry %s: %s", file.Name(), err)
+		return nil, s.remove(file.Name(), info)
+	}
+	return file, nil
+}
+
+func (s *localStore) openEntry(archive ArchiveInfo) (*os.File, error) {
+	var file *os.File
+	err := s.withLock(func() error {
+		path := s.entryPath(archive)
+		f, err := os.Open(path)
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		info, err := f.Stat()
+		if err != nil {
+			f.Close() //nolint:errcheck
+			return err
+		}
+		if archive.Size > 0 && info.Size() != archive.Size {
+			f.Close() //nolint:errcheck
+			s.logger.Warnf("Removing corrupted local cache entry %s", path)
+			return os.Remove(path)
+		}
+
+		// The mtime of the entries tracks their last use for the LRU eviction
+		now := time.Now()
+		if err := os.Chtimes(path, now, now); err != nil {
+			s.logger.Debugf("Failed to update the last use of %s: %s", path, err)
+		}
+		file = f
+		return nil
+	})
+	return file, err
+}
+
+// verifyEntry checks the opened entry against the archive size and checksum, and rewinds it.
+func verifyEntry(file *os.File, archive ArchiveInfo) error {
+	hash := sha256.New()
+	size, err := io.Copy(hash, file)
+	if err != nil {
+		return fmt.Errorf("read local cache entry: %w", err)
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("read local cache entry: %w", err)
+	}
+	return checkIntegrity(size, hex.EncodeToString(hash.Sum(nil)), archive)
+}
+
+// remove removes the entry at path from the store, unless another build has replaced it since it was opened.
+func (s *localStore) remove(path string, opened fs.FileInfo) error {
+	return s.withLock(func() error {
+		current, err := os.Stat(path)
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if !os.SameFile(current, opened) {
+			return nil
+		}
+		return os.Remove(path)
+	})
+}
+
+// copyTo copies the stored archive to dest. It returns false if the store has no intact entry for the archive.
+func (s *localStore) copyTo(archive ArchiveInfo, dest string) (bool, error) {
+	file, err := s.open(archive)
+	if err != nil || file == nil {
+		return false, err
+	}
+	defer file.Close() //nolint:errcheck
+
+	// A hard link is free, but it only works if the store is on the same volume as dest
+	if err := os.Link(file.Name(), dest); err == nil {
+		return true, nil
+	}
+
+	destFile, err := os.Create(dest)
+	if err != nil {
+		return false, err
+	}
+	if _, err := io.Copy(destFile, file); err != nil {
+		destFile.Close() //nolint:errcheck
+		return false, err
+	}
+	return true, destFile.Close()
+}
+
+// createTemp creates a file in the store directory, which can be moved into the store by add.
+func (s *localStore) createTemp() (*os.File, error) {
+	return os.CreateTemp(s.tempDir(), "archive-*.tzst")
+}
+
+// addFile copies the verified archive at path into the store.
+func (s *localStore) addFile(path string, archive ArchiveInfo) error {
+	tempFile, err := s.createTemp()
+	if err != nil {
+		return err
+	}
+	tempPath := tempFile.Name()
+	defer os.Remove(tempPath) //nolint:errcheck
+
+	source, err := os.Open(path)
+	if err != nil {
+		tempFile.Close() //nolint:errcheck
+		return err
+	}
+	defer source.Close() //nolint:errcheck
+
+	if _, err := io.Copy(tempFile, source); err != nil {
+		tempFile.Close() //nolint:errcheck
+		return err
+	}
+	if err := tempFile.Close(); err != nil {
+		return err
+	}
+	return s.add(tempPath, archive)
+}
+
+// add moves the verified archive at tempPath (created by createTemp) into the store,
+// then evicts the least recently used entries over the size budget.
+func (s *localStore) add(tempPath string, archive ArchiveInfo) error {
+	if archive.Checksum == "" {
+		return fmt.Errorf("archive checksum is unknown")
+	}
+
+	return s.withLock(func() error {
+		if err := os.Rename(tempPath, s.entryPath(archive)); err != nil {
+			return fmt.Errorf("add archive to the local cache: %w", err)
+		}
+		s.logger.Debugf("Added archive to the local cache: %s", s.entryPath(archive))
+		s.removeStaleTempFiles()
+		return s.evict()
+	})
+}
+
+// evict removes the least recently used entries until the store fits into maxSize. The caller holds the lock.
+func (s *localStore) evict() error {
+	dirEntries, err := os.ReadDir(s.entriesDir())
+	if err != nil {
+		return err
+	}
+
+	var entries []fs.FileInfo
+	var totalSize int64
+	for _, dirEntry := range dirEntries {
+		info, err := dirEntry.Info()
+		if err != nil {
+			continue
+		}
+		entries = append(entries, info)
+		totalSize += info.Size()
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].ModTime().Before(entries[j].ModTime())
+	})
+
+	for _, entry := range entries {
+		if totalSize <= s.maxSize {
+			break
+		}
+		path := filepath.Join(s.entriesDir(), entry.Name())
+		if err := os.Remove(path); err != nil {
+			return fmt.Errorf("evict local cache entry: %w", err)
+		}
+		s.logger.Debugf("Evicted least recently used local cache entry %s", entry.Name())
+		totalSize -= entry.Size()
+	}
+	return nil
+}
+
+func (s *localStore) removeStaleTempFiles() {
+	tempEntries, err := os.ReadDir(s.tempDir())
+	if err != nil {
+		return
+	}
+	for _, tempEntry := range tempEntries {
+		info, err := tempEntry.Info()
+		if err != nil || time.Since(info.ModTime()) < staleTempFileAge {
+			continue
+		}
+		os.Remove(filepath.Join(s.tempDir(), tempEntry.Name())) //nolint:errcheck
+	}
+}
@@ -0,0 +1,65 @@
+package network
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bitrise-io/go-utils/v2/log"
+)
+
+func TestLocalStoreVerifiesEntries(t *testing.T) {
+	content := []byte("archive content")
+	checksum := sha256.Sum256(content)
+	archive := ArchiveInfo{MatchedKey: "key", Checksum: hex.EncodeToString(checksum[:]), Size: int64(len(content))}
+
+	tests := []struct {
+		name string
+		// entry is the content of the stored entry
+		entry     []byte
+		wantFound bool
+	}{
+		{name: "intact entry", entry: content, wantFound: true},
+		{name: "corrupted entry of the same size", entry: []byte("archive CONTENT"), wantFound: false},
+		{name: "truncated entry", entry: content[:5], wantFound: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store, err := newLocalStore(t.TempDir(), 1024*1024, log.NewLogger())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(store.entryPath(archive), tt.entry, 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			dest := filepath.Join(t.TempDir(), "archive.tzst")
+			found, err := store.copyTo(archive, dest)
+			if err != nil {
+				t.Fatalf("copyTo() error = %s", err)
+			}
+			if found != tt.wantFound {
+				t.Fatalf("copyTo() found = %t, want %t", found, tt.wantFound)
+			}
+
+			_, statErr := os.Stat(store.entryPath(archive))
+			if tt.wantFound {
+				if statErr != nil {
+					t.Errorf("intact entry was removed: %s", statErr)
+				}
+				if got, err := os.ReadFile(dest); err != nil || string(got) != string(content) {
+					t.Errorf("copied archive = %q, %v, want %q", got, err, content)
+				}
+				return
+			}
+			if !os.IsNotExist(statErr) {
+				t.Errorf("corrupted entry was not removed")
+			}
+			if _, err := os.Stat(dest); !os.IsNotExist(err) {
+				t.Errorf("corrupted entry was copied to the download path")
+			}
+		})
+	}
+}
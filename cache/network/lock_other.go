@@ -0,0 +1,19 @@
+//go:build !linux && !darwin
+
+package network
+
+import "os"
+
+// The step only runs on Linux and macOS, the local cache isn't shared safely between builds on other platforms.
+
+func lockFile(file *os.File) error {
+	return nil
+}
+
+func unlockFile(file *os.File) error {
+	return nil
+}
+
+func tryLockFile(file *os.File) (bool, error) {
+	return true, nil
+}
@@ -0,0 +1,81 @@
+package network
+
+import (
+	"fmt"
+	"strings"
+)
+
+// MatchMode decides which archives a cache key matches.
+type MatchMode string
+
+const (
+	// MatchPrefix matches the archive saved with the same key, or else the newest archive saved with a key
+	// starting with the key. This is the default.
+	MatchPrefix MatchMode = "prefix"
+	// MatchExact only matches the archive saved with the same key.
+	MatchExact MatchMode = "exact"
+	// MatchDefaultBranch matches the newest archive saved by a build of the default branch, with a key starting
+	// with the key. Only the Bitrise cache API knows the branch of the archives.
+	MatchDefaultBranch MatchMode = "default-branch"
+)
+
+// ParseMatchMode returns an error if mode is not a known match mode. An empty mode is MatchPrefix.
+func ParseMatchMode(mode string) (MatchMode, error) {
+	switch MatchMode(mode) {
+	case "":
+		return MatchPrefix, nil
+	case MatchPrefix, MatchExact, MatchDefaultBranch:
+		return MatchMode(mode), nil
+	default:
+		return "", fmt.Errorf("unknown match mode: %s", mode)
+	}
+}
+
+// matchMode returns the match mode of the key at index i, modes can be shorter than the keys.
+func matchMode(modes []MatchMode, i int) MatchMode {
+	if i < len(modes) && modes[i] != "" {
+		return modes[i]
+	}
+	return MatchPrefix
+}
+
+// hasNonDefaultMatchMode returns true if any of the keys uses a match mode other than MatchPrefix.
+func hasNonDefaultMatchMode(modes []MatchMode) bool {
+	for i := range modes {
+		if matchMode(modes, i) != MatchPrefix {
+			return true
+		}
+	}
+	return false
+}
+
+// MatchingKeyIndex returns the index of the first key that matches matchedKey according to its match mode,
+// or -1 if none of them does.
+func MatchingKeyIndex(matchedKey string, keys []string, modes []MatchMode) int {
+	for i, key := range keys {
+		if matchMode(modes, i) == MatchExact {
+			if matchedKey == key {
+				return i
+			}
+			continue
+		}
+		if strings.HasPrefix(matchedKey, key) {
+			return i
+		}
+	}
+	return -1
+}
+
+// ValidateMatchModes returns an error if a match mode is unknown, or not supported by the storage backend.
+func ValidateMatchModes(modes []MatchMode, storage StorageConfig) error {
+	for _, mode := range modes {
+		mode, err := ParseMatchMode(string(mode))
+		if err != nil {
+			return err
+		}
+		if mode == MatchDefaultBranch && storage.backend() != StorageBitrise {
+			return fmt.Errorf("match mode %s is not supported by the %s storage", mode, storage.backend())
+		}
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+package network
+
+import "testing"
+
+func TestMatchingKeyIndex(t *testing.T) {
+	keys := []string{"npm-main-abc", "npm-main-", "npm-"}
+	tests := []struct {
+		name       string
+		matchedKey string
+		modes      []MatchMode
+		want       int
+	}{
+		{name: "prefix keys", matchedKey: "npm-main-def", want: 1},
+		{name: "exact key", matchedKey: "npm-main-abc", modes: []MatchMode{MatchExact}, want: 0},
+		{name: "exact key doesn't match by prefix", matchedKey: "npm-main-abcd", modes: []MatchMode{MatchExact, MatchExact}, want: 2},
+		{name: "default branch key matches by prefix", matchedKey: "npm-develop", modes: []MatchMode{"", "", MatchDefaultBranch}, want: 2},
+		{name: "no match", matchedKey: "gradle-abc", want: -1},
+		{name: "no match with exact keys", matchedKey: "npm-main-abcd", modes: []MatchMode{MatchExact, MatchExact, MatchExact}, want: -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := MatchingKeyIndex(tt.matchedKey, keys, tt.modes); got != tt.want {
+				t.Errorf("MatchingKeyIndex() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateMatchModes(t *testing.T) {
+	tests := []struct {
+		name    string
+		modes   []MatchMode
+		storage StorageConfig
+		wantErr bool
+	}{
+		{name: "default modes", modes: []MatchMode{"", MatchPrefix, MatchExact}, storage: StorageConfig{Backend: StorageFilesystem, Path: "/cache"}},
+		{name: "default branch with the bitrise storage", modes: []MatchMode{MatchDefaultBranch}, storage: StorageConfig{}},
+		{name: "default branch with the filesystem storage", modes: []MatchMode{MatchDefaultBranch}, storage: StorageConfig{Backend: StorageFilesystem, Path: "/cache"}, wantErr: true},
+		{name: "default branch with the s3 storage", modes: []MatchMode{MatchDefaultBranch}, storage: StorageConfig{Backend: StorageS3}, wantErr: true},
+		{name: "unknown mode", modes: []MatchMode{"newest"}, storage: StorageConfig{}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := ValidateMatchModes(tt.modes, tt.storage); (err != nil) != tt.wantErr {
+				t.Errorf("ValidateMatchModes() error = %v, wantErr %t", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestHasNonDefaultMatchMode(t *testing.T) {
+	if hasNonDefaultMatchMode([]MatchMode{"", MatchPrefix}) {
+		t.Errorf("hasNonDefaultMatchMode() = true for prefix keys")
+	}
+	if !hasNonDefaultMatchMode([]MatchMode{MatchPrefix, MatchExact}) {
+		t.Errorf("hasNonDefaultMatchMode() = false with an exact key")
+	}
+}
@@ -0,0 +1,69 @@
+package network
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/bitrise-io/go-utils/v2/log"
+	"github.com/hashicorp/go-retryablehttp"
+)
+
+// preflight calls params.Preflight with the archive found by the lookup. The returned archive has the size
+// filled in if the storage didn't provide it, but the remote server told it.
+func preflight(ctx context.Context, httpClient *retryablehttp.Client, archive ArchiveInfo, params DownloadParams, logger log.Logger) (ArchiveInfo, error) {
+	if params.Preflight == nil {
+		return archive, nil
+	}
+
+	if archive.Size <= 0 {
+		size, err := probeSize(ctx, httpClient, archive.URL)
+		if err != nil {
+			logger.Debugf("Failed to get the archive size: %s", err)
+		}
+		archive.Size = size
+	}
+	return archive, params.Preflight(archive)
+}
+
+// probeSize returns the size of the remote file from the Content-Range of a single byte range request,
+// the same way the downloader learns it. It's zero if the server doesn't support range requests.
+func probeSize(ctx context.Context, httpClient *retryablehttp.Client, rawURL string) (int64, error) {
+	if file, isFileURL, err := openFileURL(rawURL); isFileURL {
+		if err != nil {
+			return 0, err
+		}
+		defer file.Close() //nolint:errcheck
+		info, err := file.Stat()
+		if err != nil {
+			return 0, err
+		}
+		return info.Size(), nil
+	}
+
+	req, err := retryablehttp.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Range", "bytes=0-0")
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close() //nolint:errcheck
+
+	if resp.StatusCode != http.StatusPartialContent {
+		return 0, fmt.Errorf("range request is not supported, status code: %d", resp.StatusCode)
+	}
+	_, total, found := strings.Cut(resp.Header.Get("Content-Range"), "/")
+	if !found {
+		return 0, fmt.Errorf("response has no valid Content-Range header")
+	}
+	size, err := strconv.ParseInt(total, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid Content-Range header: %w", err)
+	}
+	return size, nil
+}
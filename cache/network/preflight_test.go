@@ -0,0 +1,95 @@
+package network
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bitrise-io/go-utils/v2/log"
+	"github.com/bitrise-io/go-utils/v2/retryhttp"
+)
+
+func TestProbeSize(t *testing.T) {
+	content := bytes.Repeat([]byte("a"), 1234)
+	rangeServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "archive.tzst", time.Time{}, bytes.NewReader(content))
+	}))
+	defer rangeServer.Close()
+	noRangeServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(content) //nolint:errcheck
+	}))
+	defer noRangeServer.Close()
+
+	archivePath := filepath.Join(t.TempDir(), "archive.tzst")
+	if err := os.WriteFile(archivePath, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	fileURL := (&url.URL{Scheme: "file", Path: filepath.ToSlash(archivePath)}).String()
+
+	tests := []struct {
+		name    string
+		rawURL  string
+		want    int64
+		wantErr bool
+	}{
+		{name: "range request", rawURL: rangeServer.URL, want: int64(len(content))},
+		{name: "range requests not supported", rawURL: noRangeServer.URL, wantErr: true},
+		{name: "file URL", rawURL: fileURL, want: int64(len(content))},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := probeSize(context.Background(), retryhttp.NewClient(log.NewLogger()), tt.rawURL)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("probeSize() error = %v, wantErr %t", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("probeSize() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPreflight(t *testing.T) {
+	content := bytes.Repeat([]byte("a"), 1234)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "archive.tzst", time.Time{}, bytes.NewReader(content))
+	}))
+	defer server.Close()
+	httpClient := retryhttp.NewClient(log.NewLogger())
+
+	var checked ArchiveInfo
+	errTooLarge := errors.New("too large")
+	params := DownloadParams{Preflight: func(archive ArchiveInfo) error {
+		checked = archive
+		return errTooLarge
+	}}
+
+	// The size is looked up if the storage didn't provide it
+	archive, err := preflight(context.Background(), httpClient, ArchiveInfo{URL: server.URL}, params, log.NewLogger())
+	if !errors.Is(err, errTooLarge) {
+		t.Errorf("preflight() error = %v, want the error of the check", err)
+	}
+	if archive.Size != int64(len(content)) || checked.Size != int64(len(content)) {
+		t.Errorf("archive size = %d, checked size = %d, want %d", archive.Size, checked.Size, len(content))
+	}
+
+	// A known size is not looked up again
+	if _, err := preflight(context.Background(), httpClient, ArchiveInfo{URL: "http://127.0.0.1:0", Size: 42}, params, log.NewLogger()); !errors.Is(err, errTooLarge) {
+		t.Errorf("preflight() error = %v, want the error of the check", err)
+	}
+	if checked.Size != 42 {
+		t.Errorf("checked size = %d, want 42", checked.Size)
+	}
+
+	// Without a check, nothing is requested
+	if _, err := preflight(context.Background(), httpClient, ArchiveInfo{URL: "http://127.0.0.1:0"}, DownloadParams{}, log.NewLogger()); err != nil {
+		t.Errorf("preflight() error = %s", err)
+	}
+}
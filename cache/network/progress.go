@@ -0,0 +1,76 @@
+package network
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/bitrise-io/go-utils/v2/log"
+	"github.com/docker/go-units"
+)
+
+// logDownloadProgress prints a single progress line, it's meant to be readable in non-interactive CI logs too.
+// total is 0 if the archive size is unknown.
+func logDownloadProgress(logger log.Logger, done, total, avgSpeed uint64, activeChunks int) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Downloaded %s", humanSize(done))
+	if total > 0 {
+		fmt.Fprintf(&b, " of %s (%d%%)", humanSize(total), done*100/total)
+	}
+	fmt.Fprintf(&b, ", %s/s", humanSize(avgSpeed))
+	if total > done && avgSpeed > 0 {
+		eta := time.Duration(float64(total-done) / float64(avgSpeed) * float64(time.Second)).Round(time.Second)
+		fmt.Fprintf(&b, ", ETA %s", eta)
+	}
+	if activeChunks > 0 {
+		fmt.Fprintf(&b, ", %d active chunks", activeChunks)
+	}
+	logger.Printf("%s", b.String())
+}
+
+func humanSize(size uint64) string {
+	return units.HumanSizeWithPrecision(float64(size), 3)
+}
+
+// streamProgress counts the bytes written to the stream and reports the progress periodically.
+type streamProgress struct {
+	dest         io.Writer
+	written      uint64
+	activeChunks func() int
+}
+
+func (p *streamProgress) Write(b []byte) (int, error) {
+	n, err := p.dest.Write(b)
+	atomic.AddUint64(&p.written, uint64(n))
+	return n, err
+}
+
+// report logs the progress every interval until the returned function is called.
+func (p *streamProgress) report(interval time.Duration, total uint64, logger log.Logger) func() {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	startTime := time.Now()
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+
+			written := atomic.LoadUint64(&p.written)
+			avgSpeed := uint64(float64(written) / time.Since(startTime).Seconds())
+			logDownloadProgress(logger, written, total, avgSpeed, p.activeChunks())
+		}
+	}()
+
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
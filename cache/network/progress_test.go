@@ -0,0 +1,93 @@
+package network
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bitrise-io/go-utils/v2/log"
+)
+
+// recordingLogger records the Printf lines, the rest of the log goes to the standard logger.
+type recordingLogger struct {
+	log.Logger
+	mu    sync.Mutex
+	lines []string
+}
+
+func newRecordingLogger() *recordingLogger {
+	return &recordingLogger{Logger: log.NewLogger()}
+}
+
+func (l *recordingLogger) Printf(format string, v ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.lines = append(l.lines, fmt.Sprintf(format, v...))
+}
+
+func (l *recordingLogger) recorded() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]string(nil), l.lines...)
+}
+
+func TestLogDownloadProgress(t *testing.T) {
+	const mb = 1000 * 1000
+	tests := []struct {
+		name         string
+		done, total  uint64
+		avgSpeed     uint64
+		activeChunks int
+		want         string
+	}{
+		{
+			name: "known size", done: 25 * mb, total: 100 * mb, avgSpeed: 5 * mb, activeChunks: 4,
+			want: "Downloaded 25MB of 100MB (25%), 5MB/s, ETA 15s, 4 active chunks",
+		},
+		{
+			name: "unknown size", done: 25 * mb, avgSpeed: 5 * mb,
+			want: "Downloaded 25MB, 5MB/s",
+		},
+		{
+			name: "finished", done: 100 * mb, total: 100 * mb, avgSpeed: 5 * mb,
+			want: "Downloaded 100MB of 100MB (100%), 5MB/s",
+		},
+		{
+			name: "nothing downloaded yet", total: 100 * mb,
+			want: "Downloaded 0B of 100MB (0%), 0B/s",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logger := newRecordingLogger()
+			logDownloadProgress(logger, tt.done, tt.total, tt.avgSpeed, tt.activeChunks)
+			if got := logger.recorded(); len(got) != 1 || got[0] != tt.want {
+				t.Errorf("logged %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStreamProgressInterval(t *testing.T) {
+	logger := newRecordingLogger()
+	progress := &streamProgress{dest: io.Discard, activeChunks: func() int { return 0 }}
+
+	stop := progress.report(20*time.Millisecond, 0, logger)
+	if _, err := progress.Write(make([]byte, 1000)); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(110 * time.Millisecond)
+	stop()
+
+	lines := logger.recorded()
+	// 5 ticks are expected, a loaded machine can skip some of them
+	if len(lines) < 2 || len(lines) > 5 {
+		t.Errorf("logged %d progress lines in 110ms with a 20ms interval: %q", len(lines), lines)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if after := logger.recorded(); len(after) != len(lines) {
+		t.Errorf("progress was logged after the download finished: %q", after[len(lines):])
+	}
+}
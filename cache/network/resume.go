@@ -0,0 +1,169 @@
+package network
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// partialDownloadsDirName is the directory (inside the temp dir) of the archive downloads in progress.
+// The temp dir is kept for the whole build, so a re-run of the step can resume an interrupted download too.
+const partialDownloadsDirName = "restore-cache-downloads"
+
+// partialDownloadSuffix is the suffix of the downloads in progress. Their manifest and lock are named after them.
+const partialDownloadSuffix = ".tzst.part"
+
+// partialDownload is the stable download location of an archive. The path is derived from the matched key and
+// the archive checksum, so later download attempts of the same archive find the data downloaded earlier.
+type partialDownload struct {
+	path string
+	// lock is held until the download is finished, so concurrent downloads of the same archive (such as cache groups
+	// matching the same key) never write the same file, and the cleanup of other restores skips it.
+	lock *os.File
+	// resumable is false for the unique locations, nothing picks them up after a failure
+	resumable bool
+}
+
+// newPartialDownload returns the locked download location of the archive. If the same archive is being downloaded
+// by another cache group or process, a unique location is returned, which isn't resumed later.
+func newPartialDownload(archive ArchiveInfo) (partialDownload, error) {
+	dir := filepath.Join(os.TempDir(), partialDownloadsDirName)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return partialDownload{}, fmt.Errorf("create download directory: %w", err)
+	}
+	removeStalePartialDownloads(dir)
+
+	digest := strings.ToLower(archive.Checksum)
+	if digest == "" {
+		digest = "unknown"
+	}
+	keyHash := sha256.Sum256([]byte(archive.MatchedKey))
+	name := fmt.Sprintf("%s-%s", hex.EncodeToString(keyHash[:8]), digest)
+
+	partial, err := lockPartialDownload(filepath.Join(dir, name+partialDownloadSuffix))
+	if err != nil || partial.lock != nil {
+		partial.resumable = true
+		return partial, err
+	}
+
+	file, err := os.CreateTemp(dir, name+"-*"+partialDownloadSuffix)
+	if err != nil {
+		return partialDownload{}, fmt.Errorf("create download file: %w", err)
+	}
+	file.Close() //nolint:errcheck
+	partial, err = lockPartialDownload(file.Name())
+	if err == nil && partial.lock == nil {
+		err = fmt.Errorf("download file %s is locked", file.Name())
+	}
+	return partial, err
+}
+
+// lockPartialDownload locks the download at path. The returned lock is nil if the download is locked by someone else.
+func lockPartialDownload(path string) (partialDownload, error) {
+	lockPath := path + ".lock"
+	lock, err := os.OpenFile(lockPath, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return partialDownload{}, fmt.Errorf("open download lock: %w", err)
+	}
+	locked, err := tryLockFile(lock)
+	if err != nil || !locked {
+		lock.Close() //nolint:errcheck
+		if err != nil {
+			return partialDownload{}, fmt.Errorf("lock download: %w", err)
+		}
+		return partialDownload{path: path}, nil
+	}
+
+	// The lock file is removed on release, a lock taken on a file removed in the meantime doesn't count
+	lockInfo, err := lock.Stat()
+	if err != nil {
+		lock.Close() //nolint:errcheck
+		return partialDownload{}, fmt.Errorf("lock download: %w", err)
+	}
+	if pathInfo, err := os.Stat(lockPath); err != nil || !os.SameFile(lockInfo, pathInfo) {
+		lock.Close() //nolint:errcheck
+		return partialDownload{path: path}, nil
+	}
+	return partialDownload{path: path, lock: lock}, nil
+}
+
+// release removes the lock file and releases the lock, the download can be taken over by others from then on.
+func (p partialDownload) release() {
+	if p.lock == nil {
+		return
+	}
+	os.Remove(p.lock.Name()) //nolint:errcheck
+	unlockFile(p.lock)       //nolint:errcheck
+	p.lock.Close()           //nolint:errcheck
+}
+
+// manifestPath is the sidecar file holding the chunk progress of the download.
+func (p partialDownload) manifestPath() string {
+	return p.path + ".json"
+}
+
+// moveTo moves the completed download to dest.
+func (p partialDownload) moveTo(dest string) error {
+	if err := os.Rename(p.path, dest); err == nil {
+		return nil
+	}
+
+	// The temp dir and dest can be on different filesystems
+	source, err := os.Open(p.path)
+	if err != nil {
+		return err
+	}
+	defer source.Close() //nolint:errcheck
+
+	destFile, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(destFile, source); err != nil {
+		destFile.Close() //nolint:errcheck
+		return err
+	}
+	if err := destFile.Close(); err != nil {
+		return err
+	}
+	return os.Remove(p.path)
+}
+
+// remove discards the download, the next attempt starts from scratch.
+func (p partialDownload) remove() {
+	os.Remove(p.path)           //nolint:errcheck
+	os.Remove(p.manifestPath()) //nolint:errcheck
+}
+
+// removeStalePartialDownloads cleans up the downloads that were interrupted and never resumed.
+// Downloads locked by other restores are kept, even if they are resumed from an old file.
+func removeStalePartialDownloads(dir string) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || time.Since(info.ModTime()) < staleTempFileAge {
+			continue
+		}
+
+		path := filepath.Join(dir, entry.Name())
+		// The manifest, its temp files and the lock belong to the download they are named after
+		downloadPath := path
+		if i := strings.Index(path, partialDownloadSuffix); i >= 0 {
+			downloadPath = path[:i+len(partialDownloadSuffix)]
+		}
+		partial, err := lockPartialDownload(downloadPath)
+		if err != nil || partial.lock == nil {
+			continue
+		}
+		os.Remove(path) //nolint:errcheck
+		partial.release()
+	}
+}
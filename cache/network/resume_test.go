@@ -0,0 +1,85 @@
+//go:build linux || darwin
+
+package network
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPartialDownloadOfConcurrentRestores(t *testing.T) {
+	t.Setenv("TMPDIR", t.TempDir())
+	archive := ArchiveInfo{MatchedKey: "key", Checksum: "ABC"}
+
+	first, err := newPartialDownload(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := newPartialDownload(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.path == second.path {
+		t.Errorf("concurrent downloads of the same archive share %s", first.path)
+	}
+	if first.lock == nil || second.lock == nil {
+		t.Errorf("downloads are not locked")
+	}
+	if !first.resumable || second.resumable {
+		t.Errorf("resumable = %t, %t, want only the first download to be resumable", first.resumable, second.resumable)
+	}
+	second.release()
+
+	// Once released, the next attempt resumes the stable location
+	first.release()
+	third, err := newPartialDownload(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer third.release()
+	if third.path != first.path {
+		t.Errorf("path after release = %s, want %s", third.path, first.path)
+	}
+}
+
+func TestRemoveStalePartialDownloadsKeepsLockedDownloads(t *testing.T) {
+	t.Setenv("TMPDIR", t.TempDir())
+
+	locked, err := newPartialDownload(ArchiveInfo{MatchedKey: "locked"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer locked.release()
+	stale, err := newPartialDownload(ArchiveInfo{MatchedKey: "stale"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.release()
+
+	old := time.Now().Add(-2 * staleTempFileAge)
+	for _, path := range []string{locked.path, locked.manifestPath(), stale.path, stale.manifestPath()} {
+		if err := os.WriteFile(path, []byte("partial"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	removeStalePartialDownloads(filepath.Dir(locked.path))
+
+	for _, path := range []string{locked.path, locked.manifestPath()} {
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("download in progress was removed: %s", err)
+		}
+	}
+	for _, path := range []string{stale.path, stale.manifestPath(), stale.path + ".lock"} {
+		if _, err := os.Stat(path); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("stale %s was not removed: %v", path, err)
+		}
+	}
+}
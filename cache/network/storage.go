@@ -0,0 +1,92 @@
+package network
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/bitrise-io/go-utils/v2/log"
+	"github.com/hashicorp/go-retryablehttp"
+)
+
+// archiveExtension is the file extension of the archives stored by the S3 and filesystem backends.
+// The archive of the `my-key` cache key is stored as `my-key.tzst`.
+const archiveExtension = ".tzst"
+
+// StorageBackend is the storage the cache archives are restored from.
+type StorageBackend string
+
+const (
+	// StorageBitrise is the Bitrise cache API (BITRISEIO_ABCS_API_URL)
+	StorageBitrise StorageBackend = "bitrise"
+	// StorageS3 is an S3-compatible object storage
+	StorageS3 StorageBackend = "s3"
+	// StorageFilesystem is a directory, such as a network share mounted on every build machine
+	StorageFilesystem StorageBackend = "filesystem"
+)
+
+// StorageConfig selects and configures the storage backend. The zero value is the Bitrise cache API.
+type StorageConfig struct {
+	Backend StorageBackend
+	// Path is `bucket/optional/prefix` for S3 and the root directory for the filesystem backend
+	Path string
+	// S3Endpoint is the base URL of the S3-compatible API. Defaults to AWS S3 in S3Region.
+	S3Endpoint        string
+	S3Region          string
+	S3AccessKeyID     string
+	S3SecretAccessKey string
+	S3SessionToken    string
+}
+
+func (c StorageConfig) backend() StorageBackend {
+	if c.Backend == "" {
+		return StorageBitrise
+	}
+	return c.Backend
+}
+
+// ValidateStorageConfig returns an error if the storage backend is unknown or misses required settings.
+func ValidateStorageConfig(config StorageConfig) error {
+	switch config.backend() {
+	case StorageBitrise:
+		return nil
+	case StorageS3:
+		if config.Path == "" {
+			return fmt.Errorf("S3 storage needs a bucket name")
+		}
+		if config.S3AccessKeyID == "" || config.S3SecretAccessKey == "" {
+			return fmt.Errorf("S3 storage needs an access key ID and a secret access key")
+		}
+		return nil
+	case StorageFilesystem:
+		if config.Path == "" {
+			return fmt.Errorf("filesystem storage needs a directory")
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown storage backend: %s", config.Backend)
+	}
+}
+
+// resolveArchive finds the archive of the first key with a match in the configured storage.
+// Keys match archives saved with the same key first, then (unless the key's match mode is MatchExact)
+// the newest archive saved with a key starting with the key.
+// If there is no match for any of the keys, the error is ErrCacheNotFound.
+func resolveArchive(ctx context.Context, httpClient *retryablehttp.Client, params DownloadParams, logger log.Logger) (ArchiveInfo, error) {
+	switch params.Storage.backend() {
+	case StorageS3:
+		client, err := newS3Client(httpClient, params.Storage)
+		if err != nil {
+			return ArchiveInfo{}, err
+		}
+		return client.resolve(ctx, params.CacheKeys, params.MatchModes)
+	case StorageFilesystem:
+		return filesystemStorage{dir: params.Storage.Path}.resolve(params.CacheKeys, params.MatchModes)
+	default:
+		client := newAPIClient(httpClient, params.APIBaseURL, params.Token, logger)
+		restoreResponse, err := client.restore(ctx, params.CacheKeys, params.MatchModes)
+		if err != nil {
+			return ArchiveInfo{}, err
+		}
+		return archiveInfo(restoreResponse), nil
+	}
+}
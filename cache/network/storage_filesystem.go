@@ -0,0 +1,118 @@
+package network
+
+import (
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// filesystemStorage restores archives from a directory. The archive of a key is stored at `<dir>/<key>.tzst`.
+type filesystemStorage struct {
+	dir string
+}
+
+func (s filesystemStorage) resolve(keys []string, modes []MatchMode) (ArchiveInfo, error) {
+	if _, err := os.Stat(s.dir); err != nil {
+		return ArchiveInfo{}, err
+	}
+
+	for i, key := range keys {
+		path := s.archivePath(key)
+		if info, err := os.Stat(path); err == nil && info.Mode().IsRegular() {
+			return s.archiveInfo(key, path, info), nil
+		}
+		if matchMode(modes, i) == MatchExact {
+			continue
+		}
+
+		matchedKey, path, info, err := s.newestWithPrefix(key)
+		if err != nil {
+			return ArchiveInfo{}, err
+		}
+		if info != nil {
+			return s.archiveInfo(matchedKey, path, info), nil
+		}
+	}
+	return ArchiveInfo{}, ErrCacheNotFound
+}
+
+func (s filesystemStorage) archivePath(key string) string {
+	return filepath.Join(s.dir, filepath.FromSlash(key)+archiveExtension)
+}
+
+func (s filesystemStorage) archiveInfo(key, path string, info fs.FileInfo) ArchiveInfo {
+	return ArchiveInfo{
+		URL:        (&url.URL{Scheme: "file", Path: filepath.ToSlash(path)}).String(),
+		MatchedKey: key,
+		Size:       info.Size(),
+	}
+}
+
+// newestWithPrefix returns the most recently modified archive saved with a key starting with prefix.
+func (s filesystemStorage) newestWithPrefix(prefix string) (string, string, fs.FileInfo, error) {
+	var newestKey, newestPath string
+	var newestInfo fs.FileInfo
+	err := filepath.WalkDir(s.dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(s.dir, path)
+		if err != nil {
+			return err
+		}
+		relPath = filepath.ToSlash(relPath)
+
+		if entry.IsDir() {
+			// Only descend into directories that can contain keys with the prefix
+			if relPath != "." && !strings.HasPrefix(prefix, relPath+"/") && !strings.HasPrefix(relPath, prefix) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !entry.Type().IsRegular() || !strings.HasPrefix(relPath, prefix) || !strings.HasSuffix(relPath, archiveExtension) {
+			return nil
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		if newestInfo == nil || info.ModTime().After(newestInfo.ModTime()) {
+			newestKey, newestPath, newestInfo = strings.TrimSuffix(relPath, archiveExtension), path, info
+		}
+		return nil
+	})
+	return newestKey, newestPath, newestInfo, err
+}
+
+// openFileURL opens the archive if rawURL is a `file://` URL of the filesystem backend.
+func openFileURL(rawURL string) (*os.File, bool, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Scheme != "file" {
+		return nil, false, nil
+	}
+	file, err := os.Open(filepath.FromSlash(u.Path))
+	return file, true, err
+}
+
+// copyFileURL copies the archive at the `file://` URL to dest. It returns false if rawURL is not a file URL.
+func copyFileURL(rawURL string, dest string) (bool, error) {
+	file, isFileURL, err := openFileURL(rawURL)
+	if !isFileURL || err != nil {
+		return isFileURL, err
+	}
+	defer file.Close() //nolint:errcheck
+
+	destFile, err := os.Create(dest)
+	if err != nil {
+		return true, err
+	}
+	if _, err := io.Copy(destFile, file); err != nil {
+		destFile.Close() //nolint:errcheck
+		return true, err
+	}
+	return true, destFile.Close()
+}
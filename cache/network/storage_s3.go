@@ -0,0 +1,301 @@
+package network
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/go-retryablehttp"
+)
+
+const (
+	s3DefaultRegion = "us-east-1"
+	// s3URLExpiry is the validity of the presigned URLs, it has to cover the whole download
+	s3URLExpiry = 6 * time.Hour
+	// s3ChecksumMetadata is the object metadata holding the SHA-256 checksum of the archive, if set at upload
+	s3ChecksumMetadata = "X-Amz-Meta-Archive-Checksum"
+	// s3UncompressedSizeMetadata is the object metadata holding the total size of the archive content, if set at upload
+	s3UncompressedSizeMetadata = "X-Amz-Meta-Uncompressed-Size"
+)
+
+// s3Client restores archives from an S3-compatible object storage. The archive of a key is stored
+// as the `<prefix>/<key>.tzst` object. Requests are authenticated with presigned URLs (AWS Signature Version 4),
+// so the archive itself is downloaded with the same parallel downloader as the Bitrise cache archives.
+type s3Client struct {
+	httpClient *retryablehttp.Client
+	endpoint   *url.URL
+	// pathStyle addresses the bucket in the URL path instead of the host name, custom endpoints (such as MinIO) need it
+	pathStyle       bool
+	region          string
+	bucket          string
+	prefix          string
+	accessKeyID     string
+	secretAccessKey string
+	sessionToken    string
+	now             func() time.Time
+}
+
+type s3Object struct {
+	Key          string    `xml:"Key"`
+	LastModified time.Time `xml:"LastModified"`
+	Size         int64     `xml:"Size"`
+}
+
+type s3ListResult struct {
+	Contents              []s3Object `xml:"Contents"`
+	IsTruncated           bool       `xml:"IsTruncated"`
+	NextContinuationToken string     `xml:"NextContinuationToken"`
+}
+
+func newS3Client(httpClient *retryablehttp.Client, config StorageConfig) (s3Client, error) {
+	bucket, prefix, _ := strings.Cut(strings.Trim(config.Path, "/"), "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+
+	region := config.S3Region
+	if region == "" {
+		region = s3DefaultRegion
+	}
+
+	rawEndpoint := config.S3Endpoint
+	pathStyle := rawEndpoint != ""
+	if rawEndpoint == "" {
+		rawEndpoint = fmt.Sprintf("https://s3.%s.amazonaws.com", region)
+	}
+	endpoint, err := url.Parse(strings.TrimSuffix(rawEndpoint, "/"))
+	if err != nil || endpoint.Host == "" {
+		return s3Client{}, fmt.Errorf("invalid S3 endpoint: %s", rawEndpoint)
+	}
+
+	return s3Client{
+		httpClient:      httpClient,
+		endpoint:        endpoint,
+		pathStyle:       pathStyle,
+		region:          region,
+		bucket:          bucket,
+		prefix:          prefix,
+		accessKeyID:     config.S3AccessKeyID,
+		secretAccessKey: config.S3SecretAccessKey,
+		sessionToken:    config.S3SessionToken,
+		now:             time.Now,
+	}, nil
+}
+
+func (c s3Client) resolve(ctx context.Context, keys []string, modes []MatchMode) (ArchiveInfo, error) {
+	for i, key := range keys {
+		objects, err := c.list(ctx, c.prefix+key)
+		if err != nil {
+			return ArchiveInfo{}, err
+		}
+
+		exactOnly := matchMode(modes, i) == MatchExact
+		var match *s3Object
+		for i, object := range objects {
+			if !strings.HasSuffix(object.Key, archiveExtension) {
+				continue
+			}
+			if object.Key == c.prefix+key+archiveExtension {
+				match = &objects[i]
+				break
+			}
+			if exactOnly {
+				continue
+			}
+			if match == nil || object.LastModified.After(match.LastModified) {
+				match = &objects[i]
+			}
+		}
+		if match == nil {
+			continue
+		}
+
+		checksum, uncompressedSize, err := c.metadata(ctx, match.Key)
+		if err != nil {
+			return ArchiveInfo{}, err
+		}
+		return ArchiveInfo{
+			URL:              c.presign(http.MethodGet, match.Key, nil, s3URLExpiry),
+			MatchedKey:       strings.TrimSuffix(strings.TrimPrefix(match.Key, c.prefix), archiveExtension),
+			Checksum:         checksum,
+			Size:             match.Size,
+			UncompressedSize: uncompressedSize,
+		}, nil
+	}
+	return ArchiveInfo{}, ErrCacheNotFound
+}
+
+// list returns every object with the given key prefix (ListObjectsV2).
+func (c s3Client) list(ctx context.Context, prefix string) ([]s3Object, error) {
+	var objects []s3Object
+	continuationToken := ""
+	for {
+		query := url.Values{}
+		query.Set("list-type", "2")
+		query.Set("prefix", prefix)
+		if continuationToken != "" {
+			query.Set("continuation-token", continuationToken)
+		}
+
+		resp, err := c.do(ctx, http.MethodGet, c.presign(http.MethodGet, "", query, time.Minute))
+		if err != nil {
+			return nil, fmt.Errorf("list objects: %w", err)
+		}
+		var result s3ListResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close() //nolint:errcheck
+		if err != nil {
+			return nil, fmt.Errorf("parse object list: %w", err)
+		}
+
+		objects = append(objects, result.Contents...)
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return objects, nil
+		}
+		continuationToken = result.NextContinuationToken
+	}
+}
+
+// metadata returns the archive checksum and uncompressed size stored in the object metadata,
+// or zero values if they weren't set at upload.
+func (c s3Client) metadata(ctx context.Context, key string) (string, int64, error) {
+	resp, err := c.do(ctx, http.MethodHead, c.presign(http.MethodHead, key, nil, time.Minute))
+	if err != nil {
+		return "", 0, fmt.Errorf("get object metadata: %w", err)
+	}
+	resp.Body.Close() //nolint:errcheck
+
+	// A malformed size is treated as unknown, it's only used for estimating the disk space of the restore
+	uncompressedSize, _ := strconv.ParseInt(resp.Header.Get(s3UncompressedSizeMetadata), 10, 64)
+	return resp.Header.Get(s3ChecksumMetadata), uncompressedSize, nil
+}
+
+func (c s3Client) do(ctx context.Context, method, rawURL string) (*http.Response, error) {
+	req, err := retryablehttp.NewRequestWithContext(ctx, method, rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close() //nolint:errcheck
+		return nil, unwrapError(resp)
+	}
+	return resp, nil
+}
+
+// presign returns a URL of the object (or the bucket if key is empty) signed with AWS Signature Version 4 query parameters.
+func (c s3Client) presign(method, key string, query url.Values, expiry time.Duration) string {
+	u := *c.endpoint
+	if c.pathStyle {
+		u.Path = "/" + c.bucket
+		if key != "" {
+			u.Path += "/" + key
+		}
+	} else {
+		u.Host = c.bucket + "." + u.Host
+		u.Path = "/" + key
+	}
+
+	return presignURL(method, &u, query, c.region, c.accessKeyID, c.secretAccessKey, c.sessionToken, c.now(), expiry)
+}
+
+func presignURL(method string, u *url.URL, query url.Values, region, accessKeyID, secretAccessKey, sessionToken string, now time.Time, expiry time.Duration) string {
+	now = now.UTC()
+	scope := sigV4Scope(now, region)
+
+	signedQuery := url.Values{}
+	for key, values := range query {
+		signedQuery[key] = values
+	}
+	signedQuery.Set("X-Amz-Algorithm", "AWS4-HMAC-SHA256")
+	signedQuery.Set("X-Amz-Credential", accessKeyID+"/"+scope)
+	signedQuery.Set("X-Amz-Date", now.Format("20060102T150405Z"))
+	signedQuery.Set("X-Amz-Expires", strconv.Itoa(int(expiry.Seconds())))
+	signedQuery.Set("X-Amz-SignedHeaders", "host")
+	if sessionToken != "" {
+		signedQuery.Set("X-Amz-Security-Token", sessionToken)
+	}
+
+	signature := sigV4Signature(secretAccessKey, region, now, sigV4CanonicalRequest(method, u, signedQuery))
+	return fmt.Sprintf("%s://%s%s?%s&X-Amz-Signature=%s", u.Scheme, u.Host, uriEncode(u.Path, false), canonicalQueryString(signedQuery), signature)
+}
+
+func sigV4Scope(now time.Time, region string) string {
+	return strings.Join([]string{now.UTC().Format("20060102"), region, "s3", "aws4_request"}, "/")
+}
+
+// sigV4CanonicalRequest returns the canonical request of a presigned URL, only the host header is signed.
+func sigV4CanonicalRequest(method string, u *url.URL, signedQuery url.Values) string {
+	return strings.Join([]string{
+		method,
+		uriEncode(u.Path, false),
+		canonicalQueryString(signedQuery),
+		"host:" + u.Host + "\n",
+		"host",
+		"UNSIGNED-PAYLOAD",
+	}, "\n")
+}
+
+// sigV4StringToSign returns the string signed by sigV4Signature.
+func sigV4StringToSign(region string, now time.Time, canonicalRequest string) string {
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	return strings.Join([]string{"AWS4-HMAC-SHA256", now.UTC().Format("20060102T150405Z"), sigV4Scope(now, region), hex.EncodeToString(requestHash[:])}, "\n")
+}
+
+func sigV4Signature(secretAccessKey, region string, now time.Time, canonicalRequest string) string {
+	signingKey := hmacSHA256([]byte("AWS4"+secretAccessKey), now.UTC().Format("20060102"))
+	signingKey = hmacSHA256(signingKey, region)
+	signingKey = hmacSHA256(signingKey, "s3")
+	signingKey = hmacSHA256(signingKey, "aws4_request")
+	return hex.EncodeToString(hmacSHA256(signingKey, sigV4StringToSign(region, now, canonicalRequest)))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data)) //nolint:errcheck
+	return mac.Sum(nil)
+}
+
+func canonicalQueryString(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var parts []string
+	for _, key := range keys {
+		for _, value := range query[key] {
+			parts = append(parts, uriEncode(key, true)+"="+uriEncode(value, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// uriEncode percent-encodes everything except the unreserved characters, as Signature Version 4 requires.
+func uriEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for _, c := range []byte(s) {
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,216 @@
+package network
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bitrise-io/go-utils/retry"
+	"github.com/bitrise-io/go-utils/v2/log"
+	"github.com/bitrise-steplib/bitrise-step-restore-cache/cache/network/got"
+	"github.com/hashicorp/go-retryablehttp"
+)
+
+const (
+	streamChunkSize          = 8 * 1024 * 1024
+	streamDefaultConcurrency = 8
+)
+
+type byteRange struct {
+	start, end int64 // inclusive
+}
+
+// streamFile downloads the archive with parallel range requests and writes the chunks to dest in order.
+// At most params.Tuning.MaxConcurrency chunks are downloaded or waiting to be written at a time, which bounds memory usage.
+func streamFile(ctx context.Context, httpClient *retryablehttp.Client, archive ArchiveInfo, dest io.Writer, params DownloadParams, logger log.Logger) error {
+	file, isFileURL, err := openFileURL(archive.URL)
+	if isFileURL {
+		if err != nil {
+			return err
+		}
+		defer file.Close() //nolint:errcheck
+		_, err := io.Copy(dest, file)
+		return err
+	}
+
+	client := httpClient.StandardClient()
+	url := archive.URL
+
+	size, rangeable, err := probeFile(ctx, client, url, dest)
+	if err != nil {
+		return err
+	}
+	if !rangeable {
+		logger.Debugf("Server doesn't support range requests, archive was streamed in a single request")
+		return nil
+	}
+	if archive.Size > 0 && size != archive.Size {
+		// Fail before anything is written to dest
+		return fmt.Errorf("%w: archive size is %d bytes, expected %d bytes", ErrIntegrityCheckFailed, size, archive.Size)
+	}
+
+	concurrency := params.Tuning.maxConcurrency(true)
+
+	ranges := splitRanges(size, streamChunkSize)
+	logger.Debugf("Streaming %d chunks, %d concurrency", len(ranges), concurrency)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make([]chan []byte, len(ranges))
+	for i := range results {
+		results[i] = make(chan []byte, 1)
+	}
+	errC := make(chan error, 1)
+	// A slot is taken before a chunk download starts and released once the chunk is written to dest.
+	slots := make(chan struct{}, concurrency)
+
+	if params.ProgressInterval > 0 {
+		progress := &streamProgress{dest: dest, activeChunks: func() int { return len(slots) }}
+		dest = progress
+		stopProgress := progress.report(params.ProgressInterval, uint64(size), logger)
+		defer stopProgress()
+	}
+
+	go func() {
+		for i, r := range ranges {
+			select {
+			case slots <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+
+			go func(i int, r byteRange) {
+				data, err := fetchRange(ctx, client, url, r, params.Tuning.maxRetryPerChunk(), logger)
+				if err != nil {
+					select {
+					case errC <- fmt.Errorf("chunk %d: %w", i, err):
+					default:
+					}
+					cancel()
+					return
+				}
+				results[i] <- data
+			}(i, r)
+		}
+	}()
+
+	for i := range ranges {
+		select {
+		case data := <-results[i]:
+			if _, err := dest.Write(data); err != nil {
+				return err
+			}
+			<-slots
+		case err := <-errC:
+			return err
+		case <-ctx.Done():
+			select {
+			case err := <-errC:
+				return err
+			default:
+				return ctx.Err()
+			}
+		}
+	}
+
+	return nil
+}
+
+// probeFile requests the first byte of the file to learn its size.
+// If the server doesn't support range requests, the whole file is written to dest instead.
+func probeFile(ctx context.Context, client *http.Client, url string, dest io.Writer) (int64, bool, error) {
+	req, err := got.NewRequest(ctx, http.MethodGet, url, []got.GotHeader{{Key: "Range", Value: "bytes=0-0"}})
+	if err != nil {
+		return 0, false, err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, false, err
+	}
+	defer resp.Body.Close() //nolint:errcheck
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		size, err := parseContentRangeSize(resp.Header.Get("Content-Range"))
+		if err != nil {
+			return 0, false, err
+		}
+		return size, true, nil
+	case http.StatusOK:
+		_, err := io.Copy(dest, resp.Body)
+		return resp.ContentLength, false, err
+	default:
+		return 0, false, unwrapError(resp)
+	}
+}
+
+func parseContentRangeSize(contentRange string) (int64, error) {
+	parts := strings.Split(contentRange, "/")
+	if len(parts) != 2 {
+		return 0, fmt.Errorf("invalid content-range header: %s", contentRange)
+	}
+	size, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid content-range header: %s", contentRange)
+	}
+	return size, nil
+}
+
+func splitRanges(size, chunkSize int64) []byteRange {
+	var ranges []byteRange
+	for start := int64(0); start < size; start += chunkSize {
+		end := start + chunkSize - 1
+		if end >= size {
+			end = size - 1
+		}
+		ranges = append(ranges, byteRange{start: start, end: end})
+	}
+	return ranges
+}
+
+// fetchRange downloads a single chunk into memory. Interrupted attempts resume from the last received byte.
+func fetchRange(ctx context.Context, client *http.Client, url string, r byteRange, maxRetries int, logger log.Logger) ([]byte, error) {
+	length := r.end - r.start + 1
+	data := bytes.NewBuffer(make([]byte, 0, length))
+
+	err := retry.Times(uint(maxRetries)).Wait(time.Second).TryWithAbort(func(attempt uint) (error, bool) {
+		offset := r.start + int64(data.Len())
+		if attempt != 0 {
+			logger.Debugf("Retrying chunk %d-%d from offset %d (attempt %d)", r.start, r.end, offset, attempt+1)
+		}
+
+		contentRange := fmt.Sprintf("bytes=%d-%d", offset, r.end)
+		req, err := got.NewRequest(ctx, http.MethodGet, url, []got.GotHeader{{Key: "Range", Value: contentRange}})
+		if err != nil {
+			return err, true
+		}
+
+		resp, err := client.Do(req)
+		if err != nil {
+			return err, ctx.Err() != nil
+		}
+		defer resp.Body.Close() //nolint:errcheck
+
+		if resp.StatusCode != http.StatusPartialContent {
+			return fmt.Errorf("range request %s failed: %w", contentRange, unwrapError(resp)), false
+		}
+
+		// Partially read data is kept in the buffer, the next attempt continues from there
+		if _, err := data.ReadFrom(io.LimitReader(resp.Body, length-int64(data.Len()))); err != nil {
+			return err, ctx.Err() != nil
+		}
+		if int64(data.Len()) != length {
+			return fmt.Errorf("range request %s ended after %d bytes", contentRange, data.Len()), false
+		}
+		return nil, false
+	})
+
+	return data.Bytes(), err
+}
@@ -0,0 +1,31 @@
+package network
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	// ErrLookupTimedOut is returned if the archive lookup exceeds DownloadParams.LookupTimeout or the deadline of the context.
+	ErrLookupTimedOut = errors.New("cache lookup timed out")
+	// ErrDownloadTimedOut is returned if the archive download exceeds DownloadParams.DownloadTimeout or the deadline of the context.
+	ErrDownloadTimedOut = errors.New("archive download timed out")
+)
+
+// withTimeout returns a context with the timeout, or ctx itself if the timeout is zero.
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// phaseError wraps err with timeoutErr if ctx (the context of the phase that failed) exceeded its deadline.
+func phaseError(ctx context.Context, timeoutErr error, err error) error {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) && !errors.Is(err, timeoutErr) {
+		return fmt.Errorf("%w: %w", timeoutErr, err)
+	}
+	return err
+}
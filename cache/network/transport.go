@@ -0,0 +1,177 @@
+package network
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/bitrise-io/go-utils/v2/log"
+	"github.com/bitrise-io/go-utils/v2/retryhttp"
+	"github.com/hashicorp/go-retryablehttp"
+)
+
+// NetworkConfig configures how the cache traffic reaches the storage on restricted networks, such as behind an
+// intercepting proxy. The zero value uses the proxy env vars (HTTPS_PROXY, HTTP_PROXY, NO_PROXY) and the system CAs.
+type NetworkConfig struct {
+	// ProxyURL is the proxy of the cache API requests. Defaults to the proxy env vars.
+	ProxyURL string
+	// DownloadProxyURL is the proxy of the requests to presigned URLs: the archive downloads of every backend
+	// and all requests of the S3 backend. Defaults to ProxyURL.
+	DownloadProxyURL string
+	// CABundlePath is a PEM file of CA certificates trusted in addition to the system ones.
+	CABundlePath string
+	// ClientCertPath and ClientKeyPath are the PEM encoded client certificate and private key used for mutual TLS.
+	ClientCertPath string
+	ClientKeyPath  string
+}
+
+// Validate returns an error if a proxy URL is invalid, or the certificates can't be loaded.
+func (c NetworkConfig) Validate() error {
+	if _, err := parseProxyURL(c.ProxyURL); err != nil {
+		return err
+	}
+	if _, err := parseProxyURL(c.DownloadProxyURL); err != nil {
+		return err
+	}
+	_, err := c.tlsConfig()
+	return err
+}
+
+// LogEffectiveSettings prints the proxies and certificates used by the cache requests, without proxy credentials.
+func (c NetworkConfig) LogEffectiveSettings(logger log.Logger) {
+	proxy := func(proxyURL *url.URL) string {
+		if proxyURL == nil {
+			return "from environment"
+		}
+		return proxyURL.Redacted()
+	}
+	apiProxy, _ := parseProxyURL(c.ProxyURL)
+	downloadProxy, _ := parseProxyURL(c.DownloadProxyURL)
+	if downloadProxy == nil {
+		downloadProxy = apiProxy
+	}
+
+	logger.Debugf("Network settings:")
+	logger.Debugf("- API proxy: %s", proxy(apiProxy))
+	logger.Debugf("- download proxy: %s", proxy(downloadProxy))
+	if c.CABundlePath != "" {
+		logger.Debugf("- additional CA bundle: %s", c.CABundlePath)
+	}
+	if c.ClientCertPath != "" {
+		logger.Debugf("- client certificate: %s", c.ClientCertPath)
+	}
+}
+
+// newHTTPClient returns the client of every request of the download: the storage API requests and the archive downloads.
+func newHTTPClient(params DownloadParams, logger log.Logger) (*retryablehttp.Client, error) {
+	httpClient := retryhttp.NewClient(logger)
+	configureTransport(httpClient, params.Tuning)
+
+	apiHost := ""
+	if params.Storage.backend() == StorageBitrise {
+		if apiURL, err := url.Parse(params.APIBaseURL); err == nil {
+			apiHost = apiURL.Hostname()
+		}
+	}
+	if err := configureNetwork(httpClient, params.Network, apiHost); err != nil {
+		return nil, err
+	}
+	return httpClient, nil
+}
+
+// configureNetwork sets up the proxies and the TLS settings of the client's transport.
+// Requests to apiHost use the API proxy, every other request goes to a presigned URL and uses the download proxy.
+func configureNetwork(httpClient *retryablehttp.Client, config NetworkConfig, apiHost string) error {
+	transport := httpClient.HTTPClient.Transport.(*http.Transport)
+
+	tlsConfig, err := config.tlsConfig()
+	if err != nil {
+		return err
+	}
+	if tlsConfig != nil {
+		transport.TLSClientConfig = tlsConfig
+	}
+
+	apiProxy, err := parseProxyURL(config.ProxyURL)
+	if err != nil {
+		return err
+	}
+	downloadProxy, err := parseProxyURL(config.DownloadProxyURL)
+	if err != nil {
+		return err
+	}
+	if apiProxy == nil && downloadProxy == nil {
+		// The transport default
+		return nil
+	}
+	if downloadProxy == nil {
+		downloadProxy = apiProxy
+	}
+
+	transport.Proxy = func(req *http.Request) (*url.URL, error) {
+		proxy := downloadProxy
+		if apiHost != "" && strings.EqualFold(req.URL.Hostname(), apiHost) {
+			proxy = apiProxy
+		}
+		if proxy == nil {
+			return http.ProxyFromEnvironment(req)
+		}
+		return proxy, nil
+	}
+	return nil
+}
+
+// parseProxyURL returns nil if rawURL is empty. The error never contains rawURL, as it can include credentials.
+func parseProxyURL(rawURL string) (*url.URL, error) {
+	if rawURL == "" {
+		return nil, nil
+	}
+	proxyURL, err := url.Parse(rawURL)
+	if err != nil || proxyURL.Host == "" {
+		return nil, fmt.Errorf("invalid proxy URL, expected a URL such as http://proxy.example.com:8080")
+	}
+	switch proxyURL.Scheme {
+	case "http", "https", "socks5":
+		return proxyURL, nil
+	default:
+		return nil, fmt.Errorf("unsupported proxy URL scheme: %s", proxyURL.Scheme)
+	}
+}
+
+// tlsConfig returns nil if neither a CA bundle nor a client certificate is configured.
+func (c NetworkConfig) tlsConfig() (*tls.Config, error) {
+	if (c.ClientCertPath == "") != (c.ClientKeyPath == "") {
+		return nil, fmt.Errorf("client certificate and client key have to be provided together")
+	}
+	if c.CABundlePath == "" && c.ClientCertPath == "" {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{}
+	if c.CABundlePath != "" {
+		bundle, err := os.ReadFile(c.CABundlePath)
+		if err != nil {
+			return nil, fmt.Errorf("read CA bundle: %w", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(bundle) {
+			return nil, fmt.Errorf("no PEM encoded certificate found in CA bundle: %s", c.CABundlePath)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if c.ClientCertPath != "" {
+		cert, err := tls.LoadX509KeyPair(c.ClientCertPath, c.ClientKeyPath)
+		if err != nil {
+			return nil, fmt.Errorf("load client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
@@ -0,0 +1,113 @@
+package network
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/bitrise-io/go-utils/v2/log"
+	"github.com/bitrise-steplib/bitrise-step-restore-cache/cache/network/got"
+	"github.com/hashicorp/go-retryablehttp"
+)
+
+const (
+	defaultMaxRetryPerChunk    = 5
+	defaultChunkRetryThreshold = 10 * time.Second
+)
+
+// DownloadTuning are the advanced network settings of the archive download. Zero values select the defaults.
+type DownloadTuning struct {
+	// MaxConcurrency is the upper limit of the parallel chunk downloads. Defaults to a value based on the CPU count.
+	MaxConcurrency uint
+	// MaxIdleConns and MaxIdleConnsPerHost limit the idle (keep-alive) connections of the HTTP transport.
+	MaxIdleConns        int
+	MaxIdleConnsPerHost int
+	// ForceAttemptHTTP2 enables HTTP/2 even though the transport has a custom dialer.
+	ForceAttemptHTTP2 bool
+	// DualStack enables RFC 6555 Fast Fallback between IPv4 and IPv6.
+	DualStack bool
+	// MaxRetryPerChunk is how many times a failing or hanging chunk download is retried. Defaults to 5.
+	MaxRetryPerChunk int
+	// ChunkRetryThreshold is how much slower than the average a chunk download can be before it's interrupted
+	// and retried. Defaults to 10 seconds.
+	ChunkRetryThreshold time.Duration
+}
+
+// Validate returns an error if any of the settings is out of range.
+func (t DownloadTuning) Validate() error {
+	if t.MaxIdleConns < 0 {
+		return fmt.Errorf("max idle connections must not be negative, got %d", t.MaxIdleConns)
+	}
+	if t.MaxIdleConnsPerHost < 0 {
+		return fmt.Errorf("max idle connections per host must not be negative, got %d", t.MaxIdleConnsPerHost)
+	}
+	if t.MaxRetryPerChunk < 0 {
+		return fmt.Errorf("max retry per chunk must not be negative, got %d", t.MaxRetryPerChunk)
+	}
+	if t.ChunkRetryThreshold < 0 {
+		return fmt.Errorf("chunk retry threshold must not be negative, got %s", t.ChunkRetryThreshold)
+	}
+	return nil
+}
+
+func (t DownloadTuning) maxConcurrency(isStreaming bool) uint {
+	switch {
+	case t.MaxConcurrency != 0:
+		return t.MaxConcurrency
+	case isStreaming:
+		// Every chunk in flight is kept in memory
+		return streamDefaultConcurrency
+	default:
+		return got.DefaultConcurrency()
+	}
+}
+
+func (t DownloadTuning) maxRetryPerChunk() int {
+	if t.MaxRetryPerChunk == 0 {
+		return defaultMaxRetryPerChunk
+	}
+	return t.MaxRetryPerChunk
+}
+
+func (t DownloadTuning) chunkRetryThreshold() time.Duration {
+	if t.ChunkRetryThreshold == 0 {
+		return defaultChunkRetryThreshold
+	}
+	return t.ChunkRetryThreshold
+}
+
+// LogEffectiveSettings prints the settings used by the download, with the defaults resolved.
+func (t DownloadTuning) LogEffectiveSettings(isStreaming bool, logger log.Logger) {
+	idleConns := func(value int) string {
+		if value == 0 {
+			return "transport default"
+		}
+		return fmt.Sprint(value)
+	}
+
+	logger.Debugf("Download settings:")
+	logger.Debugf("- max concurrency: %d", t.maxConcurrency(isStreaming))
+	logger.Debugf("- max idle connections: %s", idleConns(t.MaxIdleConns))
+	logger.Debugf("- max idle connections per host: %s", idleConns(t.MaxIdleConnsPerHost))
+	logger.Debugf("- force attempt HTTP/2: %t", t.ForceAttemptHTTP2)
+	logger.Debugf("- dual stack: %t", t.DualStack)
+	logger.Debugf("- max retry per chunk: %d", t.maxRetryPerChunk())
+	logger.Debugf("- chunk retry threshold: %s", t.chunkRetryThreshold())
+}
+
+func configureTransport(httpClient *retryablehttp.Client, tuning DownloadTuning) {
+	transport := httpClient.HTTPClient.Transport.(*http.Transport)
+	if tuning.MaxIdleConnsPerHost > 0 {
+		transport.MaxIdleConnsPerHost = tuning.MaxIdleConnsPerHost
+	}
+	if tuning.MaxIdleConns > 0 {
+		transport.MaxIdleConns = tuning.MaxIdleConns
+	}
+	transport.ForceAttemptHTTP2 = tuning.ForceAttemptHTTP2
+	transport.DialContext = (&net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+		DualStack: tuning.DualStack,
+	}).DialContext
+}
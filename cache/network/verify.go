@@ -0,0 +1,104 @@
+package network
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/bitrise-io/go-utils/v2/log"
+)
+
+// verifyHoldbackSize is the size of the archive tail that is only written to the stream after the whole archive is verified.
+// It's larger than the maximum zstd block size, so the extraction can't complete before the verification.
+const verifyHoldbackSize = 1024 * 1024
+
+// ErrIntegrityCheckFailed is returned when the downloaded archive doesn't match the size or checksum recorded at upload.
+var ErrIntegrityCheckFailed = errors.New("archive integrity check failed")
+
+// HasDigest reports whether the cache API recorded the size or checksum of the archive, so it can be verified.
+func HasDigest(archive ArchiveInfo) bool {
+	return archive.Size > 0 || archive.Checksum != ""
+}
+
+func checkIntegrity(size int64, checksum string, archive ArchiveInfo) error {
+	if archive.Size > 0 && size != archive.Size {
+		return fmt.Errorf("%w: archive size is %d bytes, expected %d bytes", ErrIntegrityCheckFailed, size, archive.Size)
+	}
+	if archive.Checksum != "" && !strings.EqualFold(checksum, archive.Checksum) {
+		return fmt.Errorf("%w: archive checksum is %s, expected %s", ErrIntegrityCheckFailed, checksum, archive.Checksum)
+	}
+	return nil
+}
+
+// verifyDownload checks the downloaded archive at path against the size and checksum provided by the cache API.
+func verifyDownload(path string, archive ArchiveInfo, logger log.Logger) error {
+	if !HasDigest(archive) {
+		logger.Debugf("The cache API didn't provide the archive checksum, skipping integrity check")
+		return nil
+	}
+	if err := verifyFile(path, archive); err != nil {
+		return err
+	}
+	logger.Printf("Archive integrity verified")
+	return nil
+}
+
+func verifyFile(path string, archive ArchiveInfo) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close() //nolint:errcheck
+
+	hash := sha256.New()
+	size, err := io.Copy(hash, file)
+	if err != nil {
+		return fmt.Errorf("read archive: %w", err)
+	}
+	return checkIntegrity(size, hex.EncodeToString(hash.Sum(nil)), archive)
+}
+
+// verifyingWriter passes the archive through to dest while computing its checksum.
+// The last verifyHoldbackSize bytes are only written to dest by finish, once the whole archive is verified.
+type verifyingWriter struct {
+	dest    io.Writer
+	archive ArchiveInfo
+	hash    hash.Hash
+	size    int64
+	tail    bytes.Buffer
+}
+
+func newVerifyingWriter(dest io.Writer, archive ArchiveInfo) *verifyingWriter {
+	return &verifyingWriter{
+		dest:    dest,
+		archive: archive,
+		hash:    sha256.New(),
+	}
+}
+
+func (w *verifyingWriter) Write(p []byte) (int, error) {
+	w.hash.Write(p) //nolint:errcheck
+	w.size += int64(len(p))
+	w.tail.Write(p) //nolint:errcheck
+
+	if overflow := w.tail.Len() - verifyHoldbackSize; overflow > 0 {
+		if _, err := w.dest.Write(w.tail.Next(overflow)); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+func (w *verifyingWriter) finish() error {
+	if err := checkIntegrity(w.size, hex.EncodeToString(w.hash.Sum(nil)), w.archive); err != nil {
+		return err
+	}
+	_, err := w.dest.Write(w.tail.Bytes())
+	return err
+}
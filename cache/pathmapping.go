@@ -0,0 +1,63 @@
+package cache
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/bitrise-io/go-utils/v2/pathutil"
+	"github.com/bitrise-steplib/bitrise-step-restore-cache/cache/compression"
+)
+
+const pathMappingSeparator = "=>"
+
+// parsePathMappings parses `from => to` rules, such as `/home/ubuntu => $HOME`.
+// Environment variables and a leading `~` are expanded on both sides.
+func parsePathMappings(rules []string) ([]compression.PathMapping, error) {
+	var mappings []compression.PathMapping
+	for _, rule := range rules {
+		if strings.TrimSpace(rule) == "" {
+			continue
+		}
+
+		from, to, found := strings.Cut(rule, pathMappingSeparator)
+		if !found {
+			return nil, fmt.Errorf("invalid path mapping (expected format: /old/prefix => /new/prefix): %s", rule)
+		}
+
+		fromPath, err := expandMappingPath(from)
+		if err != nil {
+			return nil, fmt.Errorf("invalid path mapping %s: %w", rule, err)
+		}
+		toPath, err := expandMappingPath(to)
+		if err != nil {
+			return nil, fmt.Errorf("invalid path mapping %s: %w", rule, err)
+		}
+
+		mappings = append(mappings, compression.PathMapping{From: fromPath, To: toPath})
+	}
+
+	if err := compression.ValidatePathMappings(mappings); err != nil {
+		return nil, err
+	}
+	return mappings, nil
+}
+
+func expandMappingPath(path string) (string, error) {
+	path = strings.TrimSpace(path)
+	if path == "" {
+		return "", fmt.Errorf("empty path")
+	}
+
+	path = os.ExpandEnv(path)
+	if strings.HasPrefix(path, "~") {
+		absPath, err := pathutil.NewPathModifier().AbsPath(path)
+		if err != nil {
+			return "", err
+		}
+		path = absPath
+	}
+
+	return filepath.ToSlash(filepath.Clean(path)), nil
+}
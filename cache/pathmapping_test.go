@@ -0,0 +1,68 @@
+package cache
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/bitrise-steplib/bitrise-step-restore-cache/cache/compression"
+)
+
+func TestParsePathMappings(t *testing.T) {
+	t.Setenv("HOME", "/Users/vagrant")
+	t.Setenv("CI_HOME", "/home/ubuntu")
+
+	tests := []struct {
+		name    string
+		rules   []string
+		want    []compression.PathMapping
+		wantErr bool
+	}{
+		{
+			name:  "absolute paths",
+			rules: []string{"/home/ubuntu => /Users/vagrant"},
+			want:  []compression.PathMapping{{From: "/home/ubuntu", To: "/Users/vagrant"}},
+		},
+		{
+			name:  "environment variables and home directory",
+			rules: []string{"$CI_HOME/.gradle => ~/.gradle"},
+			want:  []compression.PathMapping{{From: "/home/ubuntu/.gradle", To: "/Users/vagrant/.gradle"}},
+		},
+		{
+			name:  "trailing slashes and empty rules",
+			rules: []string{"", "/home/ubuntu/ =>/Users/vagrant/", "  "},
+			want:  []compression.PathMapping{{From: "/home/ubuntu", To: "/Users/vagrant"}},
+		},
+		{
+			name:    "missing separator",
+			rules:   []string{"/home/ubuntu /Users/vagrant"},
+			wantErr: true,
+		},
+		{
+			name:    "empty side",
+			rules:   []string{"/home/ubuntu => "},
+			wantErr: true,
+		},
+		{
+			name:    "mapping rewritten by another mapping",
+			rules:   []string{"/a => /b", "/b => /c"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parsePathMappings(tt.rules)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("parsePathMappings() = %v, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parsePathMappings() error = %s", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parsePathMappings() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,148 @@
+package cache
+
+import (
+	"encoding/json"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bitrise-io/go-steputils/v2/export"
+)
+
+const (
+	matchedKeyIndexEnvVar    = "BITRISE_CACHE_MATCHED_KEY_INDEX"
+	archiveSizeEnvVar        = "BITRISE_CACHE_ARCHIVE_SIZE"
+	archiveChecksumEnvVar    = "BITRISE_CACHE_ARCHIVE_CHECKSUM"
+	downloadDurationEnvVar   = "BITRISE_CACHE_DOWNLOAD_DURATION"
+	extractionDurationEnvVar = "BITRISE_CACHE_EXTRACTION_DURATION"
+	restoreReportEnvVar      = "BITRISE_CACHE_RESTORE_REPORT_PATH"
+)
+
+// restoreReport is the JSON restore report, its path is exported as BITRISE_CACHE_RESTORE_REPORT_PATH.
+type restoreReport struct {
+	restoreReportEntry
+	Groups []groupRestoreReport `json:"groups,omitempty"`
+}
+
+type groupRestoreReport struct {
+	Name string `json:"name"`
+	restoreReportEntry
+	Error string `json:"error,omitempty"`
+}
+
+type restoreReportEntry struct {
+	CacheHit      string   `json:"cache_hit"`
+	EvaluatedKeys []string `json:"evaluated_keys,omitempty"`
+	MatchedKey    string   `json:"matched_key,omitempty"`
+	// MatchedKeyIndex is the index of the evaluated key that matched, -1 if there was no match
+	MatchedKeyIndex           int     `json:"matched_key_index"`
+	MatchStrategy             string  `json:"match_strategy,omitempty"`
+	ArchiveSizeBytes          int64   `json:"archive_size_bytes,omitempty"`
+	ArchiveChecksum           string  `json:"archive_checksum,omitempty"`
+	DownloadDurationSeconds   float64 `json:"download_duration_seconds,omitempty"`
+	ExtractionDurationSeconds float64 `json:"extraction_duration_seconds,omitempty"`
+	IsLookupOnly              bool    `json:"is_lookup_only"`
+	IsLocalCacheHit           bool    `json:"is_local_cache_hit"`
+	MissReason                string  `json:"miss_reason,omitempty"`
+	Outcome                   string  `json:"outcome,omitempty"`
+}
+
+func newRestoreReportEntry(result restoreResult, evaluatedKeys []string) restoreReportEntry {
+	return restoreReportEntry{
+		CacheHit:                  result.cacheHitValue(evaluatedKeys),
+		EvaluatedKeys:             evaluatedKeys,
+		MatchedKey:                result.matchedKey,
+		MatchedKeyIndex:           matchedKeyIndex(result.matchedKey, evaluatedKeys),
+		MatchStrategy:             result.matchStrategy,
+		ArchiveSizeBytes:          result.archiveSize,
+		ArchiveChecksum:           result.checksum,
+		DownloadDurationSeconds:   result.downloadDuration.Seconds(),
+		ExtractionDurationSeconds: result.extractionDuration.Seconds(),
+		IsLookupOnly:              result.lookupOnly,
+		IsLocalCacheHit:           result.fromLocalCache,
+		MissReason:                result.missReason,
+		Outcome:                   result.outcome,
+	}
+}
+
+// matchedKeyIndex returns the index of the key that matched: the key equal to the matched key,
+// or the first key that the matched key starts with (prefix match). It's -1 if there was no match.
+func matchedKeyIndex(matchedKey string, evaluatedKeys []string) int {
+	if matchedKey == "" {
+		return -1
+	}
+	for i, key := range evaluatedKeys {
+		if key == matchedKey {
+			return i
+		}
+	}
+	for i, key := range evaluatedKeys {
+		if strings.HasPrefix(matchedKey, key) {
+			return i
+		}
+	}
+	return -1
+}
+
+// exportRestoreOutputs exports the restore metadata outputs. They are empty if there was no cache hit,
+// except the miss reason and the outcome.
+func (r *restorer) exportRestoreOutputs(result restoreResult, evaluatedKeys []string) error {
+	outputs := map[string]string{
+		matchedKeyIndexEnvVar:    "",
+		matchStrategyEnvVar:      result.matchStrategy,
+		archiveSizeEnvVar:        "",
+		archiveChecksumEnvVar:    "",
+		downloadDurationEnvVar:   "",
+		extractionDurationEnvVar: "",
+		missReasonEnvVar:         result.missReason,
+		restoreOutcomeEnvVar:     result.outcome,
+	}
+	if result.matchedKey != "" {
+		outputs[matchedKeyIndexEnvVar] = strconv.Itoa(matchedKeyIndex(result.matchedKey, evaluatedKeys))
+		if result.archiveSize > 0 {
+			outputs[archiveSizeEnvVar] = strconv.FormatInt(result.archiveSize, 10)
+		}
+		outputs[archiveChecksumEnvVar] = result.checksum
+		if !result.lookupOnly {
+			outputs[downloadDurationEnvVar] = formatSeconds(result.downloadDuration)
+			outputs[extractionDurationEnvVar] = formatSeconds(result.extractionDuration)
+		}
+	}
+
+	exporter := export.NewExporter(r.cmdFactory)
+	for _, key := range []string{matchedKeyIndexEnvVar, matchStrategyEnvVar, archiveSizeEnvVar, archiveChecksumEnvVar, downloadDurationEnvVar, extractionDurationEnvVar, missReasonEnvVar, restoreOutcomeEnvVar} {
+		if err := exporter.ExportOutput(key, outputs[key]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// exportRestoreReport writes the report to a JSON file and exports its path.
+func (r *restorer) exportRestoreReport(report restoreReport) error {
+	content, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	reportFile, err := os.CreateTemp("", "restore-cache-report-*.json")
+	if err != nil {
+		return err
+	}
+	if _, err := reportFile.Write(content); err != nil {
+		reportFile.Close() //nolint:errcheck
+		return err
+	}
+	if err := reportFile.Close(); err != nil {
+		return err
+	}
+	r.logger.Debugf("Restore report: %s", reportFile.Name())
+
+	exporter := export.NewExporter(r.cmdFactory)
+	return exporter.ExportOutputFile(restoreReportEnvVar, reportFile.Name(), reportFile.Name())
+}
+
+func formatSeconds(d time.Duration) string {
+	return strconv.FormatFloat(d.Seconds(), 'f', 3, 64)
+}
@@ -0,0 +1,119 @@
+package cache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func TestMatchedKeyIndex(t *testing.T) {
+	keys := []string{"npm-main-abc", "npm-main-", "npm-"}
+	tests := []struct {
+		name       string
+		matchedKey string
+		want       int
+	}{
+		{name: "first key", matchedKey: "npm-main-abc", want: 0},
+		{name: "exact match of a fallback key", matchedKey: "npm-main-", want: 1},
+		{name: "prefix match", matchedKey: "npm-main-def", want: 1},
+		{name: "prefix match of the last key", matchedKey: "npm-feature-abc", want: 2},
+		{name: "no match", matchedKey: "", want: -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := matchedKeyIndex(tt.matchedKey, keys); got != tt.want {
+				t.Errorf("matchedKeyIndex() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRestoreOutputsAndReport(t *testing.T) {
+	outputs := fakeEnvman(t)
+	archive := testArchive(t, archiveEntry{name: "a.txt", content: []byte("a")})
+	checksum := sha256.Sum256(archive)
+
+	r := newFakeRestorer(t, fakeDownloader{archives: map[string][]byte{"key": archive}})
+	if err := r.Restore(testInput(t, t.TempDir(), "key", "fallback")); err != nil {
+		t.Fatalf("Restore() error = %s", err)
+	}
+
+	got := outputs()
+	want := map[string]string{
+		cacheHitEnvVar:        "exact",
+		matchedKeyEnvVar:      "key",
+		matchedKeyIndexEnvVar: "0",
+		archiveSizeEnvVar:     strconv.Itoa(len(archive)),
+		archiveChecksumEnvVar: hex.EncodeToString(checksum[:]),
+		missReasonEnvVar:      "",
+		restoreOutcomeEnvVar:  outcomeRestored,
+	}
+	for key, value := range want {
+		if got[key] != value {
+			t.Errorf("%s = %q, want %q", key, got[key], value)
+		}
+	}
+	for _, key := range []string{downloadDurationEnvVar, extractionDurationEnvVar} {
+		if _, err := strconv.ParseFloat(got[key], 64); err != nil {
+			t.Errorf("%s = %q, want a duration in seconds", key, got[key])
+		}
+	}
+
+	content, err := os.ReadFile(got[restoreReportEnvVar])
+	if err != nil {
+		t.Fatalf("restore report: %s", err)
+	}
+	var report restoreReport
+	if err := json.Unmarshal(content, &report); err != nil {
+		t.Fatal(err)
+	}
+	wantReport := restoreReportEntry{
+		CacheHit:         "exact",
+		EvaluatedKeys:    []string{"key", "fallback"},
+		MatchedKey:       "key",
+		MatchedKeyIndex:  0,
+		MatchStrategy:    matchStrategyExact,
+		ArchiveSizeBytes: int64(len(archive)),
+		ArchiveChecksum:  hex.EncodeToString(checksum[:]),
+		// Durations depend on the machine
+		DownloadDurationSeconds:   report.DownloadDurationSeconds,
+		ExtractionDurationSeconds: report.ExtractionDurationSeconds,
+		Outcome:                   outcomeRestored,
+	}
+	if !reflect.DeepEqual(report.restoreReportEntry, wantReport) || report.Groups != nil {
+		t.Errorf("report = %+v, want %+v", report, wantReport)
+	}
+}
+
+func TestRestoreOutputsOnMiss(t *testing.T) {
+	outputs := fakeEnvman(t)
+
+	r := newFakeRestorer(t, fakeDownloader{})
+	if err := r.Restore(testInput(t, t.TempDir(), "key")); err != nil {
+		t.Fatalf("Restore() error = %s", err)
+	}
+
+	got := outputs()
+	want := map[string]string{
+		cacheHitEnvVar:           "false",
+		matchedKeyEnvVar:         "",
+		matchedKeyIndexEnvVar:    "",
+		archiveSizeEnvVar:        "",
+		archiveChecksumEnvVar:    "",
+		downloadDurationEnvVar:   "",
+		extractionDurationEnvVar: "",
+		missReasonEnvVar:         missReasonNoMatch,
+		restoreOutcomeEnvVar:     outcomeNotRestored,
+	}
+	for key, value := range want {
+		if gotValue, ok := got[key]; !ok {
+			t.Errorf("%s was not exported", key)
+		} else if gotValue != value {
+			t.Errorf("%s = %q, want %q", key, gotValue, value)
+		}
+	}
+}
@@ -0,0 +1,842 @@
+package cache
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/bitrise-io/go-steputils/v2/export"
+	"github.com/bitrise-io/go-steputils/v2/stepconf"
+	"github.com/bitrise-io/go-utils/v2/command"
+	"github.com/bitrise-io/go-utils/v2/env"
+	"github.com/bitrise-io/go-utils/v2/log"
+	"github.com/bitrise-io/go-utils/v2/pathutil"
+	"github.com/bitrise-steplib/bitrise-step-restore-cache/cache/compression"
+	"github.com/bitrise-steplib/bitrise-step-restore-cache/cache/keytemplate"
+	"github.com/bitrise-steplib/bitrise-step-restore-cache/cache/network"
+	"github.com/docker/go-units"
+)
+
+// RestoreCacheInput is the information that comes from the cache steps that call this shared implementation
+type RestoreCacheInput struct {
+	// StepId identifies the exact cache step. Used for logging events.
+	StepId  string
+	Verbose bool
+	// Keys are key templates in priority order. A key can start with its match mode, such as `[exact] my-key`,
+	// see network.MatchMode. Keys without a match mode use network.MatchPrefix.
+	Keys []string
+	// BaseKey is a key template containing {{ .Branch }}, expanded into a chain of keys appended to Keys:
+	// the exact key, then the prefixes of the current, the PR target and the default branch. Ignored if empty.
+	BaseKey string
+	// DefaultBranch is the default branch of the repository, used by the key chain of BaseKey and the
+	// {{ .DefaultBranch }} template element.
+	DefaultBranch string
+	// IsStrictKeys fails the restore if a key is degraded, instead of logging a warning: a template function fails
+	// or has no input (such as a checksum without matching files), or a referenced template variable is empty.
+	IsStrictKeys bool
+	// Timeout is the overall time limit of the lookup and the download, no limit if zero.
+	Timeout time.Duration
+	// LookupTimeout, DownloadTimeout and ExtractionTimeout are the time budgets of the restore phases, no limit if zero.
+	LookupTimeout     time.Duration
+	DownloadTimeout   time.Duration
+	ExtractionTimeout time.Duration
+	// TimeoutPolicy decides if running out of a time budget fails the restore. Defaults to TimeoutPolicyFail.
+	TimeoutPolicy TimeoutPolicy
+	// DiskSpacePolicy decides if the restore fails when the archive doesn't fit on the disk. Defaults to DiskSpacePolicyFail.
+	// The check uses the archive sizes recorded at upload, it's skipped if they are unknown.
+	DiskSpacePolicy DiskSpacePolicy
+	NumFullRetries  int
+	// ProgressInterval is how often the download and extraction progress is logged. Disabled if zero.
+	ProgressInterval time.Duration
+	// IsStreaming pipes the downloaded archive straight into extraction, so the archive is never stored on disk.
+	IsStreaming bool
+	// IsLookupOnly only looks up the matching cache key, without downloading and extracting the archive.
+	IsLookupOnly bool
+	// Groups are independent caches restored concurrently, each with its own keys and cache hit output.
+	// Keys is ignored when Groups is not empty.
+	Groups []CacheGroup
+	// DestinationDirectory is the root directory of the restored files. Absolute paths in the archive are restored
+	// relative to it. If empty, files are restored to their original location.
+	DestinationDirectory string
+	// PathMappings are `from => to` rules rewriting path prefixes of the archive entries, such as `/home/ubuntu => $HOME`.
+	PathMappings []string
+	// IsAtomic extracts the archive into a staging directory first, and only moves the entries into place
+	// once the whole archive is extracted. Entries moved into place are rolled back if moving the rest fails.
+	IsAtomic bool
+	// IsSafeExtraction rejects archive entries that could write outside of AllowedPaths (path traversal, symlink tricks).
+	IsSafeExtraction bool
+	// AllowedPaths are the root directories safe extraction may write to.
+	// Defaults to the home directory, the working directory and DestinationDirectory.
+	AllowedPaths []string
+	// LocalCacheDirectory is a directory on the local disk where archives are kept for later builds on the same host.
+	// It's checked before downloading from the remote cache. Disabled if empty.
+	LocalCacheDirectory string
+	// LocalCacheMaxSize is the size budget of LocalCacheDirectory in bytes, the least recently used archives are evicted over it.
+	LocalCacheMaxSize int64
+	// Storage selects where the archives are restored from. Defaults to the Bitrise cache API.
+	Storage network.StorageConfig
+	// DownloadTuning are the advanced network settings of the download, zero values select the defaults.
+	DownloadTuning network.DownloadTuning
+	// Network configures the proxies and the TLS settings of the cache requests, the zero value uses the system defaults.
+	Network network.NetworkConfig
+}
+
+// CacheGroup is a named list of cache keys in priority order. Keys work the same way as RestoreCacheInput.Keys.
+// The group's keys are not extended with the key chain of RestoreCacheInput.BaseKey.
+type CacheGroup struct {
+	Name string
+	Keys []string
+	// matchModes are the match modes of the evaluated Keys, by index
+	matchModes []network.MatchMode
+}
+
+// Restorer ...
+type Restorer interface {
+	Restore(input RestoreCacheInput) error
+}
+
+type restoreCacheConfig struct {
+	Verbose bool
+	// Keys are the evaluated keys, shortened by network.ShortenKey
+	Keys []string
+	// MatchModes are the match modes of Keys, by index
+	MatchModes     []network.MatchMode
+	APIBaseURL     stepconf.Secret
+	APIAccessToken stepconf.Secret
+	NumFullRetries int
+	DownloadTuning network.DownloadTuning
+	Network        network.NetworkConfig
+	IsAtomic       bool
+	// LookupTimeout and DownloadTimeout are passed to the downloader, ExtractionTimeout is the budget of Decompression
+	LookupTimeout     time.Duration
+	DownloadTimeout   time.Duration
+	ExtractionTimeout time.Duration
+	TimeoutPolicy     TimeoutPolicy
+	DiskSpacePolicy   DiskSpacePolicy
+	IsStreaming       bool
+	IsLookupOnly      bool
+	Groups            []CacheGroup
+	Decompression     compression.DecompressOptions
+	// LocalCacheDir is the absolute path of the local cache, empty if it's disabled
+	LocalCacheDir     string
+	LocalCacheMaxSize int64
+	Storage           network.StorageConfig
+	ProgressInterval  time.Duration
+}
+
+type restorer struct {
+	envRepo          env.Repository
+	logger           log.Logger
+	cmdFactory       command.Factory
+	downloader       network.Downloader
+	streamDownloader network.StreamDownloader
+	archiveLookup    network.ArchiveLookup
+}
+
+type downloadResult struct {
+	filePath       string
+	matchedKey     string
+	fromLocalCache bool
+}
+
+type restoreResult struct {
+	matchedKey string
+	// matchStrategy tells how the archive of the matched key was found, see BITRISE_CACHE_MATCH_STRATEGY
+	matchStrategy string
+	// outcome is the state the restore left the target locations in, see BITRISE_CACHE_RESTORE_OUTCOME
+	outcome string
+	// missReason is set if there is no matched key, see BITRISE_CACHE_MISS_REASON
+	missReason string
+	checksum   string
+	// lookupOnly is true if the archive was only looked up, but not restored
+	lookupOnly         bool
+	archiveSize        int64
+	downloadDuration   time.Duration
+	extractionDuration time.Duration
+	fromLocalCache     bool
+}
+
+// cacheHitValue compares the matched key with the first key the way it was sent to the storage, shortened by network.ShortenKey.
+func (r restoreResult) cacheHitValue(evaluatedKeys []string) string {
+	switch {
+	case r.matchedKey == "":
+		return "false"
+	case r.matchedKey == network.ShortenKey(evaluatedKeys[0]):
+		return "exact"
+	default:
+		return "partial"
+	}
+}
+
+// NewRestorer creates a new cache restorer instance. `downloader` can be nil, unless you want to provide a custom `Downloader` implementation.
+// Streaming restores are only available if the downloader also implements `StreamDownloader`,
+// lookup-only restores if it implements `ArchiveLookup`.
+func NewRestorer(
+	envRepo env.Repository,
+	logger log.Logger,
+	cmdFactory command.Factory,
+	downloader network.Downloader,
+) *restorer {
+	var downloaderImpl network.Downloader = downloader
+	if downloader == nil {
+		downloaderImpl = network.DefaultDownloader{}
+	}
+	streamDownloader, _ := downloaderImpl.(network.StreamDownloader)
+	archiveLookup, _ := downloaderImpl.(network.ArchiveLookup)
+
+	return &restorer{
+		envRepo:          envRepo,
+		logger:           logger,
+		cmdFactory:       cmdFactory,
+		downloader:       downloaderImpl,
+		streamDownloader: streamDownloader,
+		archiveLookup:    archiveLookup,
+	}
+}
+
+// Restore ...
+func (r *restorer) Restore(input RestoreCacheInput) error {
+	config, err := r.createConfig(input)
+	if err != nil {
+		return fmt.Errorf("failed to parse inputs: %w", err)
+	}
+
+	tracker := newStepTracker(input.StepId, r.envRepo, r.logger)
+	defer tracker.wait()
+
+	ctx := context.Background()
+	cancel := context.CancelFunc(nil)
+	if input.Timeout != 0 {
+		ctx, cancel = context.WithTimeout(ctx, input.Timeout)
+		defer cancel()
+	}
+
+	if len(config.Groups) > 0 {
+		return r.restoreGroups(ctx, config, tracker)
+	}
+
+	result, err := r.restoreArchive(ctx, config, tracker)
+	if err != nil {
+		// The outcome tells the later steps (that run even if this step fails) if the workspace was left unchanged
+		exporter := export.NewExporter(r.cmdFactory)
+		if exportErr := exporter.ExportOutput(restoreOutcomeEnvVar, result.outcome); exportErr != nil {
+			r.logger.Warnf("Failed to export %s: %s", restoreOutcomeEnvVar, exportErr)
+		}
+		return err
+	}
+
+	exporter := export.NewExporter(r.cmdFactory)
+	if err := exporter.ExportOutput(cacheHitEnvVar, result.cacheHitValue(config.Keys)); err != nil {
+		return err
+	}
+	if err := exporter.ExportOutput(matchedKeyEnvVar, result.matchedKey); err != nil {
+		return err
+	}
+	if err := r.exportRestoreOutputs(result, config.Keys); err != nil {
+		return err
+	}
+	if err := r.exportRestoreReport(restoreReport{restoreReportEntry: newRestoreReportEntry(result, config.Keys)}); err != nil {
+		return err
+	}
+	return r.exposeCacheHit(result, config.Keys)
+}
+
+// restoreArchive downloads and extracts the archive matching one of the keys of the config.
+// The result has an empty matched key if there is no archive for any of the keys, if the restore timed out with
+// the warn-and-continue timeout policy, or if the archive doesn't fit on the disk with the skip disk space policy.
+func (r *restorer) restoreArchive(ctx context.Context, config restoreCacheConfig, tracker stepTracker) (restoreResult, error) {
+	result, err := r.restoreMatchingArchive(ctx, config, tracker)
+	result.matchStrategy = matchStrategy(result.matchedKey, config.Keys, config.MatchModes)
+	if result.outcome == "" {
+		result.outcome = outcomeNotRestored
+		if err == nil && result.matchedKey != "" && !result.lookupOnly {
+			result.outcome = outcomeRestored
+		}
+	}
+	if err == nil {
+		return result, nil
+	}
+
+	missReason := continuableMissReason(err, config)
+	if missReason == "" {
+		return restoreResult{outcome: result.outcome}, err
+	}
+	r.logger.Warnf("Continuing without the cache: %s", err)
+	tracker.logRestoreResult(false, "", "", config.Keys, false)
+	return restoreResult{missReason: missReason, lookupOnly: config.IsLookupOnly, outcome: result.outcome}, nil
+}
+
+func (r *restorer) restoreMatchingArchive(ctx context.Context, config restoreCacheConfig, tracker stepTracker) (restoreResult, error) {
+	if config.IsLookupOnly {
+		return r.lookupArchive(ctx, config, tracker)
+	}
+	if config.IsStreaming {
+		return r.restoreStream(ctx, config, tracker)
+	}
+
+	r.logger.Println()
+	r.logger.Infof("Downloading archive...")
+	downloadStartTime := time.Now()
+
+	result, err := r.download(ctx, config)
+	if err != nil {
+		if errors.Is(err, network.ErrCacheNotFound) {
+			r.handleCacheNotFound(config, tracker)
+			return restoreResult{missReason: missReasonNoMatch}, nil
+		}
+		return restoreResult{}, fmt.Errorf("download failed: %w", err)
+	}
+	r.logMatchedKey(result.matchedKey, config.Keys)
+
+	fileInfo, err := os.Stat(result.filePath)
+	if err != nil {
+		return restoreResult{}, err
+	}
+	r.logger.Printf("Archive size: %s", units.HumanSizeWithPrecision(float64(fileInfo.Size()), 3))
+	downloadDuration := time.Since(downloadStartTime)
+	downloadTime := downloadDuration.Round(time.Second)
+	r.logger.Donef("Downloaded archive in %s", downloadTime)
+	tracker.logArchiveDownloaded(downloadTime, fileInfo.Size(), len(config.Keys), false)
+
+	r.logger.Println()
+	r.logger.Infof("Restoring archive...")
+	extractionStartTime := time.Now()
+	archiver := compression.NewArchiver(
+		r.logger,
+		r.envRepo,
+		compression.NewDependencyChecker(r.logger, r.envRepo))
+
+	extractCtx, cancelExtraction := extractionContext(ctx, config.ExtractionTimeout)
+	defer cancelExtraction()
+	if err := r.decompress(extractCtx, archiver, result.filePath, config); err != nil {
+		if config.TimeoutPolicy == TimeoutPolicyWarnAndContinue && errors.Is(err, errExtractionTimedOut) {
+			r.removeDownloadedArchive(result.filePath)
+		}
+		return restoreResult{outcome: failureOutcome(err, config.IsAtomic)}, err
+	}
+	extractionDuration := time.Since(extractionStartTime)
+	extractionTime := extractionDuration.Round(time.Second)
+	r.logger.Donef("Restored archive in %s", extractionTime)
+	tracker.logArchiveExtracted(extractionTime, len(config.Keys), false)
+
+	checksum, err := checksumOfFile(result.filePath)
+	if err != nil {
+		return restoreResult{}, err
+	}
+
+	tracker.logRestoreResult(true, result.matchedKey, matchStrategy(result.matchedKey, config.Keys, config.MatchModes), config.Keys, result.fromLocalCache)
+	return restoreResult{
+		matchedKey:         result.matchedKey,
+		checksum:           checksum,
+		archiveSize:        fileInfo.Size(),
+		downloadDuration:   downloadDuration,
+		extractionDuration: extractionDuration,
+		fromLocalCache:     result.fromLocalCache,
+	}, nil
+}
+
+// lookupArchive finds the archive matching one of the keys of the config, without downloading it.
+func (r *restorer) lookupArchive(ctx context.Context, config restoreCacheConfig, tracker stepTracker) (restoreResult, error) {
+	r.logger.Println()
+	r.logger.Infof("Looking up cache archive (lookup only mode)...")
+
+	archive, err := r.archiveLookup.Lookup(ctx, r.downloadParams(config, ""), r.logger)
+	if err != nil {
+		if errors.Is(err, network.ErrCacheNotFound) {
+			r.logger.Donef("No cache entry found for the provided key")
+			tracker.logLookupResult(false, "", "", config.Keys)
+			return restoreResult{lookupOnly: true, missReason: missReasonNoMatch}, nil
+		}
+		return restoreResult{}, fmt.Errorf("lookup failed: %w", err)
+	}
+
+	r.logMatchedKey(archive.MatchedKey, config.Keys)
+	if archive.Size > 0 {
+		r.logger.Printf("Archive size: %s", units.HumanSizeWithPrecision(float64(archive.Size), 3))
+	}
+	r.logger.Donef("Archive was not downloaded (lookup only mode)")
+
+	tracker.logLookupResult(true, archive.MatchedKey, matchStrategy(archive.MatchedKey, config.Keys, config.MatchModes), config.Keys)
+	return restoreResult{matchedKey: archive.MatchedKey, checksum: archive.Checksum, archiveSize: archive.Size, lookupOnly: true}, nil
+}
+
+// restoreStream extracts the archive while it is being downloaded. The archive checksum is computed from the stream.
+func (r *restorer) restoreStream(ctx context.Context, config restoreCacheConfig, tracker stepTracker) (restoreResult, error) {
+	r.logger.Println()
+	r.logger.Infof("Downloading and restoring archive...")
+	startTime := time.Now()
+
+	params := r.downloadParams(config, "")
+	archive, err := r.streamDownloader.Lookup(ctx, params, r.logger)
+	if err != nil {
+		if errors.Is(err, network.ErrCacheNotFound) {
+			r.handleCacheNotFound(config, tracker)
+			return restoreResult{missReason: missReasonNoMatch}, nil
+		}
+		return restoreResult{}, fmt.Errorf("download failed: %w", err)
+	}
+	r.logMatchedKey(archive.MatchedKey, config.Keys)
+
+	pipeReader, pipeWriter := io.Pipe()
+	hash := sha256.New()
+	counter := &countingWriter{}
+	var downloadDuration time.Duration
+	downloadErrC := make(chan error, 1)
+	go func() {
+		err := r.streamDownloader.DownloadStream(ctx, archive, params, io.MultiWriter(pipeWriter, hash, counter), r.logger)
+		downloadDuration = time.Since(startTime)
+		// A nil error closes the pipe with io.EOF
+		pipeWriter.CloseWithError(err) //nolint:errcheck
+		downloadErrC <- err
+	}()
+
+	archiver := compression.NewArchiver(
+		r.logger,
+		r.envRepo,
+		compression.NewDependencyChecker(r.logger, r.envRepo))
+
+	// Extraction overlaps the download, so both the download and the extraction budget limit it
+	extractCtx, cancelExtraction := extractionContext(ctx, config.ExtractionTimeout)
+	defer cancelExtraction()
+	stopInterrupt := context.AfterFunc(extractCtx, func() {
+		// Unblocks the extractor waiting for the next chunk of the download
+		pipeReader.CloseWithError(extractCtx.Err()) //nolint:errcheck
+	})
+	defer stopInterrupt()
+
+	// Everything but the end of an archive with a recorded checksum reaches the extractor before the checksum is checked,
+	// so it's always staged: a corrupted archive must never land in the workspace. The size alone doesn't count,
+	// the preflight check probes it from the server for almost every archive.
+	isAtomic := config.IsAtomic
+	if !isAtomic && archive.Checksum != "" {
+		r.logger.Printf("Extracting into a staging directory until the archive integrity is verified")
+		isAtomic = true
+	}
+
+	var staged *compression.StagedRestore
+	var extractErr error
+	if isAtomic {
+		staged, extractErr = archiver.StageStream(extractCtx, pipeReader, config.Decompression)
+	} else {
+		extractErr = archiver.DecompressStream(extractCtx, pipeReader, config.Decompression)
+	}
+	if extractErr != nil {
+		// Abort the download, there is no point in fetching the rest of the archive
+		pipeReader.CloseWithError(extractErr) //nolint:errcheck
+	} else {
+		// The extractor might stop reading before the end of the stream (such as tar's zero padding),
+		// but the checksum has to cover the whole archive.
+		_, extractErr = io.Copy(io.Discard, pipeReader)
+	}
+
+	downloadErr := <-downloadErrC
+	failure := restoreResult{outcome: failureOutcome(nil, isAtomic)}
+	if staged != nil && (downloadErr != nil || extractErr != nil || extractCtx.Err() != nil) {
+		// The archive is only moved into place once the whole stream is downloaded and verified
+		staged.Discard()
+	}
+	if extractCtx.Err() != nil {
+		// The interrupted extraction closed the stream, which failed the download too
+		return failure, extractionError(extractCtx, extractCtx.Err())
+	}
+	if downloadErr != nil {
+		return failure, fmt.Errorf("download failed: %w", downloadErr)
+	}
+	if extractErr != nil {
+		return failure, extractionError(extractCtx, extractErr)
+	}
+	if staged != nil {
+		r.logger.Debugf("Moving restored files into place")
+		if err := staged.Commit(); err != nil {
+			return restoreResult{outcome: failureOutcome(err, true)}, err
+		}
+	}
+
+	r.logger.Printf("Archive size: %s", units.HumanSizeWithPrecision(float64(counter.count), 3))
+	downloadTime := downloadDuration.Round(time.Second)
+	r.logger.Donef("Downloaded archive in %s", downloadTime)
+	tracker.logArchiveDownloaded(downloadTime, counter.count, len(config.Keys), true)
+
+	// Extraction overlaps the download, its duration covers the whole restore
+	extractionDuration := time.Since(startTime)
+	extractionTime := extractionDuration.Round(time.Second)
+	r.logger.Donef("Restored archive in %s", extractionTime)
+	tracker.logArchiveExtracted(extractionTime, len(config.Keys), true)
+
+	tracker.logRestoreResult(true, archive.MatchedKey, matchStrategy(archive.MatchedKey, config.Keys, config.MatchModes), config.Keys, archive.FromLocalCache)
+	return restoreResult{
+		matchedKey:         archive.MatchedKey,
+		checksum:           hex.EncodeToString(hash.Sum(nil)),
+		archiveSize:        counter.count,
+		downloadDuration:   downloadDuration,
+		extractionDuration: extractionDuration,
+		fromLocalCache:     archive.FromLocalCache,
+	}, nil
+}
+
+func (r *restorer) createConfig(input RestoreCacheInput) (restoreCacheConfig, error) {
+	storage, err := r.storageConfig(input.Storage)
+	if err != nil {
+		return restoreCacheConfig{}, err
+	}
+
+	var apiBaseURL, apiAccessToken string
+	if storage.Backend == network.StorageBitrise {
+		apiBaseURL = r.envRepo.Get("BITRISEIO_ABCS_API_URL")
+		if apiBaseURL == "" {
+			return restoreCacheConfig{}, fmt.Errorf("the secret 'BITRISEIO_ABCS_API_URL' is not defined")
+		}
+		apiAccessToken = r.envRepo.Get("BITRISEIO_BITRISE_SERVICES_ACCESS_TOKEN")
+		if apiAccessToken == "" {
+			return restoreCacheConfig{}, fmt.Errorf("the secret 'BITRISEIO_BITRISE_SERVICES_ACCESS_TOKEN' is not defined")
+		}
+	}
+
+	if err := input.DownloadTuning.Validate(); err != nil {
+		return restoreCacheConfig{}, fmt.Errorf("invalid download settings: %w", err)
+	}
+	timeoutPolicy, err := validateTimeoutPolicy(input.TimeoutPolicy)
+	if err != nil {
+		return restoreCacheConfig{}, err
+	}
+	diskSpacePolicy, err := validateDiskSpacePolicy(input.DiskSpacePolicy)
+	if err != nil {
+		return restoreCacheConfig{}, err
+	}
+	if err := input.Network.Validate(); err != nil {
+		return restoreCacheConfig{}, fmt.Errorf("invalid network settings: %w", err)
+	}
+	if input.Network != (network.NetworkConfig{}) {
+		input.Network.LogEffectiveSettings(r.logger)
+	}
+
+	if input.IsLookupOnly && r.archiveLookup == nil {
+		return restoreCacheConfig{}, fmt.Errorf("the configured downloader doesn't support lookup only mode")
+	}
+
+	isStreaming := input.IsStreaming
+	if isStreaming && r.streamDownloader == nil {
+		r.logger.Warnf("The configured downloader doesn't support streaming, falling back to downloading the archive to disk")
+		isStreaming = false
+	}
+	if !input.IsLookupOnly {
+		input.DownloadTuning.LogEffectiveSettings(isStreaming, r.logger)
+	}
+	isAtomic := input.IsAtomic
+	// A streamed archive is extracted while it's downloaded, so the download and the overall timeout interrupt the extraction too
+	canInterruptExtraction := input.ExtractionTimeout > 0 || (isStreaming && (input.Timeout > 0 || input.DownloadTimeout > 0))
+	if !isAtomic && timeoutPolicy == TimeoutPolicyWarnAndContinue && canInterruptExtraction {
+		// A timed out extraction continues as a cache miss, so it must not leave partially extracted files behind
+		r.logger.Printf("Extracting into a staging directory, so a timed out extraction leaves the workspace unchanged")
+		isAtomic = true
+	}
+	if !isAtomic && isStreaming && input.IsSafeExtraction {
+		// A stream can't be validated before the extraction, the entries preceding an unsafe one are already extracted
+		r.logger.Printf("Extracting into a staging directory, so an unsafe archive entry leaves the workspace unchanged")
+		isAtomic = true
+	}
+
+	destinationDirectory := ""
+	if input.DestinationDirectory != "" {
+		destinationDirectory, err = pathutil.NewPathModifier().AbsPath(input.DestinationDirectory)
+		if err != nil {
+			return restoreCacheConfig{}, fmt.Errorf("invalid destination directory: %w", err)
+		}
+	}
+	pathMappings, err := parsePathMappings(input.PathMappings)
+	if err != nil {
+		return restoreCacheConfig{}, err
+	}
+	localCacheDir := ""
+	if input.LocalCacheDirectory != "" {
+		localCacheDir, err = pathutil.NewPathModifier().AbsPath(input.LocalCacheDirectory)
+		if err != nil {
+			return restoreCacheConfig{}, fmt.Errorf("invalid local cache directory: %w", err)
+		}
+		if input.LocalCacheMaxSize <= 0 {
+			return restoreCacheConfig{}, fmt.Errorf("local cache size budget must be positive, got %d", input.LocalCacheMaxSize)
+		}
+	}
+	var allowedPaths []string
+	if input.IsSafeExtraction {
+		allowedPaths, err = r.allowedPaths(input.AllowedPaths, destinationDirectory)
+		if err != nil {
+			return restoreCacheConfig{}, err
+		}
+	}
+
+	model := keytemplate.NewModel(r.envRepo, r.logger).
+		WithCommandFactory(r.cmdFactory).
+		WithDefaultBranch(input.DefaultBranch).
+		WithStrict(input.IsStrictKeys)
+	var report keyReport
+	keys, matchModes, groups, err := r.evaluateAllKeys(model, input, storage, &report)
+	// The report is exported even if the evaluation failed, it tells why
+	if exportErr := r.exportKeyReport(report); exportErr != nil {
+		r.logger.Warnf("Failed to export the key explanation report: %s", exportErr)
+	}
+	if err != nil {
+		return restoreCacheConfig{}, err
+	}
+
+	return restoreCacheConfig{
+		Verbose:           input.Verbose,
+		Keys:              keys,
+		MatchModes:        matchModes,
+		APIBaseURL:        stepconf.Secret(apiBaseURL),
+		APIAccessToken:    stepconf.Secret(apiAccessToken),
+		NumFullRetries:    input.NumFullRetries,
+		DownloadTuning:    input.DownloadTuning,
+		Network:           input.Network,
+		IsStreaming:       isStreaming,
+		IsAtomic:          isAtomic,
+		LookupTimeout:     input.LookupTimeout,
+		DownloadTimeout:   input.DownloadTimeout,
+		ExtractionTimeout: input.ExtractionTimeout,
+		TimeoutPolicy:     timeoutPolicy,
+		DiskSpacePolicy:   diskSpacePolicy,
+		IsLookupOnly:      input.IsLookupOnly,
+		Groups:            groups,
+		Decompression: compression.DecompressOptions{
+			DestinationDirectory: destinationDirectory,
+			PathMappings:         pathMappings,
+			SafeExtraction:       input.IsSafeExtraction,
+			AllowedPaths:         allowedPaths,
+			ProgressInterval:     input.ProgressInterval,
+		},
+		LocalCacheDir:     localCacheDir,
+		LocalCacheMaxSize: input.LocalCacheMaxSize,
+		Storage:           storage,
+		ProgressInterval:  input.ProgressInterval,
+	}, nil
+}
+
+func (r *restorer) storageConfig(storage network.StorageConfig) (network.StorageConfig, error) {
+	if storage.Backend == "" {
+		storage.Backend = network.StorageBitrise
+	}
+	if err := network.ValidateStorageConfig(storage); err != nil {
+		return network.StorageConfig{}, fmt.Errorf("invalid storage: %w", err)
+	}
+
+	if storage.Backend == network.StorageFilesystem {
+		dir, err := pathutil.NewPathModifier().AbsPath(storage.Path)
+		if err != nil {
+			return network.StorageConfig{}, fmt.Errorf("invalid storage directory: %w", err)
+		}
+		storage.Path = dir
+	}
+	if storage.Backend != network.StorageBitrise {
+		r.logger.Printf("Restoring from %s storage: %s", storage.Backend, storage.Path)
+	}
+
+	return storage, nil
+}
+
+func (r *restorer) allowedPaths(paths []string, destinationDirectory string) ([]string, error) {
+	pathModifier := pathutil.NewPathModifier()
+
+	var allowedPaths []string
+	for _, path := range paths {
+		if strings.TrimSpace(path) == "" {
+			continue
+		}
+		absPath, err := pathModifier.AbsPath(strings.TrimSpace(path))
+		if err != nil {
+			return nil, fmt.Errorf("invalid allowed path %s: %w", path, err)
+		}
+		allowedPaths = append(allowedPaths, absPath)
+	}
+	if len(allowedPaths) > 0 {
+		return allowedPaths, nil
+	}
+
+	homeDir, err := pathModifier.AbsPath("~")
+	if err != nil {
+		return nil, err
+	}
+	workDir, err := os.Getwd()
+	if err != nil {
+		return nil, err
+	}
+	allowedPaths = []string{homeDir, workDir}
+	if destinationDirectory != "" {
+		allowedPaths = append(allowedPaths, destinationDirectory)
+	}
+	r.logger.Debugf("Safe extraction is allowed to write to: %s", strings.Join(allowedPaths, ", "))
+
+	return allowedPaths, nil
+}
+
+// evaluateAllKeys evaluates the keys of the cache groups, or else the keys and the key chain of the base key.
+// The evaluated keys are validated right away, before anything is sent to the storage.
+func (r *restorer) evaluateAllKeys(model keytemplate.Model, input RestoreCacheInput, storage network.StorageConfig, report *keyReport) ([]string, []network.MatchMode, []CacheGroup, error) {
+	var groups []CacheGroup
+	if len(input.Groups) > 0 {
+		for _, group := range input.Groups {
+			r.logger.Println()
+			r.logger.Infof("Evaluating keys of cache group %s", group.Name)
+			groupKeys, groupMatchModes, err := r.evaluateKeys(model, group.Keys, group.Name, report)
+			if err != nil {
+				return nil, nil, nil, fmt.Errorf("failed to evaluate keys of cache group %s: %w", group.Name, err)
+			}
+			if len(groupKeys) == 0 {
+				return nil, nil, nil, fmt.Errorf("cache group %s has no keys", group.Name)
+			}
+			if err := validateKeyCount(groupKeys); err != nil {
+				return nil, nil, nil, fmt.Errorf("invalid keys of cache group %s: %w", group.Name, err)
+			}
+			if err := network.ValidateMatchModes(groupMatchModes, storage); err != nil {
+				return nil, nil, nil, fmt.Errorf("invalid keys of cache group %s: %w", group.Name, err)
+			}
+			groups = append(groups, CacheGroup{Name: group.Name, Keys: groupKeys, matchModes: groupMatchModes})
+		}
+		if err := validateKeys(*report); err != nil {
+			return nil, nil, nil, err
+		}
+		return nil, nil, groups, nil
+	}
+
+	evaluatedKeys, evaluatedMatchModes, err := r.evaluateKeys(model, input.Keys, "", report)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to evaluate keys: %w", err)
+	}
+	if err := validateKeyCount(evaluatedKeys); err != nil {
+		return nil, nil, nil, fmt.Errorf("invalid keys: %w", err)
+	}
+	if strings.TrimSpace(input.BaseKey) != "" {
+		chainKeys, chainMatchModes, err := r.expandKeyChain(model, strings.TrimSpace(input.BaseKey), report)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		evaluatedKeys, evaluatedMatchModes = r.appendKeyChain(evaluatedKeys, evaluatedMatchModes, chainKeys, chainMatchModes)
+	}
+	if err := validateKeys(*report); err != nil {
+		return nil, nil, nil, err
+	}
+	if err := network.ValidateMatchModes(evaluatedMatchModes, storage); err != nil {
+		return nil, nil, nil, fmt.Errorf("invalid keys: %w", err)
+	}
+	return evaluatedKeys, evaluatedMatchModes, nil, nil
+}
+
+// evaluateKeys evaluates the key templates, and returns the keys together with their match modes.
+func (r *restorer) evaluateKeys(model keytemplate.Model, keys []string, group string, report *keyReport) ([]string, []network.MatchMode, error) {
+	var evaluatedKeys []string
+	var matchModes []network.MatchMode
+	for _, key := range keys {
+		if key == "" {
+			continue
+		}
+		matchMode, key, err := parseKeyMatchMode(key)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		r.logger.Println()
+		r.logger.Printf("Evaluating key template: %s", key)
+		evaluatedKey, err := r.explainKey(model, key, matchMode, group, report)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to evaluate key template: %s", err)
+		}
+		if matchMode != network.MatchPrefix {
+			r.logger.Donef("Cache key: %s (match mode: %s)", evaluatedKey, matchMode)
+		} else {
+			r.logger.Donef("Cache key: %s", evaluatedKey)
+		}
+		evaluatedKeys = append(evaluatedKeys, evaluatedKey)
+		matchModes = append(matchModes, matchMode)
+	}
+
+	return evaluatedKeys, matchModes, nil
+}
+
+func (r *restorer) downloadParams(config restoreCacheConfig, downloadPath string) network.DownloadParams {
+	return network.DownloadParams{
+		APIBaseURL:        string(config.APIBaseURL),
+		Token:             string(config.APIAccessToken),
+		CacheKeys:         config.Keys,
+		MatchModes:        config.MatchModes,
+		DownloadPath:      downloadPath,
+		NumFullRetries:    config.NumFullRetries,
+		Tuning:            config.DownloadTuning,
+		Network:           config.Network,
+		LocalCacheDir:     config.LocalCacheDir,
+		LocalCacheMaxSize: config.LocalCacheMaxSize,
+		Storage:           config.Storage,
+		ProgressInterval:  config.ProgressInterval,
+		LookupTimeout:     config.LookupTimeout,
+		DownloadTimeout:   config.DownloadTimeout,
+		// Under the warn-and-continue policy the build goes on without the cache, nothing would resume the download
+		DiscardPartialOnTimeout: config.TimeoutPolicy == TimeoutPolicyWarnAndContinue,
+		Preflight:               r.diskSpacePreflight(config),
+	}
+}
+
+func (r *restorer) download(ctx context.Context, config restoreCacheConfig) (downloadResult, error) {
+	dir, err := os.MkdirTemp("", "restore-cache")
+	if err != nil {
+		return downloadResult{}, err
+	}
+	name := fmt.Sprintf("cache-%s.tzst", time.Now().UTC().Format("20060102-150405"))
+	downloadPath := filepath.Join(dir, name)
+
+	archive, err := r.downloader.Download(ctx, r.downloadParams(config, downloadPath), r.logger)
+	if err != nil {
+		// An interrupted download is kept by the downloader (for resuming it) outside of this directory
+		os.RemoveAll(dir) //nolint:errcheck
+		return downloadResult{}, err
+	}
+
+	r.logger.Debugf("Archive downloaded to %s", downloadPath)
+
+	return downloadResult{filePath: downloadPath, matchedKey: archive.MatchedKey, fromLocalCache: archive.FromLocalCache}, nil
+}
+
+func (r *restorer) handleCacheNotFound(config restoreCacheConfig, tracker stepTracker) {
+	r.logger.Donef("No cache entry found for the provided key")
+	tracker.logRestoreResult(false, "", "", config.Keys, false)
+}
+
+func (r *restorer) logMatchedKey(matchedKey string, evaluatedKeys []string) {
+	if matchedKey == evaluatedKeys[0] {
+		r.logger.Printf("Exact hit for first key")
+	} else {
+		r.logger.Printf("Cache hit for key: %s", matchedKey)
+	}
+}
+
+// exposeCacheHit exports the checksum of the restored archive for the Save Cache step, so it can skip uploading an unchanged archive.
+func (r *restorer) exposeCacheHit(result restoreResult, evaluatedKeys []string) error {
+	if result.matchedKey == "" || len(evaluatedKeys) == 0 {
+		return nil
+	}
+
+	err := r.envRepo.Set(cacheHitEnvVar, result.cacheHitValue(evaluatedKeys))
+	if err != nil {
+		return err
+	}
+	if result.lookupOnly {
+		// Nothing was restored, so Save Cache must not skip uploading based on the checksum of this archive
+		return nil
+	}
+
+	r.logger.Debugf("Exposing cache hit info:")
+	r.logger.Debugf("Matched key: %s", result.matchedKey)
+	r.logger.Debugf("Archive checksum: %s", result.checksum)
+
+	exporter := export.NewExporter(r.cmdFactory)
+	envKey := cacheHitUniqueEnvVarPrefix + result.matchedKey
+	err = exporter.ExportOutput(envKey, result.checksum)
+	if err != nil {
+		return err
+	}
+	return r.envRepo.Set(envKey, result.checksum)
+}
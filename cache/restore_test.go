@@ -0,0 +1,308 @@
+package cache
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/bitrise-io/go-utils/v2/command"
+	"github.com/bitrise-io/go-utils/v2/env"
+	"github.com/bitrise-io/go-utils/v2/log"
+	"github.com/bitrise-steplib/bitrise-step-restore-cache/cache/network"
+	"github.com/klauspost/compress/zstd"
+)
+
+// fakeDownloader serves archives by cache key, it implements every downloader interface of the network package.
+type fakeDownloader struct {
+	archives map[string][]byte
+	// errs fail the lookup of a key
+	errs map[string]error
+	// stall streams the first half of the archive only, then waits until the context is done
+	stall bool
+	// uncompressedSize is reported by the lookup for every archive
+	uncompressedSize int64
+}
+
+func (d fakeDownloader) Lookup(_ context.Context, params network.DownloadParams, _ log.Logger) (network.ArchiveInfo, error) {
+	for _, key := range params.CacheKeys {
+		if err := d.errs[key]; err != nil {
+			return network.ArchiveInfo{}, err
+		}
+		if archive, ok := d.archives[key]; ok {
+			return network.ArchiveInfo{MatchedKey: key, Size: int64(len(archive)), UncompressedSize: d.uncompressedSize}, nil
+		}
+	}
+	return network.ArchiveInfo{}, network.ErrCacheNotFound
+}
+
+func (d fakeDownloader) Download(ctx context.Context, params network.DownloadParams, logger log.Logger) (network.ArchiveInfo, error) {
+	archive, err := d.Lookup(ctx, params, logger)
+	if err != nil {
+		return network.ArchiveInfo{}, err
+	}
+	if params.Preflight != nil {
+		if err := params.Preflight(archive); err != nil {
+			return network.ArchiveInfo{}, err
+		}
+	}
+	return archive, os.WriteFile(params.DownloadPath, d.archives[archive.MatchedKey], 0644)
+}
+
+func (d fakeDownloader) DownloadStream(ctx context.Context, archive network.ArchiveInfo, _ network.DownloadParams, dest io.Writer, _ log.Logger) error {
+	content := d.archives[archive.MatchedKey]
+	if !d.stall {
+		_, err := dest.Write(content)
+		return err
+	}
+	if _, err := dest.Write(content[:len(content)/2]); err != nil {
+		return err
+	}
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+// downloadOnly hides the lookup and streaming support of the wrapped downloader.
+type downloadOnly struct {
+	network.Downloader
+}
+
+func newFakeRestorer(t *testing.T, downloader network.Downloader) *restorer {
+	t.Helper()
+	t.Setenv("ANALYTICS_DISABLED", "true")
+	envRepo := env.NewRepository()
+	return NewRestorer(envRepo, log.NewLogger(), command.NewFactory(envRepo), downloader)
+}
+
+// testInput is a restore from the filesystem storage (served by a fake downloader) into destination.
+func testInput(t *testing.T, destination string, keys ...string) RestoreCacheInput {
+	t.Helper()
+	return RestoreCacheInput{
+		Keys:                 keys,
+		NumFullRetries:       3,
+		DestinationDirectory: destination,
+		Storage:              network.StorageConfig{Backend: network.StorageFilesystem, Path: t.TempDir()},
+	}
+}
+
+type archiveEntry struct {
+	name    string
+	content []byte
+}
+
+// testArchive returns a zstd compressed tar archive of regular files.
+func testArchive(t *testing.T, entries ...archiveEntry) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw, err := zstd.NewWriter(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tw := tar.NewWriter(zw)
+	for _, entry := range entries {
+		if err := tw.WriteHeader(&tar.Header{Name: entry.name, Mode: 0644, Size: int64(len(entry.content)), Typeflag: tar.TypeReg}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(entry.content); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// fakeEnvman puts an envman stub on the PATH, and returns the outputs exported through it so far.
+func fakeEnvman(t *testing.T) func() map[string]string {
+	t.Helper()
+	dir := t.TempDir()
+	outputsPath := filepath.Join(dir, "outputs")
+	script := `#!/bin/sh
+while [ $# -gt 0 ]; do
+	case "$1" in
+		--key) key="$2"; shift ;;
+		--value) value="$2"; shift ;;
+	esac
+	shift
+done
+printf '%s=%s\n' "$key" "$value" >> "` + outputsPath + `"
+`
+	if err := os.WriteFile(filepath.Join(dir, "envman"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	return func() map[string]string {
+		outputs := map[string]string{}
+		file, err := os.Open(outputsPath)
+		if err != nil {
+			return outputs
+		}
+		defer file.Close() //nolint:errcheck
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			key, value, _ := strings.Cut(scanner.Text(), "=")
+			outputs[key] = value
+		}
+		return outputs
+	}
+}
+
+func TestRestoreStream(t *testing.T) {
+	outputs := fakeEnvman(t)
+	archive := testArchive(t,
+		archiveEntry{name: "node_modules/a.js", content: []byte("a")},
+		archiveEntry{name: "node_modules/b.js", content: []byte("b")},
+	)
+	checksum := sha256.Sum256(archive)
+	destination := t.TempDir()
+	tempDir := t.TempDir()
+	t.Setenv("TMPDIR", tempDir)
+
+	r := newFakeRestorer(t, fakeDownloader{archives: map[string][]byte{"npm-fallback": archive}})
+	input := testInput(t, destination, "npm-lockfile", "npm-fallback")
+	input.IsStreaming = true
+	if err := r.Restore(input); err != nil {
+		t.Fatalf("Restore() error = %s", err)
+	}
+
+	for _, name := range []string{"a.js", "b.js"} {
+		if _, err := os.Stat(filepath.Join(destination, "node_modules", name)); err != nil {
+			t.Errorf("archive was not extracted: %s", err)
+		}
+	}
+	got := outputs()
+	want := map[string]string{
+		cacheHitEnvVar:        "partial",
+		matchedKeyEnvVar:      "npm-fallback",
+		archiveChecksumEnvVar: hex.EncodeToString(checksum[:]),
+	}
+	for key, value := range want {
+		if got[key] != value {
+			t.Errorf("%s = %q, want %q", key, got[key], value)
+		}
+	}
+	// The streamed archive is never stored on disk
+	filepath.WalkDir(tempDir, func(path string, _ fs.DirEntry, err error) error { //nolint:errcheck
+		if err == nil && strings.HasSuffix(path, ".tzst") {
+			t.Errorf("archive was written to %s", path)
+		}
+		return nil
+	})
+}
+
+// TestStreamingSafeExtractionLeavesTargetUntouched streams an archive with an unsafe entry following a safe one.
+// A stream can't be validated up front, so the safe entry must not be extracted to the destination either.
+func TestStreamingSafeExtractionLeavesTargetUntouched(t *testing.T) {
+	fakeEnvman(t)
+	archive := testArchive(t,
+		archiveEntry{name: "node_modules/a.js", content: []byte("a")},
+		archiveEntry{name: "../escape.js", content: []byte("escape")},
+	)
+	parent := t.TempDir()
+	destination := filepath.Join(parent, "destination")
+
+	r := newFakeRestorer(t, fakeDownloader{archives: map[string][]byte{"npm": archive}})
+	input := testInput(t, destination, "npm")
+	input.IsStreaming = true
+	input.IsSafeExtraction = true
+	if err := r.Restore(input); err == nil {
+		t.Fatalf("Restore() error = nil, want the unsafe entry error")
+	}
+
+	for _, path := range []string{filepath.Join(destination, "node_modules", "a.js"), filepath.Join(parent, "escape.js")} {
+		if _, err := os.Lstat(path); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("%s was extracted", path)
+		}
+	}
+}
+
+func TestStreamingFallsBackWithoutStreamDownloader(t *testing.T) {
+	archive := testArchive(t, archiveEntry{name: "a.txt", content: []byte("a")})
+	downloader := downloadOnly{fakeDownloader{archives: map[string][]byte{"key": archive}}}
+	destination := t.TempDir()
+
+	r := newFakeRestorer(t, downloader)
+	input := testInput(t, destination, "key")
+	input.IsStreaming = true
+	config, err := r.createConfig(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.IsStreaming {
+		t.Fatalf("streaming is enabled for a downloader without streaming support")
+	}
+
+	result, err := r.restoreArchive(context.Background(), config, newStepTracker("", r.envRepo, r.logger))
+	if err != nil {
+		t.Fatalf("restoreArchive() error = %s", err)
+	}
+	if result.matchedKey != "key" || result.outcome != outcomeRestored {
+		t.Errorf("matched key = %q, outcome = %s, want key and %s", result.matchedKey, result.outcome, outcomeRestored)
+	}
+	if _, err := os.Stat(filepath.Join(destination, "a.txt")); err != nil {
+		t.Errorf("archive was not extracted: %s", err)
+	}
+}
+
+func TestLookupOnly(t *testing.T) {
+	outputs := fakeEnvman(t)
+	archive := testArchive(t, archiveEntry{name: "a.txt", content: []byte("a")})
+	destination := t.TempDir()
+
+	r := newFakeRestorer(t, fakeDownloader{archives: map[string][]byte{"fallback": archive}})
+	input := testInput(t, destination, "primary", "fallback")
+	input.IsLookupOnly = true
+	if err := r.Restore(input); err != nil {
+		t.Fatalf("Restore() error = %s", err)
+	}
+
+	entries, err := os.ReadDir(destination)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) > 0 {
+		t.Errorf("lookup only mode extracted the archive")
+	}
+	got := outputs()
+	want := map[string]string{
+		cacheHitEnvVar:         "partial",
+		matchedKeyEnvVar:       "fallback",
+		matchedKeyIndexEnvVar:  "1",
+		archiveSizeEnvVar:      strconv.Itoa(len(archive)),
+		downloadDurationEnvVar: "",
+		restoreOutcomeEnvVar:   outcomeNotRestored,
+	}
+	for key, value := range want {
+		if got[key] != value {
+			t.Errorf("%s = %q, want %q", key, got[key], value)
+		}
+	}
+	// Save Cache must not skip the upload based on an archive that wasn't restored
+	if _, ok := got[cacheHitUniqueEnvVarPrefix+"fallback"]; ok {
+		t.Errorf("checksum of the matched archive was exposed to Save Cache")
+	}
+}
+
+func TestLookupOnlyNeedsLookupSupport(t *testing.T) {
+	r := newFakeRestorer(t, downloadOnly{fakeDownloader{}})
+	input := testInput(t, t.TempDir(), "key")
+	input.IsLookupOnly = true
+	if _, err := r.createConfig(input); err == nil {
+		t.Errorf("createConfig() succeeded for a downloader without lookup support")
+	}
+}
@@ -0,0 +1,104 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/bitrise-steplib/bitrise-step-restore-cache/cache/network"
+)
+
+// TimeoutPolicy decides what happens if a phase of the restore runs out of its time budget.
+type TimeoutPolicy string
+
+const (
+	// TimeoutPolicyFail fails the restore.
+	TimeoutPolicyFail TimeoutPolicy = "fail"
+	// TimeoutPolicyWarnAndContinue removes the partially downloaded archive and continues as a cache miss.
+	// With an extraction timeout (or any timeout when streaming), the archive is always extracted into a staging directory,
+	// which is discarded on timeout.
+	TimeoutPolicyWarnAndContinue TimeoutPolicy = "warn-and-continue"
+)
+
+const missReasonEnvVar = "BITRISE_CACHE_MISS_REASON"
+
+// Values of BITRISE_CACHE_MISS_REASON, it's empty if the archive was restored (or found in lookup only mode).
+const (
+	missReasonNoMatch           = "no_match"
+	missReasonLookupTimeout     = "lookup_timeout"
+	missReasonDownloadTimeout   = "download_timeout"
+	missReasonExtractionTimeout = "extraction_timeout"
+	// missReasonInsufficientDiskSpace is set if the archive was skipped by the disk space pre-flight check
+	missReasonInsufficientDiskSpace = "insufficient_disk_space"
+)
+
+var errExtractionTimedOut = errors.New("archive extraction timed out")
+
+func validateTimeoutPolicy(policy TimeoutPolicy) (TimeoutPolicy, error) {
+	switch policy {
+	case "":
+		return TimeoutPolicyFail, nil
+	case TimeoutPolicyFail, TimeoutPolicyWarnAndContinue:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("unknown timeout policy: %s", policy)
+	}
+}
+
+// timeoutMissReason returns the miss reason of a restore that failed with err, or an empty string if err is not a timeout.
+func timeoutMissReason(err error) string {
+	switch {
+	case errors.Is(err, errExtractionTimedOut):
+		return missReasonExtractionTimeout
+	case errors.Is(err, network.ErrLookupTimedOut):
+		return missReasonLookupTimeout
+	case errors.Is(err, network.ErrDownloadTimedOut), errors.Is(err, context.DeadlineExceeded):
+		// The overall timeout only covers the lookup and the download
+		return missReasonDownloadTimeout
+	default:
+		return ""
+	}
+}
+
+// continuableMissReason returns the miss reason if the configured policies turn the failure into a cache miss,
+// or an empty string if the restore has to fail with err.
+func continuableMissReason(err error, config restoreCacheConfig) string {
+	if errors.Is(err, errInsufficientDiskSpace) {
+		if config.DiskSpacePolicy == DiskSpacePolicySkip {
+			return missReasonInsufficientDiskSpace
+		}
+		return ""
+	}
+	if config.TimeoutPolicy == TimeoutPolicyWarnAndContinue {
+		return timeoutMissReason(err)
+	}
+	return ""
+}
+
+// extractionContext returns the context of the extraction. The overall timeout of the restore covers the lookup and
+// the download only, so the extraction is limited by its own budget (if any).
+func extractionContext(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	ctx = context.WithoutCancel(ctx)
+	if timeout <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// extractionError wraps err with errExtractionTimedOut if the extraction ran out of its time budget.
+func extractionError(ctx context.Context, err error) error {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("%w: %w", errExtractionTimedOut, err)
+	}
+	return fmt.Errorf("failed to decompress cache archive: %w", err)
+}
+
+// removeDownloadedArchive removes the archive downloaded by restorer.download, together with its temp directory.
+func (r *restorer) removeDownloadedArchive(path string) {
+	if err := os.RemoveAll(filepath.Dir(path)); err != nil {
+		r.logger.Debugf("Failed to remove downloaded archive: %s", err)
+	}
+}
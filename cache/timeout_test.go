@@ -0,0 +1,54 @@
+package cache
+
+import (
+	"context"
+	"crypto/rand"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestStreamingTimeoutLeavesTargetUntouched(t *testing.T) {
+	// The first half of the archive has to extract some of the files
+	large := make([]byte, 2<<20)
+	if _, err := rand.Read(large); err != nil {
+		t.Fatal(err)
+	}
+	archive := testArchive(t,
+		archiveEntry{name: "first.txt", content: []byte("first")},
+		archiveEntry{name: "large.bin", content: large},
+		archiveEntry{name: "last.txt", content: []byte("last")},
+	)
+	destination := t.TempDir()
+
+	r := newFakeRestorer(t, fakeDownloader{archives: map[string][]byte{"key": archive}, stall: true})
+	input := testInput(t, destination, "key")
+	input.IsStreaming = true
+	input.Timeout = time.Second
+	input.TimeoutPolicy = TimeoutPolicyWarnAndContinue
+	config, err := r.createConfig(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !config.IsAtomic {
+		t.Errorf("streaming restore with a timeout and the warn-and-continue policy is not staged")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), input.Timeout)
+	defer cancel()
+	result, err := r.restoreArchive(ctx, config, newStepTracker("", r.envRepo, r.logger))
+	if err != nil {
+		t.Fatalf("restoreArchive() error = %s", err)
+	}
+	if result.missReason != missReasonDownloadTimeout || result.outcome != outcomeNotRestored {
+		t.Errorf("miss reason = %s, outcome = %s, want %s and %s", result.missReason, result.outcome, missReasonDownloadTimeout, outcomeNotRestored)
+	}
+
+	entries, err := os.ReadDir(destination)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		t.Errorf("%s was left in the destination directory", entry.Name())
+	}
+}
@@ -1,7 +1,6 @@
 package cache
 
 import (
-	"io/fs"
 	"time"
 
 	"github.com/bitrise-io/go-utils/v2/analytics"
@@ -28,41 +27,26 @@ func newStepTracker(stepId string, envRepo env.Repository, logger log.Logger) st
 	}
 }
 
-func (t *stepTracker) logArchiveUploaded(uploadTime time.Duration, info fs.FileInfo, pathCount int) {
-	properties := analytics.Properties{
-		"upload_time_s":     uploadTime.Truncate(time.Second).Seconds(),
-		"upload_size_bytes": info.Size(),
-		"path_count":        pathCount,
-	}
-	t.tracker.Enqueue("step_save_cache_archive_uploaded", properties)
-}
-
-func (t *stepTracker) logArchiveCompressed(compressionTime time.Duration, pathCount int) {
-	properties := analytics.Properties{
-		"compression_time_s": compressionTime.Truncate(time.Second).Seconds(),
-		"path_count":         pathCount,
-	}
-	t.tracker.Enqueue("step_save_cache_archive_compressed", properties)
-}
-
-func (t *stepTracker) logArchiveDownloaded(downloadTime time.Duration, info fs.FileInfo, keyCount int) {
+func (t *stepTracker) logArchiveDownloaded(downloadTime time.Duration, archiveSize int64, keyCount int, isStreaming bool) {
 	properties := analytics.Properties{
 		"download_time_s":     downloadTime.Truncate(time.Second).Seconds(),
-		"download_size_bytes": info.Size(),
+		"download_size_bytes": archiveSize,
 		"key_count":           keyCount,
+		"is_streaming":        isStreaming,
 	}
 	t.tracker.Enqueue("step_restore_cache_archive_downloaded", properties)
 }
 
-func (t *stepTracker) logArchiveExtracted(extractionTime time.Duration, keyCount int) {
+func (t *stepTracker) logArchiveExtracted(extractionTime time.Duration, keyCount int, isStreaming bool) {
 	properties := analytics.Properties{
 		"extraction_time_s": extractionTime.Truncate(time.Second).Seconds(),
 		"key_count":         keyCount,
+		"is_streaming":      isStreaming,
 	}
 	t.tracker.Enqueue("step_restore_cache_archive_extracted", properties)
 }
 
-func (t *stepTracker) logRestoreResult(isMatch bool, matchedKey string, evaluatedKeys []string) {
+func (t *stepTracker) logRestoreResult(isMatch bool, matchedKey, matchStrategy string, evaluatedKeys []string, isLocalCacheHit bool) {
 	if len(evaluatedKeys) == 0 {
 		return
 	}
@@ -70,27 +54,25 @@ func (t *stepTracker) logRestoreResult(isMatch bool, matchedKey string, evaluate
 	properties := analytics.Properties{
 		"is_match":             isMatch,
 		"is_first_key_matched": matchedKey == evaluatedKeys[0],
+		"match_strategy":       matchStrategy,
 		"key_count":            len(evaluatedKeys),
+		"is_local_cache_hit":   isLocalCacheHit,
 	}
 	t.tracker.Enqueue("step_restore_cache_result", properties)
 }
 
-func (t *stepTracker) logSkipSaveResult(isSaveSkipped bool, reason skipReason) {
-
-	properties := analytics.Properties{
-		"is_save_skipped": isSaveSkipped,
-		"reason":          reason.String(),
+func (t *stepTracker) logLookupResult(isMatch bool, matchedKey, matchStrategy string, evaluatedKeys []string) {
+	if len(evaluatedKeys) == 0 {
+		return
 	}
-	t.tracker.Enqueue("step_save_cache_save_skipped", properties)
-}
-
-func (t *stepTracker) logSkipUploadResult(isUploadSkipped bool, reason skipReason) {
 
 	properties := analytics.Properties{
-		"is_upload_skipped": isUploadSkipped,
-		"reason":            reason.String(),
+		"is_match":             isMatch,
+		"is_first_key_matched": matchedKey == evaluatedKeys[0],
+		"match_strategy":       matchStrategy,
+		"key_count":            len(evaluatedKeys),
 	}
-	t.tracker.Enqueue("step_save_cache_upload_skipped", properties)
+	t.tracker.Enqueue("step_restore_cache_lookup_result", properties)
 }
 
 func (t *stepTracker) wait() {
@@ -4,17 +4,17 @@ go 1.22
 
 require (
 	github.com/bitrise-io/go-steputils/v2 v2.0.0-alpha.46
+	github.com/bitrise-io/go-utils v1.0.15
 	github.com/bitrise-io/go-utils/v2 v2.0.0-alpha.33
+	github.com/bmatcuk/doublestar/v4 v4.9.1
+	github.com/docker/go-units v0.5.0
+	github.com/hashicorp/go-retryablehttp v0.7.7
+	github.com/klauspost/compress v1.18.0
+	golang.org/x/sys v0.22.0
 )
 
 require (
-	github.com/bitrise-io/go-utils v1.0.15 // indirect
-	github.com/bitrise-io/got v0.0.0-20260223134234-6d4aa9f90a75 // indirect
-	github.com/bmatcuk/doublestar/v4 v4.9.1 // indirect
-	github.com/docker/go-units v0.5.0 // indirect
 	github.com/gofrs/uuid/v5 v5.3.2 // indirect
 	github.com/hashicorp/go-cleanhttp v0.5.2 // indirect
-	github.com/hashicorp/go-retryablehttp v0.7.7 // indirect
-	github.com/klauspost/compress v1.18.0 // indirect
 	github.com/mitchellh/mapstructure v1.5.0 // indirect
 )
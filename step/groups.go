@@ -0,0 +1,60 @@
+package step
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/bitrise-steplib/bitrise-step-restore-cache/cache"
+)
+
+var groupNameRegexp = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_]*$`)
+
+// parseCacheGroups parses the cache_groups input. Each group starts with an unindented `name:` line,
+// followed by the group's keys in priority order, one indented key per line:
+//
+//	npm:
+//	  npm-cache-{{ checksum "package-lock.json" }}
+//	  npm-cache-
+//	gradle:
+//	  gradle-cache-{{ checksum "**/*.gradle*" }}
+func parseCacheGroups(input string) ([]cache.CacheGroup, error) {
+	var groups []cache.CacheGroup
+	seenNames := map[string]bool{}
+
+	for i, line := range strings.Split(input, "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+
+		isIndented := strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")
+		if !isIndented {
+			name := strings.TrimSuffix(strings.TrimSpace(line), ":")
+			if !strings.HasSuffix(strings.TrimSpace(line), ":") || !groupNameRegexp.MatchString(name) {
+				return nil, fmt.Errorf("line %d: expected a group name like `npm:` (letters, digits and underscores), got: %s", i+1, line)
+			}
+			upperName := strings.ToUpper(name)
+			if seenNames[upperName] {
+				return nil, fmt.Errorf("line %d: duplicate group name: %s", i+1, name)
+			}
+			seenNames[upperName] = true
+
+			groups = append(groups, cache.CacheGroup{Name: name})
+			continue
+		}
+
+		if len(groups) == 0 {
+			return nil, fmt.Errorf("line %d: key is not part of any group: %s", i+1, line)
+		}
+		current := &groups[len(groups)-1]
+		current.Keys = append(current.Keys, strings.TrimSpace(line))
+	}
+
+	for _, group := range groups {
+		if len(group.Keys) == 0 {
+			return nil, fmt.Errorf("group %s has no keys", group.Name)
+		}
+	}
+
+	return groups, nil
+}
@@ -5,18 +5,65 @@ import (
 	"strings"
 	"time"
 
-	"github.com/bitrise-io/go-steputils/v2/cache"
 	"github.com/bitrise-io/go-steputils/v2/stepconf"
 	"github.com/bitrise-io/go-utils/v2/command"
 	"github.com/bitrise-io/go-utils/v2/env"
 	"github.com/bitrise-io/go-utils/v2/log"
+	"github.com/bitrise-steplib/bitrise-step-restore-cache/cache"
+	"github.com/bitrise-steplib/bitrise-step-restore-cache/cache/network"
+	"github.com/docker/go-units"
 )
 
 type Input struct {
 	Verbose        bool   `env:"verbose,required"`
-	Key            string `env:"key,required"`
+	Key            string `env:"key"`
+	BaseKey        string `env:"base_key"`
+	DefaultBranch  string `env:"default_branch"`
+	StrictKeys     bool   `env:"strict_keys,opt[true,false]"`
+	CacheGroups    string `env:"cache_groups"`
 	NumFullRetries int    `env:"retries,required"`
 	Timeout        int64  `env:"timeout,required"`
+	// Phase timeouts are in seconds, 0 means no limit
+	LookupTimeout     int64  `env:"lookup_timeout,range[0..86400]"`
+	DownloadTimeout   int64  `env:"download_timeout,range[0..86400]"`
+	ExtractionTimeout int64  `env:"extraction_timeout,range[0..86400]"`
+	TimeoutPolicy     string `env:"timeout_policy,opt[fail,warn-and-continue]"`
+	DiskSpacePolicy   string `env:"disk_space_policy,opt[fail,skip]"`
+	// ProgressInterval is in seconds, 0 disables progress reporting
+	ProgressInterval int64  `env:"progress_interval,range[0..3600]"`
+	IsStreaming      bool   `env:"streaming,opt[true,false]"`
+	IsLookupOnly     bool   `env:"lookup_only,opt[true,false]"`
+	Destination      string `env:"destination"`
+	PathMappings     string `env:"path_mappings"`
+	AtomicRestore    bool   `env:"atomic_restore,opt[true,false]"`
+	SafeExtraction   bool   `env:"safe_extraction,opt[true,false]"`
+	AllowedPaths     string `env:"allowed_paths"`
+	LocalCacheDir    string `env:"local_cache_dir"`
+	LocalCacheSize   string `env:"local_cache_max_size,required"`
+
+	StorageBackend    string          `env:"storage_backend,opt[bitrise,s3,filesystem]"`
+	StoragePath       string          `env:"storage_path"`
+	S3Endpoint        string          `env:"s3_endpoint"`
+	S3Region          string          `env:"s3_region"`
+	S3AccessKeyID     stepconf.Secret `env:"s3_access_key_id"`
+	S3SecretAccessKey stepconf.Secret `env:"s3_secret_access_key"`
+	S3SessionToken    stepconf.Secret `env:"s3_session_token"`
+
+	// Network tuning inputs are empty unless the input (or the legacy env var it defaults to) is set.
+	// 0 selects the default, like an unset legacy env var did.
+	MaxConcurrency      *int  `env:"max_concurrency,range[0..64]"`
+	MaxIdleConns        *int  `env:"max_idle_conns,range[0..1000]"`
+	MaxIdleConnsPerHost *int  `env:"max_idle_conns_per_host,range[0..1000]"`
+	ForceAttemptHTTP2   *bool `env:"force_attempt_http2"`
+	DualStack           *bool `env:"dual_stack"`
+	MaxRetryPerChunk    *int  `env:"max_retry_per_chunk,range[0..100]"`
+	ChunkRetryThreshold *int  `env:"chunk_retry_threshold,range[0..3600]"`
+
+	ProxyURL         stepconf.Secret `env:"proxy_url"`
+	DownloadProxyURL stepconf.Secret `env:"download_proxy_url"`
+	CABundlePath     string          `env:"ca_bundle_path"`
+	ClientCertPath   string          `env:"client_cert_path"`
+	ClientKeyPath    string          `env:"client_key_path"`
 }
 
 type RestoreCacheStep struct {
@@ -47,17 +94,98 @@ func (step RestoreCacheStep) Run() error {
 	}
 	stepconf.Print(input)
 
-	if strings.TrimSpace(input.Key) == "" {
-		return fmt.Errorf("required input 'key' is empty")
+	hasKey := strings.TrimSpace(input.Key) != "" || strings.TrimSpace(input.BaseKey) != ""
+	hasCacheGroups := strings.TrimSpace(input.CacheGroups) != ""
+	if !hasKey && !hasCacheGroups {
+		return fmt.Errorf("either the 'key', the 'base_key' or the 'cache_groups' input has to be provided")
+	}
+	if hasKey && hasCacheGroups {
+		return fmt.Errorf("the 'key' and 'base_key' inputs can't be used together with 'cache_groups'")
+	}
+
+	var groups []cache.CacheGroup
+	if hasCacheGroups {
+		var err error
+		groups, err = parseCacheGroups(input.CacheGroups)
+		if err != nil {
+			return fmt.Errorf("invalid 'cache_groups' input: %w", err)
+		}
+	}
+
+	localCacheMaxSize, err := units.FromHumanSize(input.LocalCacheSize)
+	if err != nil {
+		return fmt.Errorf("invalid 'local_cache_max_size' input: %w", err)
 	}
 
 	step.logger.EnableDebugLog(input.Verbose)
 
 	return cache.NewRestorer(step.envRepo, step.logger, step.commandFactory, nil).Restore(cache.RestoreCacheInput{
-		StepId:         "restore-cache",
-		Verbose:        input.Verbose,
-		Keys:           strings.Split(input.Key, "\n"),
-		Timeout:        time.Duration(input.Timeout) * time.Second,
-		NumFullRetries: input.NumFullRetries,
+		StepId:               "restore-cache",
+		Verbose:              input.Verbose,
+		Keys:                 strings.Split(input.Key, "\n"),
+		BaseKey:              input.BaseKey,
+		DefaultBranch:        input.DefaultBranch,
+		IsStrictKeys:         input.StrictKeys,
+		Timeout:              time.Duration(input.Timeout) * time.Second,
+		LookupTimeout:        time.Duration(input.LookupTimeout) * time.Second,
+		DownloadTimeout:      time.Duration(input.DownloadTimeout) * time.Second,
+		ExtractionTimeout:    time.Duration(input.ExtractionTimeout) * time.Second,
+		TimeoutPolicy:        cache.TimeoutPolicy(input.TimeoutPolicy),
+		DiskSpacePolicy:      cache.DiskSpacePolicy(input.DiskSpacePolicy),
+		ProgressInterval:     time.Duration(input.ProgressInterval) * time.Second,
+		NumFullRetries:       input.NumFullRetries,
+		IsStreaming:          input.IsStreaming,
+		IsLookupOnly:         input.IsLookupOnly,
+		Groups:               groups,
+		DestinationDirectory: input.Destination,
+		PathMappings:         strings.Split(input.PathMappings, "\n"),
+		IsAtomic:             input.AtomicRestore,
+		IsSafeExtraction:     input.SafeExtraction,
+		AllowedPaths:         strings.Split(input.AllowedPaths, "\n"),
+		LocalCacheDirectory:  input.LocalCacheDir,
+		LocalCacheMaxSize:    localCacheMaxSize,
+		Storage: network.StorageConfig{
+			Backend:           network.StorageBackend(input.StorageBackend),
+			Path:              input.StoragePath,
+			S3Endpoint:        input.S3Endpoint,
+			S3Region:          input.S3Region,
+			S3AccessKeyID:     string(input.S3AccessKeyID),
+			S3SecretAccessKey: string(input.S3SecretAccessKey),
+			S3SessionToken:    string(input.S3SessionToken),
+		},
+		DownloadTuning: downloadTuning(input),
+		Network: network.NetworkConfig{
+			ProxyURL:         string(input.ProxyURL),
+			DownloadProxyURL: string(input.DownloadProxyURL),
+			CABundlePath:     input.CABundlePath,
+			ClientCertPath:   input.ClientCertPath,
+			ClientKeyPath:    input.ClientKeyPath,
+		},
 	})
 }
+
+func downloadTuning(input Input) network.DownloadTuning {
+	var tuning network.DownloadTuning
+	if input.MaxConcurrency != nil {
+		tuning.MaxConcurrency = uint(*input.MaxConcurrency)
+	}
+	if input.MaxIdleConns != nil {
+		tuning.MaxIdleConns = *input.MaxIdleConns
+	}
+	if input.MaxIdleConnsPerHost != nil {
+		tuning.MaxIdleConnsPerHost = *input.MaxIdleConnsPerHost
+	}
+	if input.ForceAttemptHTTP2 != nil {
+		tuning.ForceAttemptHTTP2 = *input.ForceAttemptHTTP2
+	}
+	if input.DualStack != nil {
+		tuning.DualStack = *input.DualStack
+	}
+	if input.MaxRetryPerChunk != nil {
+		tuning.MaxRetryPerChunk = *input.MaxRetryPerChunk
+	}
+	if input.ChunkRetryThreshold != nil {
+		tuning.ChunkRetryThreshold = time.Duration(*input.ChunkRetryThreshold) * time.Second
+	}
+	return tuning
+}
@@ -0,0 +1,109 @@
+package step
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bitrise-io/go-steputils/v2/stepconf"
+	"github.com/bitrise-io/go-utils/v2/env"
+	"github.com/bitrise-steplib/bitrise-step-restore-cache/cache/network"
+)
+
+// defaultInputs are the step.yml defaults of the required inputs and the inputs with value options.
+var defaultInputs = map[string]string{
+	"verbose":              "false",
+	"strict_keys":          "false",
+	"retries":              "3",
+	"timeout":              "600",
+	"timeout_policy":       "fail",
+	"disk_space_policy":    "fail",
+	"streaming":            "false",
+	"lookup_only":          "false",
+	"atomic_restore":       "true",
+	"safe_extraction":      "false",
+	"local_cache_max_size": "10GB",
+	"storage_backend":      "bitrise",
+}
+
+func TestDownloadTuningInputs(t *testing.T) {
+	tests := []struct {
+		name    string
+		envs    map[string]string
+		want    network.DownloadTuning
+		wantErr bool
+	}{
+		{
+			name: "empty inputs",
+			want: network.DownloadTuning{},
+		},
+		{
+			name: "values in range",
+			envs: map[string]string{
+				"max_concurrency":         "16",
+				"max_idle_conns":          "0",
+				"max_idle_conns_per_host": "100",
+				"force_attempt_http2":     "true",
+				"max_retry_per_chunk":     "3",
+				"chunk_retry_threshold":   "30",
+			},
+			want: network.DownloadTuning{
+				MaxConcurrency:      16,
+				MaxIdleConnsPerHost: 100,
+				ForceAttemptHTTP2:   true,
+				MaxRetryPerChunk:    3,
+				ChunkRetryThreshold: 30 * time.Second,
+			},
+		},
+		{
+			// 0 is what the legacy env vars used for the default
+			name: "zero values select the defaults",
+			envs: map[string]string{"max_concurrency": "0", "max_retry_per_chunk": "0", "chunk_retry_threshold": "0"},
+			want: network.DownloadTuning{},
+		},
+		{
+			name:    "concurrency out of range",
+			envs:    map[string]string{"max_concurrency": "128"},
+			wantErr: true,
+		},
+		{
+			name:    "negative idle connections",
+			envs:    map[string]string{"max_idle_conns": "-1"},
+			wantErr: true,
+		},
+		{
+			name:    "chunk retry threshold out of range",
+			envs:    map[string]string{"chunk_retry_threshold": "7200"},
+			wantErr: true,
+		},
+		{
+			name:    "non-numeric value",
+			envs:    map[string]string{"max_retry_per_chunk": "many"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for key, value := range defaultInputs {
+				t.Setenv(key, value)
+			}
+			for _, key := range []string{"max_concurrency", "max_idle_conns", "max_idle_conns_per_host", "force_attempt_http2", "dual_stack", "max_retry_per_chunk", "chunk_retry_threshold"} {
+				t.Setenv(key, tt.envs[key])
+			}
+
+			var input Input
+			err := stepconf.NewInputParser(env.NewRepository()).Parse(&input)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("Parse() succeeded, want an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Parse() error = %s", err)
+			}
+			if got := downloadTuning(input); got != tt.want {
+				t.Errorf("downloadTuning() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}